@@ -3,4 +3,4 @@ set -e
 
 echo "loading schema for tests..."
 echo "drop database if exists fieri_test; create database fieri_test" | psql $POSTGRES_CONN
-migrate -url "$POSTGRES_CONN" -path ./migrations up
+go run ./cmd/fieri migrate up
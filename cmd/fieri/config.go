@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+	"flag"
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/fieri/service"
+	"github.com/opsee/fieri/store"
+	"github.com/opsee/fieri/webhooks"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errMissingPostgres    = errors.New("You have to give me a postgres connection with --postgres or the POSTGRES_CONN env var")
+	errMissingAddr        = errors.New("You have to give me a listening address with --addr or the FIERI_HTTP_ADDR env var")
+	errMissingLookupd     = errors.New("You'll need to give me nsqlookupd connection(s) with --lookupd or the LOOKUPD_HOSTS env var (comma-separated)")
+	errMissingTopic       = errors.New("You have to give me a topic to consume with --topic or the BASTION_DISCOVERY_TOPIC env var")
+	errMissingCustomer    = errors.New("You have to give me a customer with --customer")
+	errMissingSecret      = errors.New("You have to give me the webhook's signing secret with --secret")
+	errInvalidMaxAttempts = errors.New("--max-attempts (FIERI_NSQ_MAX_ATTEMPTS) can be at most 65535")
+	errInvalidBatch       = errors.New("--batch-size (FIERI_NSQ_BATCH_SIZE) and --batch-wait (FIERI_NSQ_BATCH_WAIT) must be positive")
+	errInvalidWebhooks    = errors.New("--webhook-timeout (FIERI_WEBHOOK_TIMEOUT) and --webhook-max-failures (FIERI_WEBHOOK_MAX_FAILURES) must be positive")
+)
+
+// envDuration reads a duration from the environment, for use as a flag
+// default.
+func envDuration(name string, def time.Duration) time.Duration {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		log.Fatalf("%s must be a duration (e.g. 30s): %s", name, err)
+	}
+
+	return d
+}
+
+// envInt reads an integer from the environment, for use as a flag default.
+func envInt(name string, def int) int {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatalf("%s must be a number: %s", name, err)
+	}
+
+	return i
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, ",")
+}
+
+type storeOptions struct {
+	postgres string
+}
+
+func (o *storeOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.postgres, "postgres", os.Getenv("POSTGRES_CONN"), "postgres connection string (POSTGRES_CONN)")
+}
+
+func (o *storeOptions) open() (store.Store, error) {
+	if o.postgres == "" {
+		return nil, errMissingPostgres
+	}
+
+	return store.NewPostgres(o.postgres, 60, 120)
+}
+
+type runOptions struct {
+	adminAddr       string
+	shutdownTimeout time.Duration
+	ingest          ingestOptions
+}
+
+func (o *runOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.adminAddr, "admin-addr", os.Getenv("FIERI_ADMIN_ADDR"), "listening address for /metrics (FIERI_ADMIN_ADDR)")
+	fs.DurationVar(&o.shutdownTimeout, "shutdown-timeout", envDuration("FIERI_SHUTDOWN_TIMEOUT", 30*time.Second), "time allowed for a graceful shutdown (FIERI_SHUTDOWN_TIMEOUT)")
+	o.ingest.register(fs)
+}
+
+// ingestOptions pause ingestion in this process regardless of the pauses
+// set through the admin api.
+type ingestOptions struct {
+	paused          bool
+	pausedCustomers string
+	pausedTypes     string
+	refresh         time.Duration
+}
+
+func (o *ingestOptions) register(fs *flag.FlagSet) {
+	fs.BoolVar(&o.paused, "ingest-paused", os.Getenv("FIERI_INGEST_PAUSED") == "true", "pause storing every nsq message (FIERI_INGEST_PAUSED)")
+	fs.StringVar(&o.pausedCustomers, "ingest-paused-customers", os.Getenv("FIERI_INGEST_PAUSED_CUSTOMERS"), "comma-separated customer ids whose messages aren't stored (FIERI_INGEST_PAUSED_CUSTOMERS)")
+	fs.StringVar(&o.pausedTypes, "ingest-paused-types", os.Getenv("FIERI_INGEST_PAUSED_TYPES"), "comma-separated entity types that aren't stored, e.g. Instance (FIERI_INGEST_PAUSED_TYPES)")
+	fs.DurationVar(&o.refresh, "ingest-refresh", envDuration("FIERI_INGEST_REFRESH", 5*time.Second), "how often pauses set through the admin api are reloaded (FIERI_INGEST_REFRESH)")
+}
+
+func (o *ingestOptions) pauses() []*store.IngestPause {
+	pauses := make([]*store.IngestPause, 0)
+
+	if o.paused {
+		pauses = append(pauses, &store.IngestPause{Scope: store.GlobalIngestScope, Reason: "FIERI_INGEST_PAUSED"})
+	}
+
+	for _, customerId := range splitList(o.pausedCustomers) {
+		pauses = append(pauses, &store.IngestPause{Scope: store.CustomerIngestScope, Value: customerId, Reason: "FIERI_INGEST_PAUSED_CUSTOMERS"})
+	}
+
+	for _, entityType := range splitList(o.pausedTypes) {
+		pauses = append(pauses, &store.IngestPause{Scope: store.TypeIngestScope, Value: entityType, Reason: "FIERI_INGEST_PAUSED_TYPES"})
+	}
+
+	return pauses
+}
+
+type serveOptions struct {
+	addr            string
+	adminToken      string
+	hmacKeys        string
+	jwtHMACKeys     string
+	jwtRSAKeys      string
+	staleAfter      time.Duration
+	staleTopic      string
+	staleWebhook    string
+	nsqd            string
+	eventsRetention time.Duration
+	prices          string
+	webhooks        webhookOptions
+}
+
+func (o *serveOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.addr, "addr", os.Getenv("FIERI_HTTP_ADDR"), "listening address for the api (FIERI_HTTP_ADDR)")
+	fs.StringVar(&o.adminToken, "admin-token", os.Getenv("FIERI_ADMIN_TOKEN"), "static admin bearer token (FIERI_ADMIN_TOKEN)")
+	fs.StringVar(&o.hmacKeys, "hmac-keys", os.Getenv("FIERI_HMAC_KEYS"), "comma-separated keys for hmac bearer tokens (FIERI_HMAC_KEYS)")
+	fs.StringVar(&o.jwtHMACKeys, "jwt-hmac-keys", os.Getenv("FIERI_JWT_HMAC_KEYS"), "comma-separated keys for HS256 JWTs (FIERI_JWT_HMAC_KEYS)")
+	fs.StringVar(&o.jwtRSAKeys, "jwt-rsa-keys", os.Getenv("FIERI_JWT_RSA_KEYS"), "comma-separated PEM public key files for RS256 JWTs (FIERI_JWT_RSA_KEYS)")
+	fs.DurationVar(&o.staleAfter, "stale-after", envDuration("FIERI_STALE_AFTER", 10*time.Minute), "time since last sync before a customer is stale (FIERI_STALE_AFTER)")
+	fs.StringVar(&o.staleTopic, "stale-topic", os.Getenv("FIERI_STALE_TOPIC"), "nsq topic for stale inventory events (FIERI_STALE_TOPIC)")
+	fs.StringVar(&o.staleWebhook, "stale-webhook", os.Getenv("FIERI_STALE_WEBHOOK"), "url to POST stale inventory events to (FIERI_STALE_WEBHOOK)")
+	fs.StringVar(&o.nsqd, "nsqd", os.Getenv("NSQD_HOST"), "nsqd address for publishing (NSQD_HOST)")
+	fs.DurationVar(&o.eventsRetention, "events-retention", envDuration("FIERI_EVENTS_RETENTION", 24*time.Hour), "how long inventory events are kept for /events clients to resume from (FIERI_EVENTS_RETENTION)")
+	fs.StringVar(&o.prices, "prices", os.Getenv("FIERI_PRICES"), "json price table merged over the bundled one for cost estimates (FIERI_PRICES)")
+	o.webhooks.register(fs)
+}
+
+type webhookOptions struct {
+	timeout      time.Duration
+	maxFailures  int
+	retention    time.Duration
+	allowPrivate bool
+}
+
+func (o *webhookOptions) register(fs *flag.FlagSet) {
+	fs.DurationVar(&o.timeout, "webhook-timeout", envDuration("FIERI_WEBHOOK_TIMEOUT", 10*time.Second), "time allowed for a webhook to respond to a delivery (FIERI_WEBHOOK_TIMEOUT)")
+	fs.IntVar(&o.maxFailures, "webhook-max-failures", envInt("FIERI_WEBHOOK_MAX_FAILURES", 10), "consecutive failed deliveries before a webhook is disabled (FIERI_WEBHOOK_MAX_FAILURES)")
+	fs.DurationVar(&o.retention, "webhook-delivery-retention", envDuration("FIERI_WEBHOOK_DELIVERY_RETENTION", 7*24*time.Hour), "how long the webhook delivery log is kept (FIERI_WEBHOOK_DELIVERY_RETENTION)")
+	fs.BoolVar(&o.allowPrivate, "webhook-allow-private", os.Getenv("FIERI_WEBHOOK_ALLOW_PRIVATE") == "true", "allow webhooks at private, loopback and link-local addresses, e.g. a local webhook-sink (FIERI_WEBHOOK_ALLOW_PRIVATE)")
+}
+
+func (o *webhookOptions) config() *webhooks.Config {
+	return &webhooks.Config{
+		Interval:     time.Second,
+		Timeout:      o.timeout,
+		MaxFailures:  o.maxFailures,
+		Retention:    o.retention,
+		AllowPrivate: o.allowPrivate,
+	}
+}
+
+func (o *serveOptions) authenticator() (service.Authenticator, error) {
+	authenticators := make([]service.Authenticator, 0)
+
+	if o.adminToken != "" {
+		authenticators = append(authenticators, service.NewStaticAdminAuthenticator(o.adminToken))
+	}
+
+	if o.hmacKeys != "" {
+		authenticators = append(authenticators, service.NewHMACAuthenticator(splitList(o.hmacKeys)...))
+	}
+
+	if o.jwtHMACKeys != "" || o.jwtRSAKeys != "" {
+		rsaKeys := make([]*rsa.PublicKey, 0)
+		for _, path := range splitList(o.jwtRSAKeys) {
+			key, err := service.LoadRSAPublicKey(path)
+			if err != nil {
+				return nil, err
+			}
+			rsaKeys = append(rsaKeys, key)
+		}
+
+		authenticators = append(authenticators, service.NewJWTAuthenticator(splitList(o.jwtHMACKeys), rsaKeys))
+	}
+
+	if len(authenticators) == 0 {
+		log.Warn("no credentials are configured (--admin-token, --hmac-keys, --jwt-hmac-keys, --jwt-rsa-keys), every authenticated route will answer 401")
+	}
+
+	return service.NewAuthenticator(authenticators...), nil
+}
+
+type consumeOptions struct {
+	lookupds     string
+	topic        string
+	maxAttempts  uint
+	requeueDelay time.Duration
+	batchSize    int
+	batchWait    time.Duration
+}
+
+func (o *consumeOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.lookupds, "lookupd", os.Getenv("LOOKUPD_HOSTS"), "comma-separated nsqlookupd addresses (LOOKUPD_HOSTS)")
+	fs.StringVar(&o.topic, "topic", os.Getenv("BASTION_DISCOVERY_TOPIC"), "nsq topic to consume (BASTION_DISCOVERY_TOPIC)")
+	fs.UintVar(&o.maxAttempts, "max-attempts", uint(envInt("FIERI_NSQ_MAX_ATTEMPTS", 5)), "attempts at a transiently failing message before dead-lettering it, 0 for no limit (FIERI_NSQ_MAX_ATTEMPTS)")
+	fs.DurationVar(&o.requeueDelay, "requeue-delay", envDuration("FIERI_NSQ_REQUEUE_DELAY", 10*time.Second), "requeue delay, multiplied by the message's attempts (FIERI_NSQ_REQUEUE_DELAY)")
+	fs.IntVar(&o.batchSize, "batch-size", envInt("FIERI_NSQ_BATCH_SIZE", 100), "most messages per customer written in one transaction (FIERI_NSQ_BATCH_SIZE)")
+	fs.DurationVar(&o.batchWait, "batch-wait", envDuration("FIERI_NSQ_BATCH_WAIT", time.Second), "longest a message waits for its batch to fill (FIERI_NSQ_BATCH_WAIT)")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/opsee/fieri/store"
+	"time"
+)
+
+func runExpire(args []string) error {
+	var storeOpts storeOptions
+
+	fs := flag.NewFlagSet("expire", flag.ExitOnError)
+	storeOpts.register(fs)
+	customerId := fs.String("customer", "", "customer id to expire entities for")
+	threshold := fs.Duration("threshold", 120*time.Second, "expire entities last seen this long before the customer's last sync")
+	fs.Parse(args)
+
+	if *customerId == "" {
+		return errMissingCustomer
+	}
+
+	db, err := storeOpts.open()
+	if err != nil {
+		return err
+	}
+	defer db.Stop(time.Second)
+
+	// expire relative to the last sync rather than now, so a customer whose
+	// bastion is down doesn't lose its whole inventory
+	customer, err := db.GetCustomer(&store.CustomerRequest{Id: *customerId})
+	if err != nil {
+		return err
+	}
+
+	before := customer.Customer.LastSync.Add(-1 * *threshold)
+	response, err := db.ExpireEntities(&store.ExpireRequest{CustomerId: *customerId, Before: before})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("expired %d groups and %d instances last seen before %s\n", response.Groups, response.Instances, before.Format(time.RFC3339))
+	return nil
+}
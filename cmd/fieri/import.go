@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/fieri/consumer"
+	"github.com/opsee/fieri/store"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// bastion events can carry large entities, e.g. ASGs with many instances
+	maxEventSize = 16 * 1024 * 1024
+)
+
+var errMissingFiles = errors.New("You have to give me files to import")
+
+// unownedDescribeKeys are the describe output whose items don't say which
+// account they're in, so importing them needs --account.
+var unownedDescribeKeys = map[string]bool{
+	"LoadBalancerDescriptions": true,
+	"DBInstances":              true,
+	"RouteTables":              true,
+	"Subnets":                  true,
+}
+
+// describeKeys maps the top level keys of aws cli describe-* output (see
+// fixtures/) to the entity type of the items under them.
+var describeKeys = map[string]string{
+	"SecurityGroups":           store.SecurityGroupEntityType,
+	"LoadBalancerDescriptions": store.ELBEntityType,
+	"AutoScalingGroups":        store.AutoScalingGroupEntityType,
+	"DBInstances":              store.DBInstanceEntityType,
+	"DBSecurityGroups":         store.DBSecurityGroupEntityType,
+	"RouteTables":              store.RouteTableEntityType,
+	"Subnets":                  store.SubnetEntityType,
+}
+
+type importCounts struct {
+	imported int
+	updated  int
+	rejected int
+}
+
+// importer puts entities from files for one customer, counting the results
+// by entity type.
+type importer struct {
+	db         store.Store
+	customerId string
+	region     string
+	accountId  string
+	counts     map[string]*importCounts
+}
+
+func runImport(args []string) error {
+	var storeOpts storeOptions
+
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	storeOpts.register(fs)
+	customerId := fs.String("customer", "", "customer id to import entities for")
+	region := fs.String("region", "", "region of the imported entities, overriding the files")
+	accountId := fs.String("account", "", "aws account id of the imported entities, overriding the files; required for describe output that doesn't say")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: fieri import --customer <id> [flags] <files...>")
+		fmt.Fprintln(os.Stderr, "\nfiles are aws cli describe-* output or newline delimited bastion events")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *customerId == "" {
+		return errMissingCustomer
+	}
+
+	if fs.NArg() == 0 {
+		return errMissingFiles
+	}
+
+	db, err := storeOpts.open()
+	if err != nil {
+		return err
+	}
+	defer db.Stop(time.Second)
+
+	imp := &importer{
+		db:         db,
+		customerId: *customerId,
+		region:     *region,
+		accountId:  *accountId,
+		counts:     make(map[string]*importCounts),
+	}
+
+	for _, path := range fs.Args() {
+		if err := imp.importFile(path); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	imp.printSummary()
+
+	return nil
+}
+
+// importFile imports aws describe output if the file is a single json object
+// with a key we recognize, and newline delimited events otherwise.
+func (imp *importer) importFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	doc := make(map[string]json.RawMessage)
+	if json.Unmarshal(data, &doc) == nil && isDescribeOutput(doc) {
+		return imp.importDescribe(path, doc)
+	}
+
+	return imp.importEvents(path, data)
+}
+
+func isDescribeOutput(doc map[string]json.RawMessage) bool {
+	if _, ok := doc["Reservations"]; ok {
+		return true
+	}
+
+	for key := range doc {
+		if _, ok := describeKeys[key]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (imp *importer) importDescribe(path string, doc map[string]json.RawMessage) error {
+	for key, raw := range doc {
+		logger := log.WithFields(log.Fields{"file": path, "key": key})
+
+		if key == "Reservations" {
+			reservations := []struct {
+				OwnerId   string
+				Instances []json.RawMessage
+			}{}
+
+			if err := json.Unmarshal(raw, &reservations); err != nil {
+				return fmt.Errorf("Reservations: %s", err)
+			}
+
+			for _, reservation := range reservations {
+				for i, item := range reservation.Instances {
+					imp.put(logger.WithField("index", i), store.InstanceEntityType, "", reservation.OwnerId, item)
+				}
+			}
+
+			continue
+		}
+
+		entityType, ok := describeKeys[key]
+		if !ok {
+			logger.Warn("ignoring unrecognized key")
+			continue
+		}
+
+		if unownedDescribeKeys[key] && imp.accountId == "" {
+			return fmt.Errorf("%s don't say which account they're in, give it with --account", key)
+		}
+
+		items := []json.RawMessage{}
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+
+		for i, item := range items {
+			imp.put(logger.WithField("index", i), entityType, "", "", item)
+		}
+	}
+
+	return nil
+}
+
+func (imp *importer) importEvents(path string, data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		logger := log.WithFields(log.Fields{"file": path, "line": line})
+
+		event := &consumer.Event{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			logger.WithError(err).Warn("rejected malformed event")
+			imp.count("unknown").rejected++
+			continue
+		}
+
+		imp.put(logger, event.MessageType, event.Region, event.AccountId, []byte(event.MessageBody))
+	}
+
+	return scanner.Err()
+}
+
+// put stores one entity, letting the --region and --account flags override
+// whatever the file said.
+func (imp *importer) put(logger *log.Entry, entityType, region, accountId string, blob []byte) {
+	if imp.region != "" {
+		region = imp.region
+	}
+
+	if imp.accountId != "" {
+		accountId = imp.accountId
+	}
+
+	var (
+		entity interface{}
+		err    error
+	)
+
+	if entityType == store.DBSecurityGroupEntityType {
+		// the consumer drops these too, there's nowhere to put them
+		err = fmt.Errorf("%s entities aren't stored", entityType)
+	} else {
+		entity, err = store.NewEntity(entityType, imp.customerId, region, accountId, blob)
+	}
+
+	var response *store.EntityResponse
+	if err == nil {
+		response, err = imp.db.PutEntity(entity)
+	}
+
+	if err != nil {
+		logger.WithError(err).Warn("rejected entity")
+		imp.count(entityType).rejected++
+		return
+	}
+
+	if response.Created {
+		imp.count(entityType).imported++
+	} else {
+		imp.count(entityType).updated++
+	}
+}
+
+func (imp *importer) count(entityType string) *importCounts {
+	c, ok := imp.counts[entityType]
+	if !ok {
+		c = &importCounts{}
+		imp.counts[entityType] = c
+	}
+	return c
+}
+
+func (imp *importer) printSummary() {
+	types := make([]string, 0, len(imp.counts))
+	for t := range imp.counts {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	fmt.Printf("%-24s %8s %8s %8s\n", "type", "imported", "updated", "rejected")
+	for _, t := range types {
+		c := imp.counts[t]
+		fmt.Printf("%-24s %8d %8d %8d\n", t, c.imported, c.updated, c.rejected)
+	}
+}
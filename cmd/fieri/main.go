@@ -1,58 +1,60 @@
 package main
 
 import (
+	"fmt"
 	log "github.com/Sirupsen/logrus"
-
-	"github.com/opsee/fieri/consumer"
-	"github.com/opsee/fieri/service"
-	"github.com/opsee/fieri/store"
 	"github.com/yeller/yeller-golang"
 	"os"
-	"os/signal"
 	"strings"
 )
 
-func main() {
-	yeller.StartWithErrorHandlerEnvApplicationRoot(os.Getenv("YELLER_KEY"), "production", "/build/src/github.com/opsee/fieri", yeller.NewSilentErrorHandler())
+const usage = `usage: fieri [command] [flags]
 
-	pgConnection := os.Getenv("POSTGRES_CONN")
-	if pgConnection == "" {
-		log.Fatal("You have to give me a postgres connection by setting the POSTGRES_CONN env var")
-	}
+commands:
+  serve                          run the http api and the stale inventory monitor
+  consume                        run the nsq consumer and the expiry loop
+  migrate up|down|status         manage the database schema
+  import --customer <id> <files> load aws describe output or events
+  expire --customer <id>         expire a customer's out of date entities now
+  webhook-sink --secret <secret> print and verify webhook deliveries locally
 
-	db, err := store.NewPostgres(pgConnection, 60, 120)
-	if err != nil {
-		log.Fatal("Error initializing postgres:", err)
-	}
+With no command, fieri serves and consumes in one process. Flags default to
+the environment variable named in their help; run "fieri <command> -h" for them.
+`
 
-	lookupdHosts := os.Getenv("LOOKUPD_HOSTS")
-	if lookupdHosts == "" {
-		log.Fatal("You'll need to give me a nsqlookupd connection(s) by setting the LOOKUPD_HOSTS env var (comma-separated)")
-	}
+func main() {
+	yeller.StartWithErrorHandlerEnvApplicationRoot(os.Getenv("YELLER_KEY"), "production", "/build/src/github.com/opsee/fieri", yeller.NewSilentErrorHandler())
 
-	bastionDiscoveryTopic := os.Getenv("BASTION_DISCOVERY_TOPIC")
-	if bastionDiscoveryTopic == "" {
-		log.Fatal("You have to give me a topic to consume by setting the BASTION_DISCOVERY_TOPIC env var")
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
 
-	lookupds := strings.Split(lookupdHosts, ",")
-	nsqConsumer, err := consumer.NewNsq(lookupds, db, bastionDiscoveryTopic)
-	if err != nil {
-		log.Fatal("Error initializing nsq consumer:", err)
+	var err error
+
+	switch command {
+	case "":
+		err = runAll(args)
+	case "serve":
+		err = runServe(args)
+	case "consume":
+		err = runConsume(args)
+	case "migrate":
+		err = runMigrate(args)
+	case "import":
+		err = runImport(args)
+	case "expire":
+		err = runExpire(args)
+	case "webhook-sink":
+		err = runWebhookSink(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
 	}
 
-	addr := os.Getenv("FIERI_HTTP_ADDR")
-	if addr == "" {
-		log.Fatal("You have to give me a listening address by setting the FIERI_HTTP_ADDR env var")
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	service := service.NewService(db)
-	go service.StartHTTP(addr)
-	go db.Start()
-
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt, os.Kill)
-	<-interrupt
-
-	nsqConsumer.Stop()
 }
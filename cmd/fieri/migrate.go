@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/opsee/fieri/store"
+	"os"
+	"strings"
+)
+
+var errMigrateUsage = errors.New("usage: fieri migrate up|down|status [flags]")
+
+func runMigrate(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errMigrateUsage
+	}
+	action, args := args[0], args[1:]
+
+	var storeOpts storeOptions
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	storeOpts.register(fs)
+	path := fs.String("path", os.Getenv("FIERI_MIGRATIONS"), "directory of migration sql files to use instead of the embedded ones (FIERI_MIGRATIONS)")
+	fs.Parse(args)
+
+	if storeOpts.postgres == "" {
+		return errMissingPostgres
+	}
+
+	migrations, err := store.EmbeddedMigrations()
+	if *path != "" {
+		migrations, err = store.ReadMigrations(os.DirFS(*path))
+	}
+	if err != nil {
+		return fmt.Errorf("reading migrations: %s", err)
+	}
+
+	migrator, err := store.NewMigrator(storeOpts.postgres, migrations)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	switch action {
+	case "up":
+		applied, err := migrator.Up()
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+
+	case "down":
+		reverted, err := migrator.Down()
+		if err != nil {
+			return err
+		}
+
+		if reverted == nil {
+			fmt.Println("no migrations are applied")
+		} else {
+			fmt.Printf("reverted %04d_%s\n", reverted.Version, reverted.Name)
+		}
+
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied"
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, state)
+		}
+
+	default:
+		return errMigrateUsage
+	}
+
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/fieri/consumer"
+	"github.com/opsee/fieri/costs"
+	"github.com/opsee/fieri/events"
+	"github.com/opsee/fieri/ingest"
+	"github.com/opsee/fieri/metrics"
+	"github.com/opsee/fieri/monitor"
+	"github.com/opsee/fieri/service"
+	"github.com/opsee/fieri/webhooks"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// stopper is a running component, stopped in order at shutdown.
+type stopper struct {
+	name string
+	stop func(timeout time.Duration) error
+}
+
+func runServe(args []string) error {
+	var (
+		storeOpts storeOptions
+		runOpts   runOptions
+		serveOpts serveOptions
+	)
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	storeOpts.register(fs)
+	runOpts.register(fs)
+	serveOpts.register(fs)
+	fs.Parse(args)
+
+	return run(&storeOpts, &runOpts, &serveOpts, nil)
+}
+
+func runConsume(args []string) error {
+	var (
+		storeOpts   storeOptions
+		runOpts     runOptions
+		consumeOpts consumeOptions
+	)
+
+	fs := flag.NewFlagSet("consume", flag.ExitOnError)
+	storeOpts.register(fs)
+	runOpts.register(fs)
+	consumeOpts.register(fs)
+	fs.Parse(args)
+
+	return run(&storeOpts, &runOpts, nil, &consumeOpts)
+}
+
+func runAll(args []string) error {
+	var (
+		storeOpts   storeOptions
+		runOpts     runOptions
+		serveOpts   serveOptions
+		consumeOpts consumeOptions
+	)
+
+	fs := flag.NewFlagSet("fieri", flag.ExitOnError)
+	storeOpts.register(fs)
+	runOpts.register(fs)
+	serveOpts.register(fs)
+	consumeOpts.register(fs)
+	fs.Parse(args)
+
+	return run(&storeOpts, &runOpts, &serveOpts, &consumeOpts)
+}
+
+// run starts the api when serveOpts is given and the consumer when
+// consumeOpts is given, then waits for a signal and shuts them down. Each
+// component's stopper is registered before it starts, so if a later one
+// fails to start, those already running are stopped before returning.
+func run(storeOpts *storeOptions, runOpts *runOptions, serveOpts *serveOptions, consumeOpts *consumeOptions) (err error) {
+	db, err := storeOpts.open()
+	if err != nil {
+		return err
+	}
+
+	var (
+		monitorStoppers  []stopper
+		notifierStoppers []stopper
+		consumeStoppers  []stopper
+		serveStoppers    []stopper
+	)
+
+	// notifiers are stopped after the monitor that uses them. stop taking
+	// messages before the http server, so nothing new is written once the
+	// expiry loop and the pool go away
+	stoppers := func() []stopper {
+		all := append([]stopper{}, monitorStoppers...)
+		all = append(all, notifierStoppers...)
+		all = append(all, consumeStoppers...)
+		all = append(all, serveStoppers...)
+		return append(all, stopper{"store", db.Stop})
+	}
+
+	started := false
+	defer func() {
+		if err != nil && !started {
+			log.WithError(err).Error("error starting, stopping what's running")
+			shutdown(runOpts.shutdownTimeout, stoppers())
+		}
+	}()
+
+	// load the pauses before the consumer starts, so it doesn't take
+	// messages it should leave in nsq
+	ingestSwitch := ingest.New(db, runOpts.ingest.refresh, runOpts.ingest.pauses()...)
+	if err = ingestSwitch.Refresh(); err != nil {
+		return err
+	}
+
+	monitorStoppers = append(monitorStoppers, stopper{"ingest switch", func(time.Duration) error {
+		ingestSwitch.Stop()
+		return nil
+	}})
+	go ingestSwitch.Start()
+
+	if consumeOpts != nil {
+		if consumeOpts.lookupds == "" {
+			return errMissingLookupd
+		}
+
+		if consumeOpts.topic == "" {
+			return errMissingTopic
+		}
+
+		if consumeOpts.maxAttempts > math.MaxUint16 {
+			return errInvalidMaxAttempts
+		}
+
+		if consumeOpts.batchSize < 1 || consumeOpts.batchWait <= 0 {
+			return errInvalidBatch
+		}
+
+		// entities are only expired as the consumer stores them, so the
+		// expiry loop runs with it
+		go db.Start()
+
+		nsqConsumer, err := consumer.NewNsq(splitList(consumeOpts.lookupds), db, consumeOpts.topic, ingestSwitch, &consumer.NsqConfig{
+			MaxAttempts:  uint16(consumeOpts.maxAttempts),
+			RequeueDelay: consumeOpts.requeueDelay,
+			BatchSize:    consumeOpts.batchSize,
+			BatchWait:    consumeOpts.batchWait,
+		})
+		if err != nil {
+			return err
+		}
+
+		consumeStoppers = append(consumeStoppers, stopper{"nsq consumer", nsqConsumer.Stop})
+	}
+
+	if serveOpts != nil {
+		if serveOpts.addr == "" {
+			return errMissingAddr
+		}
+
+		if serveOpts.webhooks.timeout <= 0 || serveOpts.webhooks.maxFailures < 1 {
+			return errInvalidWebhooks
+		}
+
+		auth, err := serveOpts.authenticator()
+		if err != nil {
+			return err
+		}
+
+		prices, err := costs.LoadPrices(serveOpts.prices)
+		if err != nil {
+			return err
+		}
+
+		notifiers := make([]monitor.Notifier, 0)
+
+		if serveOpts.staleTopic != "" {
+			nsqNotifier, err := monitor.NewNsqNotifier(serveOpts.nsqd, serveOpts.staleTopic)
+			if err != nil {
+				return err
+			}
+
+			notifiers = append(notifiers, nsqNotifier)
+			notifierStoppers = append(notifierStoppers, stopper{"nsq stale notifier", func(time.Duration) error {
+				nsqNotifier.Stop()
+				return nil
+			}})
+		}
+
+		if serveOpts.staleWebhook != "" {
+			notifiers = append(notifiers, monitor.NewWebhookNotifier(serveOpts.staleWebhook))
+		}
+
+		broker, err := events.New(db, storeOpts.postgres, serveOpts.eventsRetention)
+		if err != nil {
+			return err
+		}
+
+		staleMonitor := monitor.New(db, serveOpts.staleAfter, time.Minute, notifiers...)
+		monitorStoppers = append(monitorStoppers, stopper{"stale monitor", func(time.Duration) error {
+			staleMonitor.Stop()
+			return nil
+		}})
+		go staleMonitor.Start()
+
+		dispatcher := webhooks.New(db, serveOpts.webhooks.config())
+		monitorStoppers = append(monitorStoppers, stopper{"webhook dispatcher", func(time.Duration) error {
+			dispatcher.Stop()
+			return nil
+		}})
+		go dispatcher.Start()
+
+		// end the event streams first, the http server can't drain while
+		// they're open
+		serveStoppers = append(serveStoppers, stopper{"event broker", func(time.Duration) error {
+			broker.Stop()
+			return nil
+		}})
+		go broker.Start()
+
+		svc := service.NewService(db, auth, ingestSwitch, broker, dispatcher, costs.New(prices), staleMonitor)
+		serveStoppers = append(serveStoppers, stopper{"http server", svc.StopHTTP})
+		go svc.StartHTTP(serveOpts.addr)
+	}
+
+	// metrics are served apart from the api so they needn't be exposed with it.
+	// the address is bound here, so one that's taken fails startup
+	if runOpts.adminAddr != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/metrics", metrics.Handler())
+		adminServer := &http.Server{Addr: runOpts.adminAddr, Handler: adminMux}
+
+		listener, err := net.Listen("tcp", runOpts.adminAddr)
+		if err != nil {
+			return err
+		}
+
+		serveStoppers = append(serveStoppers, stopper{"admin server", func(timeout time.Duration) error {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			return adminServer.Shutdown(ctx)
+		}})
+
+		go func() {
+			if err := adminServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.WithError(err).Error("admin server failed")
+			}
+		}()
+	}
+
+	started = true
+	return waitAndShutdown(runOpts.shutdownTimeout, stoppers())
+}
+
+// waitAndShutdown blocks until SIGINT or SIGTERM, then shuts down.
+func waitAndShutdown(timeout time.Duration, stoppers []stopper) error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	sig := <-interrupt
+
+	log.WithFields(log.Fields{"signal": sig, "timeout": timeout}).Info("shutting down")
+
+	return shutdown(timeout, stoppers)
+}
+
+// shutdown stops each component in turn. Every step shares one deadline, so
+// shutdown as a whole is bounded.
+func shutdown(timeout time.Duration, stoppers []stopper) error {
+	deadline := time.Now().Add(timeout)
+	clean := true
+
+	for _, s := range stoppers {
+		remaining := deadline.Sub(time.Now())
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		if err := s.stop(remaining); err != nil {
+			log.WithError(err).WithField("component", s.name).Warn("component did not stop cleanly")
+			clean = false
+		}
+	}
+
+	if !clean {
+		return errors.New("shutdown finished with abandoned work")
+	}
+
+	log.Info("shutdown complete")
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/opsee/fieri/webhooks"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// runWebhookSink serves a stand-in webhook endpoint that verifies and prints
+// each delivery, for trying webhooks out without a real receiver. --status
+// makes it answer every delivery with that status, to watch retries and
+// disabling.
+func runWebhookSink(args []string) error {
+	fs := flag.NewFlagSet("webhook-sink", flag.ExitOnError)
+	addr := fs.String("addr", ":9099", "listening address")
+	secret := fs.String("secret", "", "the webhook's signing secret, deliveries that don't verify are refused")
+	status := fs.Int("status", http.StatusOK, "status to answer verified deliveries with")
+	maxSkew := fs.Duration("max-skew", 5*time.Minute, "oldest delivery timestamp accepted, against replays")
+	fs.Parse(args)
+
+	if *secret == "" {
+		return errMissingSecret
+	}
+
+	handler := func(rw http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		timestamp := r.Header.Get(webhooks.TimestampHeader)
+		if !webhooks.Verify(*secret, timestamp, body, r.Header.Get(webhooks.SignatureHeader)) {
+			fmt.Fprintf(os.Stderr, "refused delivery with a bad signature from %s\n", r.RemoteAddr)
+			http.Error(rw, "bad signature", http.StatusUnauthorized)
+			return
+		}
+
+		sent, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || time.Since(time.Unix(sent, 0)) > *maxSkew {
+			fmt.Fprintf(os.Stderr, "refused delivery with a stale timestamp %q\n", timestamp)
+			http.Error(rw, "stale timestamp", http.StatusUnauthorized)
+			return
+		}
+
+		indented := &bytes.Buffer{}
+		if err := json.Indent(indented, body, "", "  "); err != nil {
+			indented = bytes.NewBuffer(body)
+		}
+
+		fmt.Printf("%s webhook %s event %s (%s), answering %d\n%s\n\n",
+			time.Now().UTC().Format(time.RFC3339),
+			r.Header.Get(webhooks.WebhookIdHeader),
+			r.Header.Get(webhooks.EventIdHeader),
+			r.Header.Get(webhooks.EventHeader),
+			*status,
+			indented)
+
+		rw.WriteHeader(*status)
+	}
+
+	fmt.Fprintf(os.Stderr, "listening for webhook deliveries on %s\n", *addr)
+	return http.ListenAndServe(*addr, http.HandlerFunc(handler))
+}
@@ -0,0 +1,233 @@
+package consumer
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/nsqio/go-nsq"
+	"github.com/opsee/fieri/metrics"
+	"github.com/opsee/fieri/store"
+	"hash/fnv"
+	"time"
+)
+
+var (
+	batchSizes     = metrics.NewHistogram("fieri_nsq_batch_messages", "NSQ messages per batch written.", []float64{1, 5, 10, 25, 50, 100, 250, 500}, "result")
+	batchDuration  = metrics.NewHistogram("fieri_nsq_batch_duration_seconds", "Time to write a batch of NSQ messages.", metrics.DefaultBuckets, "result")
+	batchCoalesced = metrics.NewCounter("fieri_nsq_coalesced_total", "NSQ messages superseded by a later message for the same entity in their batch.", "type")
+)
+
+// batchItem is a decoded message waiting to be written.
+type batchItem struct {
+	message *nsq.Message
+	event   *Event
+	entity  interface{}
+}
+
+// batch is one customer's pending messages. Messages for the same entity
+// are coalesced, only the latest is written, but every message is acked or
+// retried with the batch.
+type batch struct {
+	customerId string
+	started    time.Time
+	size       int
+	keys       []string
+	latest     map[string]*batchItem
+	items      map[string][]*batchItem
+}
+
+func newBatch(customerId string) *batch {
+	return &batch{
+		customerId: customerId,
+		started:    time.Now(),
+		latest:     make(map[string]*batchItem),
+		items:      make(map[string][]*batchItem),
+	}
+}
+
+func (b *batch) add(item *batchItem) {
+	key := entityKey(item.entity)
+
+	if _, ok := b.latest[key]; ok {
+		batchCoalesced.Inc(item.event.MessageType)
+	} else {
+		b.keys = append(b.keys, key)
+	}
+
+	b.latest[key] = item
+	b.items[key] = append(b.items[key], item)
+	b.size++
+}
+
+// entityKey identifies the row an entity is written to.
+func entityKey(entity interface{}) string {
+	switch e := entity.(type) {
+	case *store.Instance:
+		return "instance/" + e.AccountId + "/" + e.Region + "/" + e.Id
+	case *store.Group:
+		return "group/" + e.AccountId + "/" + e.Region + "/" + e.Name
+	case *store.RouteTable:
+		return "route_table/" + e.AccountId + "/" + e.Region + "/" + e.Id
+	case *store.Subnet:
+		return "subnet/" + e.AccountId + "/" + e.Region + "/" + e.Id
+	}
+
+	return ""
+}
+
+// batcher spreads customers over a fixed set of workers, so a customer's
+// batches are written one at a time and never race each other's upserts.
+type batcher struct {
+	workers []*batchWorker
+}
+
+func newBatcher(h *nsqHandler, size, workers int, wait time.Duration) *batcher {
+	b := &batcher{workers: make([]*batchWorker, workers)}
+
+	for i := range b.workers {
+		b.workers[i] = &batchWorker{
+			handler:   h,
+			size:      size,
+			wait:      wait,
+			input:     make(chan *batchItem),
+			batches:   make(map[string]*batch),
+			drainChan: make(chan struct{}),
+			drained:   make(chan struct{}),
+		}
+		go b.workers[i].run()
+	}
+
+	return b
+}
+
+func (b *batcher) add(item *batchItem) {
+	hash := fnv.New32a()
+	hash.Write([]byte(item.event.CustomerId))
+	b.workers[hash.Sum32()%uint32(len(b.workers))].input <- item
+}
+
+// drain writes every pending batch, and from then on writes messages as
+// they arrive, so the consumer can ack what it has in flight and stop.
+func (b *batcher) drain() {
+	for _, w := range b.workers {
+		close(w.drainChan)
+	}
+
+	for _, w := range b.workers {
+		<-w.drained
+	}
+}
+
+type batchWorker struct {
+	handler   *nsqHandler
+	size      int
+	wait      time.Duration
+	input     chan *batchItem
+	batches   map[string]*batch
+	drainChan chan struct{}
+	drained   chan struct{}
+	draining  bool
+}
+
+func (w *batchWorker) run() {
+	ticker := time.NewTicker(w.wait / 4)
+	defer ticker.Stop()
+
+	drainChan := w.drainChan
+
+	for {
+		select {
+		case item := <-w.input:
+			b, ok := w.batches[item.event.CustomerId]
+			if !ok {
+				b = newBatch(item.event.CustomerId)
+				w.batches[item.event.CustomerId] = b
+			}
+
+			b.add(item)
+			if w.draining || b.size >= w.size {
+				w.flush(b)
+			}
+
+		case <-ticker.C:
+			for _, b := range w.batches {
+				if time.Since(b.started) >= w.wait {
+					w.flush(b)
+				}
+			}
+
+		case <-drainChan:
+			w.draining = true
+			for _, b := range w.batches {
+				w.flush(b)
+			}
+			close(w.drained)
+			drainChan = nil
+		}
+	}
+}
+
+// flush writes a batch in one transaction, acking its messages once it
+// commits. A transient failure retries every message. A permanent one is
+// down to some entity in the batch, so the entities are then written one at
+// a time and only the culprit's messages are dead-lettered.
+func (w *batchWorker) flush(b *batch) {
+	delete(w.batches, b.customerId)
+
+	entities := make([]interface{}, len(b.keys))
+	for i, key := range b.keys {
+		entities[i] = b.latest[key].entity
+	}
+
+	err := w.put(b, entities)
+	if err == nil {
+		for _, key := range b.keys {
+			w.finish(b.items[key])
+		}
+		return
+	}
+
+	class := classifyStoreError(err)
+	if class == transientError || len(b.keys) == 1 {
+		for _, key := range b.keys {
+			w.fail(b.items[key], class, err)
+		}
+		return
+	}
+
+	log.WithError(err).WithFields(log.Fields{"customer-id": b.customerId, "messages": b.size}).Warn("batch failed permanently, writing its entities one at a time")
+
+	for _, key := range b.keys {
+		single := &batch{customerId: b.customerId, size: len(b.items[key])}
+		if err := w.put(single, []interface{}{b.latest[key].entity}); err != nil {
+			w.fail(b.items[key], classifyStoreError(err), err)
+		} else {
+			w.finish(b.items[key])
+		}
+	}
+}
+
+func (w *batchWorker) put(b *batch, entities []interface{}) error {
+	start := time.Now()
+	_, err := w.handler.db.PutEntities(&store.PutEntitiesRequest{CustomerId: b.customerId, Entities: entities})
+
+	result := processedResult
+	if err != nil {
+		result = failedResult
+	}
+	batchSizes.Observe(float64(b.size), result)
+	batchDuration.Observe(time.Since(start).Seconds(), result)
+
+	return err
+}
+
+func (w *batchWorker) finish(items []*batchItem) {
+	for _, item := range items {
+		item.message.Finish()
+		messagesHandled.Inc(item.event.MessageType, processedResult)
+	}
+}
+
+func (w *batchWorker) fail(items []*batchItem, class errorClass, err error) {
+	for _, item := range items {
+		w.handler.handleError(item.message, item.event, class, err)
+	}
+}
@@ -1,7 +1,16 @@
 package consumer
 
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/opsee/fieri/store"
+	"time"
+)
+
 type Consumer interface {
-	Stop() error
+	// Stop stops taking messages and waits up to timeout for in-flight
+	// handlers to finish.
+	Stop(timeout time.Duration) error
 }
 
 const (
@@ -10,6 +19,25 @@ const (
 
 type Event struct {
 	CustomerId  string `json:"customer_id,omitempty"`
+	Region      string `json:"region,omitempty"`
+	AccountId   string `json:"account_id,omitempty"`
 	MessageType string `json:"type"`
 	MessageBody string `json:"event"`
 }
+
+// DecodeEntity decodes an NSQ message body into its event and the entity the
+// event describes. The event is returned with any error building the entity,
+// so failures can be attributed to a customer and type.
+func DecodeEntity(body []byte) (*Event, interface{}, error) {
+	event := &Event{}
+	if err := json.Unmarshal(body, event); err != nil {
+		return nil, nil, err
+	}
+
+	entity, err := store.NewEntity(event.MessageType, event.CustomerId, event.Region, event.AccountId, []byte(event.MessageBody))
+	if err == store.ErrUnsupportedType {
+		err = fmt.Errorf("%s: %s", err, event.MessageType)
+	}
+
+	return event, entity, err
+}
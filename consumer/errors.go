@@ -0,0 +1,57 @@
+package consumer
+
+import (
+	"github.com/lib/pq"
+	"github.com/opsee/fieri/store"
+	"net"
+)
+
+type errorClass string
+
+const (
+	// permanentError messages fail the same way however often they're
+	// retried, so they're dead-lettered straight away.
+	permanentError errorClass = "permanent"
+	// transientError messages may be stored on a later attempt, so they're
+	// requeued until they run out of attempts.
+	transientError errorClass = "transient"
+)
+
+// transientPqClasses are the postgres error classes worth retrying:
+// connection exceptions, transaction rollbacks (serialization failures and
+// deadlocks), insufficient resources, operator intervention (cancelled
+// queries, restarts) and system errors.
+var transientPqClasses = map[pq.ErrorClass]bool{
+	"08": true,
+	"40": true,
+	"53": true,
+	"57": true,
+	"58": true,
+}
+
+// classifyStoreError decides whether a failed PutEntity might work if
+// retried; decoding failures never get here, they're always permanent.
+// Errors we don't recognize, e.g. a dropped connection, are treated as
+// transient, since retries are bounded and the message is dead-lettered
+// once they run out.
+func classifyStoreError(err error) errorClass {
+	switch e := err.(type) {
+	case *pq.Error:
+		// 55P03 is lock_not_available
+		if transientPqClasses[e.Code.Class()] || e.Code == "55P03" {
+			return transientError
+		}
+		return permanentError
+
+	case net.Error:
+		return transientError
+	}
+
+	switch err {
+	case store.ErrMissingCustomerId, store.ErrMissingInstanceId, store.ErrMissingGroupId,
+		store.ErrMissingRouteTableId, store.ErrMissingSubnetId, store.ErrUnsupportedType:
+		return permanentError
+	}
+
+	return transientError
+}
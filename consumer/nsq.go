@@ -1,84 +1,228 @@
 package consumer
 
 import (
-	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/nsqio/go-nsq"
+	"github.com/opsee/fieri/ingest"
+	"github.com/opsee/fieri/metrics"
 	"github.com/opsee/fieri/store"
 	"github.com/yeller/yeller-golang"
 	"time"
 )
 
+const (
+	batchWorkers = 4
+
+	processedResult = "processed"
+	requeuedResult  = "requeued"
+	failedResult    = "failed"
+	skippedResult   = "skipped"
+	pausedResult    = "paused"
+	unknownType     = "unknown"
+)
+
+var (
+	messagesHandled = metrics.NewCounter("fieri_nsq_messages_total", "NSQ messages handled by entity type and result (processed, requeued, failed, skipped or paused).", "type", "result")
+	messageErrors   = metrics.NewCounter("fieri_nsq_errors_total", "NSQ message errors by entity type and class (permanent or transient).", "type", "class")
+)
+
 type Nsq struct {
 	consumer *nsq.Consumer
+	batcher  *batcher
+}
+
+// NsqConfig tunes retries and batching.
+type NsqConfig struct {
+	// MaxAttempts is how many times a message that fails transiently is
+	// tried before it's dead-lettered, 0 for no limit.
+	MaxAttempts uint16
+	// RequeueDelay grows the delay before a retry by this much each attempt.
+	RequeueDelay time.Duration
+	// BatchSize caps the messages written in one transaction.
+	BatchSize int
+	// BatchWait is how long a batch gathers messages before it's written.
+	BatchWait time.Duration
 }
 
 type nsqHandler struct {
-	db store.Store
+	db           store.Store
+	ingest       *ingest.Switch
+	batcher      *batcher
+	maxAttempts  uint16
+	requeueDelay time.Duration
 }
 
-func NewNsq(lookupds []string, db store.Store, topic string) (Consumer, error) {
+// NewNsq consumes topic, gathering each customer's messages into batches of
+// up to BatchSize, written in one transaction at most BatchWait after their
+// first message. Messages that fail transiently are requeued up to
+// MaxAttempts times, with nsq's exponential backoff and a requeue delay that
+// grows by RequeueDelay each attempt. While sw pauses ingestion globally the
+// consumer takes no messages, leaving them in nsq.
+func NewNsq(lookupds []string, db store.Store, topic string, sw *ingest.Switch, nsqConfig *NsqConfig) (Consumer, error) {
+	// enough messages in flight to fill a batch for every worker
+	maxInFlight := nsqConfig.BatchSize * batchWorkers
+
 	config := nsq.NewConfig()
-	config.MaxInFlight = 4
+	config.MaxInFlight = maxInFlight
+	// nsq finishes messages past its max attempts before they reach the
+	// handler, which would lose a message requeued because dead-lettering
+	// it failed. the handler counts attempts itself instead
+	config.MaxAttempts = 0
+	config.DefaultRequeueDelay = nsqConfig.RequeueDelay
+	if config.MsgTimeout < 2*nsqConfig.BatchWait {
+		config.MsgTimeout = 2 * nsqConfig.BatchWait
+	}
+	if sw.State().Global {
+		config.MaxInFlight = 0
+	}
+
 	consumer, err := nsq.NewConsumer(topic, Channel, config)
 	if err != nil {
 		return nil, err
 	}
 
-	handler := &nsqHandler{db: db}
-	consumer.AddConcurrentHandlers(handler, 4)
+	sw.OnGlobalChange(func(paused bool) {
+		if paused {
+			consumer.ChangeMaxInFlight(0)
+		} else {
+			consumer.ChangeMaxInFlight(maxInFlight)
+		}
+	})
+
+	handler := &nsqHandler{db: db, ingest: sw, maxAttempts: nsqConfig.MaxAttempts, requeueDelay: nsqConfig.RequeueDelay}
+	handler.batcher = newBatcher(handler, nsqConfig.BatchSize, batchWorkers, nsqConfig.BatchWait)
+	consumer.AddConcurrentHandlers(handler, batchWorkers)
 	consumer.ConnectToNSQLookupds(lookupds)
 
-	return &Nsq{consumer: consumer}, nil
+	return &Nsq{consumer: consumer, batcher: handler.batcher}, nil
 }
 
-func (c *Nsq) Stop() error {
+// Stop stops taking messages and writes the pending batches, so the messages
+// in flight are acked before the consumer shuts down.
+func (c *Nsq) Stop(timeout time.Duration) error {
+	deadline := time.After(timeout)
 	c.consumer.Stop()
 
+	drained := make(chan struct{})
+	go func() {
+		c.batcher.drain()
+		close(drained)
+	}()
+
 	var err error
 
 	select {
-	case <-c.consumer.StopChan:
-		err = nil
-	case <-time.After(5 * time.Second):
-		err = fmt.Errorf("timed out waiting for consumer shutdown")
+	case <-drained:
+		select {
+		case <-c.consumer.StopChan:
+			err = nil
+		case <-deadline:
+			err = c.abandoned()
+		}
+	case <-deadline:
+		err = c.abandoned()
 	}
 
 	return err
 }
 
+func (c *Nsq) abandoned() error {
+	stats := c.consumer.Stats()
+	inFlight := stats.MessagesReceived - stats.MessagesFinished - stats.MessagesRequeued
+	return fmt.Errorf("timed out waiting for consumer shutdown, abandoned %d in-flight messages", inFlight)
+}
+
+// HandleMessage hands a storable message to its customer's batch. Every
+// message is finished or requeued explicitly, those in a batch only once the
+// batch is written.
 func (h *nsqHandler) HandleMessage(m *nsq.Message) error {
-	return nil
+	m.DisableAutoResponse()
 
-	event := &Event{}
-	err := json.Unmarshal(m.Body, event)
-	if err != nil {
-		h.handleError(m, err)
+	// messages already in flight when ingestion is paused globally go back
+	// to nsq until it resumes
+	if h.ingest.State().Global {
+		messagesHandled.Inc(unknownType, pausedResult)
+		m.RequeueWithoutBackoff(h.requeueDelay)
 		return nil
 	}
 
-	// skip db security groups which are being sent by bastions erroneously
-	if event.MessageType == store.DBSecurityGroupEntityType {
-		return nil
+	event, entity, err := DecodeEntity(m.Body)
+
+	// customer and type pauses drop messages, bastions resend their whole
+	// inventory once ingestion resumes
+	if event != nil {
+		if paused, scope := h.ingest.Paused(event.CustomerId, event.MessageType); paused {
+			messagesHandled.Inc(event.MessageType, pausedResult)
+			log.WithFields(log.Fields{"customer-id": event.CustomerId, "type": event.MessageType, "scope": scope}).Debug("dropped message, ingestion is paused")
+			m.Finish()
+			return nil
+		}
 	}
 
-	entity, err := store.NewEntity(event.MessageType, event.CustomerId, []byte(event.MessageBody))
-	if err != nil {
-		h.handleError(m, err)
+	// skip db security groups which are being sent by bastions erroneously
+	if event != nil && event.MessageType == store.DBSecurityGroupEntityType {
+		messagesHandled.Inc(event.MessageType, skippedResult)
+		m.Finish()
 		return nil
 	}
 
-	_, err = h.db.PutEntity(entity)
 	if err != nil {
-		h.handleError(m, err)
+		h.handleError(m, event, permanentError, err)
 		return nil
 	}
 
+	h.batcher.add(&batchItem{message: m, event: event, entity: entity})
 	return nil
 }
 
-func (h *nsqHandler) handleError(m *nsq.Message, err error) {
-	log.WithFields(log.Fields{"err": err.Error(), "message": string(m.Body)}).Warn("error processing nsq message")
-	yeller.NotifyInfo(err, map[string]interface{}{"message": string(m.Body)})
+// handleError requeues a message that failed transiently and has attempts
+// left, and dead-letters it otherwise. If even dead-lettering fails the
+// message is requeued rather than lost.
+func (h *nsqHandler) handleError(m *nsq.Message, event *Event, class errorClass, err error) {
+	deadLetter := &store.DeadLetter{
+		EntityType: unknownType,
+		MessageId:  string(m.ID[:]),
+		Body:       m.Body,
+		Error:      err.Error(),
+		Attempts:   int(m.Attempts),
+	}
+
+	if event != nil {
+		deadLetter.CustomerId = event.CustomerId
+		deadLetter.Region = event.Region
+		deadLetter.AccountId = event.AccountId
+		if event.MessageType != "" {
+			deadLetter.EntityType = event.MessageType
+		}
+	}
+
+	messageErrors.Inc(deadLetter.EntityType, string(class))
+	logger := log.WithFields(log.Fields{
+		"err":         err.Error(),
+		"class":       class,
+		"attempts":    m.Attempts,
+		"customer-id": deadLetter.CustomerId,
+		"type":        deadLetter.EntityType,
+	})
+
+	if class == transientError && (h.maxAttempts == 0 || m.Attempts < h.maxAttempts) {
+		messagesHandled.Inc(deadLetter.EntityType, requeuedResult)
+		logger.Warn("error processing nsq message, requeueing it")
+		m.Requeue(-1)
+		return
+	}
+
+	messagesHandled.Inc(deadLetter.EntityType, failedResult)
+	logger = logger.WithField("message", string(m.Body))
+	yeller.NotifyInfo(err, map[string]interface{}{"message": string(m.Body), "class": class})
+
+	if dlErr := h.db.PutDeadLetter(deadLetter); dlErr != nil {
+		logger.WithField("dead-letter-err", dlErr.Error()).Error("error processing nsq message, requeueing it")
+		m.Requeue(-1)
+		return
+	}
+
+	logger.WithField("dead-letter-id", deadLetter.Id).Warn("error processing nsq message, dead-lettered it")
+	m.Finish()
 }
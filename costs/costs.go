@@ -0,0 +1,420 @@
+// Package costs estimates what a customer's discovered EC2 and RDS inventory
+// costs at on-demand prices. Prices come from a table bundled with fieri,
+// which a file can extend or override, so estimating needs no network.
+package costs
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/opsee/fieri/store"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+const (
+	LinuxPlatform   = "linux"
+	WindowsPlatform = "windows"
+)
+
+//go:embed prices.json
+var bundledPrices []byte
+
+// Prices is a price table. Compute prices are per hour, storage prices per
+// GB-month and provisioned IOPS per IOPS-month.
+type Prices struct {
+	Currency      string  `json:"currency"`
+	HoursPerMonth float64 `json:"hours_per_month"`
+	// EBSVolumeGB is the size assumed for EBS volumes, which instance
+	// descriptions don't report.
+	EBSVolumeGB float64                  `json:"ebs_volume_gb"`
+	Regions     map[string]*RegionPrices `json:"regions"`
+}
+
+// RegionPrices are one region's prices. EC2 is keyed by platform, then
+// instance type, and RDS by engine, then instance class. Multi-AZ RDS
+// instances cost twice the single-AZ price unless RDSMultiAZ says
+// otherwise.
+type RegionPrices struct {
+	EC2        map[string]map[string]float64 `json:"ec2"`
+	RDS        map[string]map[string]float64 `json:"rds"`
+	RDSMultiAZ map[string]map[string]float64 `json:"rds_multi_az"`
+	RDSStorage map[string]float64            `json:"rds_storage"`
+	RDSIOPS    float64                       `json:"rds_iops"`
+	EBS        float64                       `json:"ebs"`
+}
+
+// LoadPrices returns the bundled price table, with the table in the file at
+// path, if any, merged over it.
+func LoadPrices(path string) (*Prices, error) {
+	prices := &Prices{}
+	if err := json.Unmarshal(bundledPrices, prices); err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		return prices, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	override := &Prices{}
+	if err := json.Unmarshal(b, override); err != nil {
+		return nil, err
+	}
+
+	prices.merge(override)
+
+	return prices, nil
+}
+
+// merge adds the prices in override, replacing any already there.
+func (p *Prices) merge(override *Prices) {
+	if override.Currency != "" {
+		p.Currency = override.Currency
+	}
+
+	if override.HoursPerMonth > 0 {
+		p.HoursPerMonth = override.HoursPerMonth
+	}
+
+	if override.EBSVolumeGB > 0 {
+		p.EBSVolumeGB = override.EBSVolumeGB
+	}
+
+	if p.Regions == nil {
+		p.Regions = make(map[string]*RegionPrices)
+	}
+
+	for name, o := range override.Regions {
+		r, ok := p.Regions[name]
+		if !ok {
+			p.Regions[name] = o
+			continue
+		}
+
+		r.EC2 = mergeTable(r.EC2, o.EC2)
+		r.RDS = mergeTable(r.RDS, o.RDS)
+		r.RDSMultiAZ = mergeTable(r.RDSMultiAZ, o.RDSMultiAZ)
+		r.RDSStorage = mergePrices(r.RDSStorage, o.RDSStorage)
+
+		if o.RDSIOPS > 0 {
+			r.RDSIOPS = o.RDSIOPS
+		}
+
+		if o.EBS > 0 {
+			r.EBS = o.EBS
+		}
+	}
+}
+
+func mergeTable(base, override map[string]map[string]float64) map[string]map[string]float64 {
+	if base == nil {
+		base = make(map[string]map[string]float64)
+	}
+
+	for key, prices := range override {
+		base[key] = mergePrices(base[key], prices)
+	}
+
+	return base
+}
+
+func mergePrices(base, override map[string]float64) map[string]float64 {
+	if base == nil {
+		base = make(map[string]float64)
+	}
+
+	for key, price := range override {
+		base[key] = price
+	}
+
+	return base
+}
+
+// Cost is an hourly cost and the monthly cost it adds up to.
+type Cost struct {
+	Hourly  float64 `json:"hourly"`
+	Monthly float64 `json:"monthly"`
+}
+
+func (c *Cost) add(o Cost) {
+	c.Hourly += o.Hourly
+	c.Monthly += o.Monthly
+}
+
+func (c Cost) rounded() Cost {
+	return Cost{Hourly: round(c.Hourly, 4), Monthly: round(c.Monthly, 2)}
+}
+
+// InstanceCost is an instance's estimated cost: compute, from its hourly
+// price, plus storage. Priced is false when the price table has no compute
+// price for it, and its cost is only its storage. StorageEstimated is set
+// when EBS volume sizes were assumed.
+type InstanceCost struct {
+	Id               string  `json:"id"`
+	Type             string  `json:"type"`
+	Region           string  `json:"region"`
+	AccountId        string  `json:"account_id"`
+	InstanceType     string  `json:"instance_type"`
+	Platform         string  `json:"platform"`
+	MultiAZ          bool    `json:"multi_az,omitempty"`
+	State            string  `json:"state"`
+	Priced           bool    `json:"priced"`
+	UnpricedReason   string  `json:"unpriced_reason,omitempty"`
+	StorageGB        float64 `json:"storage_gb"`
+	StorageEstimated bool    `json:"storage_estimated,omitempty"`
+	Compute          Cost    `json:"compute"`
+	Storage          Cost    `json:"storage"`
+	Total            Cost    `json:"total"`
+}
+
+// GroupCost is the cost of a group's member instances.
+type GroupCost struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Region    string `json:"region"`
+	AccountId string `json:"account_id"`
+	Instances int    `json:"instances"`
+	Total     Cost   `json:"total"`
+}
+
+// Report is the estimated cost of a set of instances and their groups.
+// Excluded counts stopped instances, which cost nothing but their storage
+// and aren't estimated, and Unpriced the instances without a compute price.
+type Report struct {
+	Currency      string          `json:"currency"`
+	HoursPerMonth float64         `json:"hours_per_month"`
+	Total         Cost            `json:"total"`
+	Instances     []*InstanceCost `json:"instances"`
+	Groups        []*GroupCost    `json:"groups"`
+	Excluded      int             `json:"excluded"`
+	Unpriced      int             `json:"unpriced"`
+}
+
+type Estimator struct {
+	prices *Prices
+}
+
+func New(prices *Prices) *Estimator {
+	return &Estimator{prices: prices}
+}
+
+// Estimate prices instances, and rolls their costs up into the groups they
+// are members of.
+func (e *Estimator) Estimate(instances []*store.Instance, groups []*store.Group, memberships []*store.Membership) *Report {
+	report := &Report{
+		Currency:      e.prices.Currency,
+		HoursPerMonth: e.prices.HoursPerMonth,
+		Instances:     make([]*InstanceCost, 0, len(instances)),
+		Groups:        make([]*GroupCost, 0),
+	}
+
+	costs := make(map[string]*InstanceCost, len(instances))
+	total := Cost{}
+
+	for _, instance := range instances {
+		cost, ok := e.estimate(instance)
+		if !ok {
+			report.Excluded++
+			continue
+		}
+
+		if !cost.Priced {
+			report.Unpriced++
+		}
+
+		total.add(cost.Total)
+		costs[instanceKey(instance.AccountId, instance.Region, instance.Id)] = cost
+		report.Instances = append(report.Instances, cost)
+	}
+
+	members := make(map[string][]*InstanceCost)
+	for _, m := range memberships {
+		if cost, ok := costs[instanceKey(m.AccountId, m.Region, m.InstanceId)]; ok {
+			key := instanceKey(m.AccountId, m.Region, m.GroupName)
+			members[key] = append(members[key], cost)
+		}
+	}
+
+	for _, group := range groups {
+		instanceCosts := members[instanceKey(group.AccountId, group.Region, group.Name)]
+		if len(instanceCosts) == 0 {
+			continue
+		}
+
+		groupCost := &GroupCost{
+			Name:      group.Name,
+			Type:      group.Type,
+			Region:    group.Region,
+			AccountId: group.AccountId,
+			Instances: len(instanceCosts),
+		}
+
+		for _, cost := range instanceCosts {
+			groupCost.Total.add(cost.Total)
+		}
+		groupCost.Total = groupCost.Total.rounded()
+
+		report.Groups = append(report.Groups, groupCost)
+	}
+
+	for _, cost := range report.Instances {
+		cost.Compute = cost.Compute.rounded()
+		cost.Storage = cost.Storage.rounded()
+		cost.Total = cost.Total.rounded()
+	}
+	report.Total = total.rounded()
+
+	sort.Slice(report.Instances, func(i, j int) bool { return report.Instances[i].Total.Monthly > report.Instances[j].Total.Monthly })
+	sort.Slice(report.Groups, func(i, j int) bool { return report.Groups[i].Total.Monthly > report.Groups[j].Total.Monthly })
+
+	return report
+}
+
+// ec2Instance and rdsInstance are the parts of instance data prices depend
+// on.
+type ec2Instance struct {
+	InstanceType string
+	Platform     string
+	State        struct {
+		Name string
+	}
+	BlockDeviceMappings []struct {
+		Ebs *struct{}
+	}
+}
+
+type rdsInstance struct {
+	DBInstanceClass  string
+	DBInstanceStatus string
+	Engine           string
+	MultiAZ          bool
+	AllocatedStorage float64
+	StorageType      string
+	Iops             float64
+}
+
+// estimate prices an instance, returning false for a stopped one.
+func (e *Estimator) estimate(instance *store.Instance) (*InstanceCost, bool) {
+	cost := &InstanceCost{
+		Id:        instance.Id,
+		Type:      instance.Type,
+		Region:    instance.Region,
+		AccountId: instance.AccountId,
+	}
+
+	region := e.prices.Regions[instance.Region]
+	if region == nil {
+		region = &RegionPrices{}
+	}
+
+	hours := e.prices.HoursPerMonth
+	var hourly, storageMonthly float64
+
+	switch instance.Type {
+	case store.InstanceStoreType:
+		data := &ec2Instance{}
+		if err := json.Unmarshal(instance.Data, data); err != nil {
+			return malformed(cost, err), true
+		}
+
+		cost.InstanceType = data.InstanceType
+		cost.State = data.State.Name
+		cost.Platform = LinuxPlatform
+		if data.Platform == WindowsPlatform {
+			cost.Platform = WindowsPlatform
+		}
+
+		switch cost.State {
+		case "stopped", "stopping", "shutting-down", "terminated":
+			return nil, false
+		}
+
+		hourly, cost.Priced = region.EC2[cost.Platform][cost.InstanceType]
+
+		// describe-instances doesn't give volume sizes, so each EBS volume
+		// is assumed to be the configured size
+		for _, mapping := range data.BlockDeviceMappings {
+			if mapping.Ebs != nil {
+				cost.StorageGB += e.prices.EBSVolumeGB
+				cost.StorageEstimated = true
+			}
+		}
+		storageMonthly = cost.StorageGB * region.EBS
+
+	case store.DBInstanceStoreType:
+		data := &rdsInstance{}
+		if err := json.Unmarshal(instance.Data, data); err != nil {
+			return malformed(cost, err), true
+		}
+
+		cost.InstanceType = data.DBInstanceClass
+		cost.State = data.DBInstanceStatus
+		cost.Platform = data.Engine
+		cost.MultiAZ = data.MultiAZ
+
+		switch cost.State {
+		case "stopped", "stopping", "deleting":
+			return nil, false
+		}
+
+		copies := 1.0
+		if data.MultiAZ {
+			copies = 2
+			hourly, cost.Priced = region.RDSMultiAZ[data.Engine][data.DBInstanceClass]
+		}
+
+		if !cost.Priced {
+			hourly, cost.Priced = region.RDS[data.Engine][data.DBInstanceClass]
+			hourly *= copies
+		}
+
+		storageType := data.StorageType
+		if storageType == "" {
+			storageType = "standard"
+		}
+
+		cost.StorageGB = data.AllocatedStorage
+		storageMonthly = copies * data.AllocatedStorage * region.RDSStorage[storageType]
+		if storageType == "io1" {
+			storageMonthly += copies * data.Iops * region.RDSIOPS
+		}
+
+	default:
+		return nil, false
+	}
+
+	if !cost.Priced {
+		cost.UnpricedReason = fmt.Sprintf("no %s price for %s %s", instance.Region, cost.Platform, cost.InstanceType)
+	}
+
+	cost.Compute = Cost{Hourly: hourly, Monthly: hourly * hours}
+	if hours > 0 {
+		cost.Storage = Cost{Hourly: storageMonthly / hours, Monthly: storageMonthly}
+	}
+	cost.Total = cost.Compute
+	cost.Total.add(cost.Storage)
+
+	return cost, true
+}
+
+// malformed marks an instance whose data couldn't be read as unpriced. It's
+// reported rather than left out, so the total doesn't quietly miss it.
+func malformed(cost *InstanceCost, err error) *InstanceCost {
+	cost.UnpricedReason = fmt.Sprintf("malformed data: %s", err)
+	return cost
+}
+
+func instanceKey(accountId, region, id string) string {
+	return accountId + "/" + region + "/" + id
+}
+
+func round(f float64, places int) float64 {
+	shift := math.Pow(10, float64(places))
+	return math.Round(f*shift) / shift
+}
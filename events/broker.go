@@ -0,0 +1,208 @@
+// Package events fans inventory changes out to the /events streams. Triggers
+// record every change in postgres and notify on commit, so each fieri
+// replica's broker hears about changes written by any of them.
+package events
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+	"github.com/opsee/fieri/metrics"
+	"github.com/opsee/fieri/store"
+	"sync"
+	"time"
+)
+
+// Channel is the postgres notification channel the triggers notify, with the
+// customer id as payload.
+const Channel = "inventory_events"
+
+const purgeInterval = time.Hour
+
+var (
+	openStreams   = metrics.NewGauge("fieri_event_streams", "Open /events streams.")
+	purgedEvents  = metrics.NewCounter("fieri_events_purged_total", "Inventory events deleted after the retention period.")
+	notifications = metrics.NewCounter("fieri_event_notifications_total", "Inventory event notifications received from postgres.")
+)
+
+// Subscription is woken whenever its customer may have new events.
+type Subscription struct {
+	customerId string
+	// C receives a value when there may be new events. It's buffered, so
+	// wake-ups while the subscriber is busy collapse into one.
+	C chan struct{}
+	// Done is closed when the broker stops.
+	Done chan struct{}
+}
+
+// Broker listens for inventory event notifications and wakes the
+// subscriptions of the notified customer. It also deletes events older than
+// the retention period.
+type Broker struct {
+	db        store.Store
+	listener  *pq.Listener
+	retention time.Duration
+	mut       *sync.Mutex
+	subs      map[string]map[*Subscription]struct{}
+	stopChan  chan struct{}
+	doneChan  chan struct{}
+	stopOnce  *sync.Once
+}
+
+// New returns a broker listening on a connection of its own to the postgres
+// at connection.
+func New(db store.Store, connection string, retention time.Duration) (*Broker, error) {
+	listener := pq.NewListener(connection, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.WithError(err).Warn("inventory event listener connection")
+		}
+	})
+
+	if err := listener.Listen(Channel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &Broker{
+		db:        db,
+		listener:  listener,
+		retention: retention,
+		mut:       &sync.Mutex{},
+		subs:      make(map[string]map[*Subscription]struct{}),
+		stopChan:  make(chan struct{}),
+		doneChan:  make(chan struct{}),
+		stopOnce:  &sync.Once{},
+	}, nil
+}
+
+// Start dispatches notifications until Stop is called.
+func (b *Broker) Start() {
+	defer close(b.doneChan)
+
+	purge := time.NewTicker(purgeInterval)
+	defer purge.Stop()
+
+	for {
+		select {
+		case n := <-b.listener.Notify:
+			// a nil notification means the connection was re-established,
+			// and notifications may have been missed in between
+			if n == nil {
+				b.wakeAll()
+				continue
+			}
+
+			notifications.Inc()
+			b.wake(n.Extra)
+
+		case <-purge.C:
+			b.purge()
+
+		case <-b.stopChan:
+			return
+		}
+	}
+}
+
+// Stop ends dispatching and closes every subscription's Done channel, so the
+// streams end and the http server can drain.
+func (b *Broker) Stop() {
+	b.stopOnce.Do(func() {
+		close(b.stopChan)
+		<-b.doneChan
+		b.listener.Close()
+
+		b.mut.Lock()
+		defer b.mut.Unlock()
+
+		for _, subs := range b.subs {
+			for sub := range subs {
+				close(sub.Done)
+			}
+		}
+	})
+}
+
+// Subscribe returns a subscription to a customer's events. It must be
+// passed to Unsubscribe once the stream ends.
+func (b *Broker) Subscribe(customerId string) *Subscription {
+	sub := &Subscription{
+		customerId: customerId,
+		C:          make(chan struct{}, 1),
+		Done:       make(chan struct{}),
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	select {
+	case <-b.stopChan:
+		close(sub.Done)
+		return sub
+	default:
+	}
+
+	if b.subs[customerId] == nil {
+		b.subs[customerId] = make(map[*Subscription]struct{})
+	}
+	b.subs[customerId][sub] = struct{}{}
+	openStreams.Add(1)
+
+	return sub
+}
+
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	subs, ok := b.subs[sub.customerId]
+	if !ok {
+		return
+	}
+
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(b.subs, sub.customerId)
+	}
+	openStreams.Add(-1)
+}
+
+func (b *Broker) wake(customerId string) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	for sub := range b.subs[customerId] {
+		notify(sub)
+	}
+}
+
+func (b *Broker) wakeAll() {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	for _, subs := range b.subs {
+		for sub := range subs {
+			notify(sub)
+		}
+	}
+}
+
+func notify(sub *Subscription) {
+	select {
+	case sub.C <- struct{}{}:
+	default:
+	}
+}
+
+func (b *Broker) purge() {
+	response, err := b.db.PurgeInventoryEvents(&store.PurgeInventoryEventsRequest{Before: time.Now().Add(-b.retention)})
+	if err != nil {
+		log.WithError(err).Error("error purging inventory events")
+		return
+	}
+
+	purgedEvents.Add(float64(response.Deleted))
+}
@@ -0,0 +1,276 @@
+package ingest
+
+import (
+	"database/sql"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/fieri/metrics"
+	"github.com/opsee/fieri/store"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownScope   = errors.New("scope must be global, customer or type")
+	ErrMissingValue   = errors.New("customer and type pauses need a value")
+	ErrPausedByConfig = errors.New("paused by configuration, it can only be lifted by redeploying")
+	ErrNotPaused      = errors.New("not paused")
+)
+
+var (
+	activePauses = metrics.NewGauge("fieri_ingest_pauses", "Active ingest pauses by scope (global, customer or type).", "scope")
+)
+
+// State is a snapshot of what is paused.
+type State struct {
+	Global    bool                 `json:"global"`
+	Customers []string             `json:"customers"`
+	Types     []string             `json:"types"`
+	Pauses    []*store.IngestPause `json:"pauses"`
+	// Config holds the pauses set in this process's configuration, which
+	// the admin api can't lift.
+	Config    []*store.IngestPause `json:"config"`
+	UpdatedAt time.Time            `json:"updated_at"`
+}
+
+// Switch decides whether the consumer may store a message. Pauses come from
+// the ingest_pauses table, so every fieri process sees those set through the
+// admin api, and from configuration, which only applies to this process.
+type Switch struct {
+	db       store.Store
+	config   []*store.IngestPause
+	interval time.Duration
+	mut      *sync.RWMutex
+	loadMut  *sync.Mutex
+	state    *State
+	onGlobal []func(paused bool)
+	stopChan chan struct{}
+	doneChan chan struct{}
+	stopOnce *sync.Once
+}
+
+// New returns a switch that reloads pauses from db every interval, on top
+// of those in config.
+func New(db store.Store, interval time.Duration, config ...*store.IngestPause) *Switch {
+	s := &Switch{
+		db:       db,
+		config:   config,
+		interval: interval,
+		mut:      &sync.RWMutex{},
+		loadMut:  &sync.Mutex{},
+		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+		stopOnce: &sync.Once{},
+	}
+	s.state = s.merge(nil)
+
+	return s
+}
+
+// OnGlobalChange calls fn whenever the global pause is set or lifted.
+func (s *Switch) OnGlobalChange(fn func(paused bool)) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.onGlobal = append(s.onGlobal, fn)
+}
+
+// Start loads the pauses and then reloads them every interval until Stop is
+// called.
+func (s *Switch) Start() {
+	if err := s.Refresh(); err != nil {
+		log.WithError(err).Error("error loading ingest pauses")
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	defer close(s.doneChan)
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Refresh(); err != nil {
+				log.WithError(err).Error("error loading ingest pauses")
+			}
+
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// Stop ends the reload loop, waiting for a reload in progress to finish.
+func (s *Switch) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopChan)
+		<-s.doneChan
+	})
+}
+
+// Refresh reloads the pauses from the database.
+func (s *Switch) Refresh() error {
+	s.loadMut.Lock()
+	defer s.loadMut.Unlock()
+
+	response, err := s.db.ListIngestPauses()
+	if err != nil {
+		return err
+	}
+
+	state := s.merge(response.Pauses)
+
+	global := 0.0
+	if state.Global {
+		global = 1
+	}
+	activePauses.Set(global, store.GlobalIngestScope)
+	activePauses.Set(float64(len(state.Customers)), store.CustomerIngestScope)
+	activePauses.Set(float64(len(state.Types)), store.TypeIngestScope)
+
+	s.mut.Lock()
+	previous := s.state
+	s.state = state
+	listeners := s.onGlobal
+	s.mut.Unlock()
+
+	if previous.Global != state.Global {
+		log.WithField("paused", state.Global).Warn("global ingest pause changed")
+		for _, fn := range listeners {
+			fn(state.Global)
+		}
+	}
+
+	return nil
+}
+
+// State returns the pauses as of the last reload.
+func (s *Switch) State() *State {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	return s.state
+}
+
+// Paused reports whether messages for the customer and entity type are
+// paused, and the scope of the pause.
+func (s *Switch) Paused(customerId, entityType string) (bool, string) {
+	state := s.State()
+
+	if state.Global {
+		return true, store.GlobalIngestScope
+	}
+
+	if contains(state.Customers, customerId) {
+		return true, store.CustomerIngestScope
+	}
+
+	if contains(state.Types, entityType) {
+		return true, store.TypeIngestScope
+	}
+
+	return false, ""
+}
+
+// Pause records a pause in the database and reloads.
+func (s *Switch) Pause(pause *store.IngestPause) error {
+	if err := validate(pause); err != nil {
+		return err
+	}
+
+	if err := s.db.PutIngestPause(pause); err != nil {
+		return err
+	}
+
+	return s.Refresh()
+}
+
+// Resume lifts a pause set through Pause. Pauses from configuration can't be
+// lifted.
+func (s *Switch) Resume(pause *store.IngestPause) error {
+	if err := validate(pause); err != nil {
+		return err
+	}
+
+	for _, p := range s.config {
+		if p.Scope == pause.Scope && p.Value == pause.Value {
+			return ErrPausedByConfig
+		}
+	}
+
+	err := s.db.DeleteIngestPause(pause)
+	if err == sql.ErrNoRows {
+		return ErrNotPaused
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return s.Refresh()
+}
+
+func (s *Switch) merge(pauses []*store.IngestPause) *State {
+	state := &State{
+		Customers: make([]string, 0),
+		Types:     make([]string, 0),
+		Pauses:    make([]*store.IngestPause, 0, len(pauses)),
+		Config:    make([]*store.IngestPause, 0, len(s.config)),
+		UpdatedAt: time.Now(),
+	}
+
+	add := func(p *store.IngestPause) {
+		switch p.Scope {
+		case store.GlobalIngestScope:
+			state.Global = true
+		case store.CustomerIngestScope:
+			if !contains(state.Customers, p.Value) {
+				state.Customers = append(state.Customers, p.Value)
+			}
+		case store.TypeIngestScope:
+			if !contains(state.Types, p.Value) {
+				state.Types = append(state.Types, p.Value)
+			}
+		}
+	}
+
+	for _, p := range s.config {
+		add(p)
+		state.Config = append(state.Config, p)
+	}
+
+	for _, p := range pauses {
+		add(p)
+		state.Pauses = append(state.Pauses, p)
+	}
+
+	sort.Strings(state.Customers)
+	sort.Strings(state.Types)
+
+	return state
+}
+
+func validate(pause *store.IngestPause) error {
+	switch pause.Scope {
+	case store.GlobalIngestScope:
+		pause.Value = ""
+	case store.CustomerIngestScope, store.TypeIngestScope:
+		if pause.Value == "" {
+			return ErrMissingValue
+		}
+	default:
+		return ErrUnknownScope
+	}
+
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
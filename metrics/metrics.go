@@ -0,0 +1,306 @@
+// Package metrics keeps process-wide counters, gauges and histograms and
+// renders them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// DefaultBuckets are latency buckets in seconds, from 1ms to 10s.
+	DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	registry = &Registry{collectors: make(map[string]collector)}
+
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry holds every metric by name. Registering a name twice replaces the
+// earlier metric.
+type Registry struct {
+	mut        sync.Mutex
+	collectors map[string]collector
+}
+
+func (r *Registry) register(c collector) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.collectors[c.name()] = c
+}
+
+// WriteText writes every registered metric to w, sorted by name.
+func (r *Registry) WriteText(w io.Writer) {
+	r.mut.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	collectors := make([]collector, len(names))
+	for i, name := range names {
+		collectors[i] = r.collectors[name]
+	}
+	r.mut.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves the registered metrics for a Prometheus scrape.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		registry.WriteText(rw)
+	})
+}
+
+// series holds one value per distinct set of label values.
+type series struct {
+	metricName string
+	help       string
+	labels     []string
+	mut        sync.Mutex
+	values     map[string][]string
+}
+
+func newSeries(name, help string, labels []string) series {
+	return series{
+		metricName: name,
+		help:       help,
+		labels:     labels,
+		values:     make(map[string][]string),
+	}
+}
+
+func (s *series) name() string {
+	return s.metricName
+}
+
+// key records the label values and returns the map key for them. Callers
+// hold s.mut.
+func (s *series) key(labelValues []string) string {
+	if len(labelValues) != len(s.labels) {
+		panic(fmt.Sprintf("metric %s wants %d label values, got %d", s.metricName, len(s.labels), len(labelValues)))
+	}
+
+	k := strings.Join(labelValues, "\xff")
+	if _, ok := s.values[k]; !ok {
+		s.values[k] = append([]string(nil), labelValues...)
+	}
+
+	return k
+}
+
+// sortedKeys returns the series keys in a stable order. Callers hold s.mut.
+func (s *series) sortedKeys() []string {
+	keys := make([]string, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (s *series) writeHeader(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", s.metricName, s.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", s.metricName, kind)
+}
+
+func (s *series) labelString(labelValues []string, extra ...string) string {
+	pairs := make([]string, 0, len(labelValues)+len(extra)/2)
+	for i, v := range labelValues {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, s.labels[i], labelEscaper.Replace(v)))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], labelEscaper.Replace(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type Counter struct {
+	series
+	counts map[string]float64
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		series: newSeries(name, help, labels),
+		counts: make(map[string]float64),
+	}
+	registry.register(c)
+
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.counts[c.key(labelValues)] += v
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	c.writeHeader(w, "counter")
+	for _, k := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.labelString(c.values[k]), formatFloat(c.counts[k]))
+	}
+}
+
+type Gauge struct {
+	series
+	gauges map[string]float64
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		series: newSeries(name, help, labels),
+		gauges: make(map[string]float64),
+	}
+	registry.register(g)
+
+	return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.gauges[g.key(labelValues)] = v
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.gauges[g.key(labelValues)] += v
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	g.writeHeader(w, "gauge")
+	for _, k := range g.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, g.labelString(g.values[k]), formatFloat(g.gauges[k]))
+	}
+}
+
+// GaugeFunc is an unlabelled gauge whose value is read at scrape time.
+type GaugeFunc struct {
+	metricName string
+	help       string
+	fn         func() float64
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{metricName: name, help: help, fn: fn}
+	registry.register(g)
+
+	return g
+}
+
+func (g *GaugeFunc) name() string {
+	return g.metricName
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", g.metricName, g.help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.metricName)
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.fn()))
+}
+
+type histogramValue struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type Histogram struct {
+	series
+	buckets    []float64
+	histograms map[string]*histogramValue
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		series:     newSeries(name, help, labels),
+		buckets:    buckets,
+		histograms: make(map[string]*histogramValue),
+	}
+	registry.register(h)
+
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	k := h.key(labelValues)
+	hv, ok := h.histograms[k]
+	if !ok {
+		hv = &histogramValue{buckets: make([]uint64, len(h.buckets))}
+		h.histograms[k] = hv
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hv.buckets[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	h.writeHeader(w, "histogram")
+	for _, k := range h.sortedKeys() {
+		labelValues := h.values[k]
+		hv := h.histograms[k]
+
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelString(labelValues, "le", formatFloat(upper)), hv.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelString(labelValues, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.labelString(labelValues), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, h.labelString(labelValues), hv.count)
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
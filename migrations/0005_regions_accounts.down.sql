@@ -0,0 +1,30 @@
+drop index idx_instances_customers_regions;
+drop index idx_groups_customers_regions;
+
+alter table groups_instances drop constraint fk_groups_instances_groups;
+alter table groups_instances drop constraint fk_groups_instances_instances;
+alter table groups_instances drop constraint uniq_groups_instances;
+
+alter table instances drop constraint instances_pkey;
+alter table instances add primary key (customer_id, id);
+alter table groups drop constraint groups_pkey;
+alter table groups add primary key (customer_id, name);
+alter table route_tables drop constraint route_tables_pkey;
+alter table route_tables add primary key (customer_id, id);
+alter table subnets drop constraint subnets_pkey;
+alter table subnets add primary key (customer_id, id);
+
+alter table groups_instances add foreign key (customer_id, group_name) references groups (customer_id, name) on delete cascade;
+alter table groups_instances add foreign key (customer_id, instance_id) references instances (customer_id, id) on delete cascade;
+alter table groups_instances add unique (customer_id, group_name, instance_id);
+
+alter table instances drop column region;
+alter table instances drop column account_id;
+alter table groups drop column region;
+alter table groups drop column account_id;
+alter table groups_instances drop column region;
+alter table groups_instances drop column account_id;
+alter table route_tables drop column region;
+alter table route_tables drop column account_id;
+alter table subnets drop column region;
+alter table subnets drop column account_id;
@@ -0,0 +1,30 @@
+alter table instances add column region character varying(32) not null default '';
+alter table instances add column account_id character varying(32) not null default '';
+alter table groups add column region character varying(32) not null default '';
+alter table groups add column account_id character varying(32) not null default '';
+alter table groups_instances add column region character varying(32) not null default '';
+alter table groups_instances add column account_id character varying(32) not null default '';
+alter table route_tables add column region character varying(32) not null default '';
+alter table route_tables add column account_id character varying(32) not null default '';
+alter table subnets add column region character varying(32) not null default '';
+alter table subnets add column account_id character varying(32) not null default '';
+
+alter table groups_instances drop constraint groups_instances_customer_id_fkey;
+alter table groups_instances drop constraint groups_instances_customer_id_fkey1;
+alter table groups_instances drop constraint groups_instances_customer_id_group_name_instance_id_key;
+
+alter table instances drop constraint instances_pkey;
+alter table instances add primary key (customer_id, account_id, region, id);
+alter table groups drop constraint groups_pkey;
+alter table groups add primary key (customer_id, account_id, region, name);
+alter table route_tables drop constraint route_tables_pkey;
+alter table route_tables add primary key (customer_id, account_id, region, id);
+alter table subnets drop constraint subnets_pkey;
+alter table subnets add primary key (customer_id, account_id, region, id);
+
+alter table groups_instances add constraint fk_groups_instances_groups foreign key (customer_id, account_id, region, group_name) references groups (customer_id, account_id, region, name) on delete cascade;
+alter table groups_instances add constraint fk_groups_instances_instances foreign key (customer_id, account_id, region, instance_id) references instances (customer_id, account_id, region, id) on delete cascade;
+alter table groups_instances add constraint uniq_groups_instances unique (customer_id, account_id, region, group_name, instance_id);
+
+create index idx_instances_customers_regions on instances (customer_id, region);
+create index idx_groups_customers_regions on groups (customer_id, region);
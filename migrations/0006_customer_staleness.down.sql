@@ -0,0 +1 @@
+alter table customers drop column stale;
@@ -0,0 +1 @@
+alter table customers add column stale boolean not null default false;
@@ -0,0 +1,18 @@
+create table dead_letters (
+  id bigserial not null,
+  customer_id character varying(64) not null default '',
+  entity_type character varying(64) not null default '',
+  region character varying(32) not null default '',
+  account_id character varying(32) not null default '',
+  message_id character varying(32) not null default '',
+  body bytea not null,
+  error text not null,
+  attempts integer not null default 0,
+  created_at timestamp with time zone DEFAULT now() NOT NULL,
+  updated_at timestamp with time zone DEFAULT now() NOT NULL,
+	primary key (id)
+);
+
+create index idx_dead_letters_entity_types on dead_letters (entity_type);
+create index idx_dead_letters_customers on dead_letters (customer_id);
+create trigger trg_dead_letters_updated_at before update on dead_letters for each row execute procedure update_time();
@@ -0,0 +1 @@
+drop table ingest_pauses;
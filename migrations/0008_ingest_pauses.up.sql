@@ -0,0 +1,7 @@
+create table ingest_pauses (
+  scope character varying(16) not null,
+  value character varying(128) not null default '',
+  reason text not null default '',
+  created_at timestamp with time zone DEFAULT now() NOT NULL,
+	primary key (scope, value)
+);
@@ -0,0 +1,25 @@
+drop trigger trg_instances_updated_at on instances;
+drop trigger trg_groups_updated_at on groups;
+drop trigger trg_route_tables_updated_at on route_tables;
+drop trigger trg_subnets_updated_at on subnets;
+
+drop index idx_instances_customers_last_seen;
+drop index idx_instances_customers_updated;
+drop index idx_groups_customers_last_seen;
+drop index idx_groups_customers_updated;
+
+alter table instances drop column data_hash;
+alter table instances drop column last_seen_at;
+alter table groups drop column data_hash;
+alter table groups drop column last_seen_at;
+alter table route_tables drop column data_hash;
+alter table route_tables drop column last_seen_at;
+alter table subnets drop column data_hash;
+alter table subnets drop column last_seen_at;
+
+create trigger trg_instances_updated_at before update on instances for each row execute procedure update_time();
+create trigger trg_groups_updated_at before update on groups for each row execute procedure update_time();
+create trigger trg_route_tables_updated_at before update on route_tables for each row execute procedure update_time();
+create trigger trg_subnets_updated_at before update on subnets for each row execute procedure update_time();
+
+drop function update_changed_time();
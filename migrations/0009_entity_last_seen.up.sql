@@ -0,0 +1,52 @@
+-- updated_at on entities now only moves when their data changes. A sync that
+-- resends identical data just moves last_seen_at, which expiry is based on.
+CREATE FUNCTION update_changed_time() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		IF NEW.data_hash IS DISTINCT FROM OLD.data_hash THEN
+			NEW.updated_at := CURRENT_TIMESTAMP;
+		END IF;
+		RETURN NEW;
+	END;
+$$;
+
+drop trigger trg_instances_updated_at on instances;
+drop trigger trg_groups_updated_at on groups;
+drop trigger trg_route_tables_updated_at on route_tables;
+drop trigger trg_subnets_updated_at on subnets;
+
+alter table instances add column data_hash character(32);
+alter table instances add column last_seen_at timestamp with time zone;
+alter table groups add column data_hash character(32);
+alter table groups add column last_seen_at timestamp with time zone;
+alter table route_tables add column data_hash character(32);
+alter table route_tables add column last_seen_at timestamp with time zone;
+alter table subnets add column data_hash character(32);
+alter table subnets add column last_seen_at timestamp with time zone;
+
+update instances set data_hash = md5(data::text), last_seen_at = updated_at;
+update groups set data_hash = md5(data::text), last_seen_at = updated_at;
+update route_tables set data_hash = md5(data::text), last_seen_at = updated_at;
+update subnets set data_hash = md5(data::text), last_seen_at = updated_at;
+
+alter table instances alter column data_hash set not null;
+alter table instances alter column last_seen_at set default now();
+alter table instances alter column last_seen_at set not null;
+alter table groups alter column data_hash set not null;
+alter table groups alter column last_seen_at set default now();
+alter table groups alter column last_seen_at set not null;
+alter table route_tables alter column data_hash set not null;
+alter table route_tables alter column last_seen_at set default now();
+alter table route_tables alter column last_seen_at set not null;
+alter table subnets alter column data_hash set not null;
+alter table subnets alter column last_seen_at set default now();
+alter table subnets alter column last_seen_at set not null;
+
+create trigger trg_instances_updated_at before update on instances for each row execute procedure update_changed_time();
+create trigger trg_groups_updated_at before update on groups for each row execute procedure update_changed_time();
+create trigger trg_route_tables_updated_at before update on route_tables for each row execute procedure update_changed_time();
+create trigger trg_subnets_updated_at before update on subnets for each row execute procedure update_changed_time();
+
+create index idx_instances_customers_last_seen on instances (customer_id, last_seen_at);
+create index idx_instances_customers_updated on instances (customer_id, updated_at);
+create index idx_groups_customers_last_seen on groups (customer_id, last_seen_at);
+create index idx_groups_customers_updated on groups (customer_id, updated_at);
@@ -0,0 +1,16 @@
+drop trigger trg_instances_events_insert_delete on instances;
+drop trigger trg_instances_events_update on instances;
+drop trigger trg_groups_events_insert_delete on groups;
+drop trigger trg_groups_events_update on groups;
+drop trigger trg_route_tables_events_insert_delete on route_tables;
+drop trigger trg_route_tables_events_update on route_tables;
+drop trigger trg_subnets_events_insert_delete on subnets;
+drop trigger trg_subnets_events_update on subnets;
+drop trigger trg_groups_instances_events on groups_instances;
+
+drop function inventory_membership_event();
+drop function inventory_group_event();
+drop function inventory_entity_event();
+drop function record_inventory_event(UUID, varchar, varchar, varchar, varchar, varchar, varchar);
+
+drop table inventory_events;
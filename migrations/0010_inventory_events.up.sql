@@ -0,0 +1,72 @@
+create table inventory_events (
+  id bigserial not null,
+  customer_id UUID not null,
+  action character varying(16) not null,
+  entity_type character varying(16) not null,
+  entity_id character varying(128) not null,
+  region character varying(32) not null default '',
+  account_id character varying(32) not null default '',
+  group_name character varying(128) not null default '',
+  created_at timestamp with time zone DEFAULT now() NOT NULL,
+	primary key (id)
+);
+
+create index idx_inventory_events_customers on inventory_events (customer_id, id);
+create index idx_inventory_events_created on inventory_events (created_at);
+
+-- A customer's events are numbered in commit order: the lock is held until
+-- the writing transaction ends, so a stream that has read up to an id never
+-- misses a lower one committed later. Notifications are sent on commit, and
+-- postgres folds identical ones in a transaction into one per customer.
+CREATE FUNCTION record_inventory_event(_customer_id UUID, _action varchar, _entity_type varchar, _entity_id varchar, _region varchar, _account_id varchar, _group_name varchar) RETURNS void LANGUAGE plpgsql AS $$
+	BEGIN
+		PERFORM pg_advisory_xact_lock(1718183273, hashtext(_customer_id::text));
+		INSERT INTO inventory_events (customer_id, action, entity_type, entity_id, region, account_id, group_name)
+			VALUES (_customer_id, _action, _entity_type, _entity_id, _region, _account_id, _group_name);
+		PERFORM pg_notify('inventory_events', _customer_id::text);
+	END;
+$$;
+
+CREATE FUNCTION inventory_entity_event() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			PERFORM record_inventory_event(OLD.customer_id, 'deleted', TG_ARGV[0], OLD.id, OLD.region, OLD.account_id, '');
+			RETURN OLD;
+		END IF;
+		PERFORM record_inventory_event(NEW.customer_id, CASE TG_OP WHEN 'INSERT' THEN 'created' ELSE 'updated' END, TG_ARGV[0], NEW.id, NEW.region, NEW.account_id, '');
+		RETURN NEW;
+	END;
+$$;
+
+CREATE FUNCTION inventory_group_event() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			PERFORM record_inventory_event(OLD.customer_id, 'deleted', 'group', OLD.name, OLD.region, OLD.account_id, '');
+			RETURN OLD;
+		END IF;
+		PERFORM record_inventory_event(NEW.customer_id, CASE TG_OP WHEN 'INSERT' THEN 'created' ELSE 'updated' END, 'group', NEW.name, NEW.region, NEW.account_id, '');
+		RETURN NEW;
+	END;
+$$;
+
+CREATE FUNCTION inventory_membership_event() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			PERFORM record_inventory_event(OLD.customer_id, 'deleted', 'membership', OLD.instance_id, OLD.region, OLD.account_id, OLD.group_name);
+			RETURN OLD;
+		END IF;
+		PERFORM record_inventory_event(NEW.customer_id, 'created', 'membership', NEW.instance_id, NEW.region, NEW.account_id, NEW.group_name);
+		RETURN NEW;
+	END;
+$$;
+
+-- updates that only move last_seen_at aren't changes
+create trigger trg_instances_events_insert_delete after insert or delete on instances for each row execute procedure inventory_entity_event('instance');
+create trigger trg_instances_events_update after update on instances for each row when (OLD.data_hash is distinct from NEW.data_hash) execute procedure inventory_entity_event('instance');
+create trigger trg_groups_events_insert_delete after insert or delete on groups for each row execute procedure inventory_group_event();
+create trigger trg_groups_events_update after update on groups for each row when (OLD.data_hash is distinct from NEW.data_hash) execute procedure inventory_group_event();
+create trigger trg_route_tables_events_insert_delete after insert or delete on route_tables for each row execute procedure inventory_entity_event('route_table');
+create trigger trg_route_tables_events_update after update on route_tables for each row when (OLD.data_hash is distinct from NEW.data_hash) execute procedure inventory_entity_event('route_table');
+create trigger trg_subnets_events_insert_delete after insert or delete on subnets for each row execute procedure inventory_entity_event('subnet');
+create trigger trg_subnets_events_update after update on subnets for each row when (OLD.data_hash is distinct from NEW.data_hash) execute procedure inventory_entity_event('subnet');
+create trigger trg_groups_instances_events after insert or delete on groups_instances for each row execute procedure inventory_membership_event();
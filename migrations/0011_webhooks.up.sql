@@ -0,0 +1,40 @@
+create table webhooks (
+  id bigserial not null,
+  customer_id UUID not null,
+  url text not null,
+  secret character varying(128) not null,
+  entity_types character varying(128) not null default '',
+  actions character varying(64) not null default '',
+  enabled boolean not null default true,
+  failures integer not null default 0,
+  last_event_id bigint not null default 0,
+  next_attempt_at timestamp with time zone DEFAULT now() NOT NULL,
+  lease_owner character varying(128) not null default '',
+  lease_until timestamp with time zone,
+  disabled_at timestamp with time zone,
+  disabled_reason text not null default '',
+  created_at timestamp with time zone DEFAULT now() NOT NULL,
+  updated_at timestamp with time zone DEFAULT now() NOT NULL,
+	primary key (id)
+);
+
+create index idx_webhooks_customers on webhooks (customer_id);
+create index idx_webhooks_due on webhooks (next_attempt_at) where enabled;
+create trigger trg_webhooks_updated_at before update on webhooks for each row execute procedure update_time();
+
+create table webhook_deliveries (
+  id bigserial not null,
+  webhook_id bigint not null references webhooks (id) on delete cascade,
+  event_id bigint not null,
+  action character varying(16) not null default '',
+  attempt integer not null default 1,
+  succeeded boolean not null,
+  status_code integer not null default 0,
+  error text not null default '',
+  duration_ms integer not null default 0,
+  created_at timestamp with time zone DEFAULT now() NOT NULL,
+	primary key (id)
+);
+
+create index idx_webhook_deliveries_webhooks on webhook_deliveries (webhook_id, id);
+create index idx_webhook_deliveries_created on webhook_deliveries (created_at);
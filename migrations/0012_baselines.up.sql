@@ -0,0 +1,21 @@
+-- A baseline pins the expected state of one entity, keyed like the entity
+-- itself. An empty region or account matches the entity in any of them.
+-- Drift is evaluated by fieri whenever the entity is written.
+create table baselines (
+  customer_id UUID not null,
+  entity_type character varying(16) not null,
+  entity_id character varying(128) not null,
+  region character varying(32) not null default '',
+  account_id character varying(32) not null default '',
+  expected jsonb not null,
+  exact boolean not null default false,
+  drifted boolean not null default false,
+  differences jsonb not null default '[]',
+  evaluated_at timestamp with time zone,
+  created_at timestamp with time zone DEFAULT now() NOT NULL,
+  updated_at timestamp with time zone DEFAULT now() NOT NULL,
+	primary key (customer_id, entity_type, entity_id, account_id, region)
+);
+
+create index idx_baselines_drifted on baselines (customer_id) where drifted;
+create trigger trg_baselines_updated_at before update on baselines for each row execute procedure update_time();
@@ -0,0 +1,8 @@
+drop index idx_groups_instances_instances;
+
+delete from groups where type in ('tag', 'attribute');
+
+alter type group_type rename to group_type_new;
+create type group_type as enum ('security', 'rds-security', 'elb', 'autoscaling', 'tag');
+alter table groups alter column type type group_type using type::text::group_type;
+drop type group_type_new;
@@ -0,0 +1,10 @@
+-- Tag and attribute groups are derived from instance and autoscaling group
+-- data on every write. Enum values can't be added in a transaction before
+-- postgres 12, so the type is replaced instead.
+alter type group_type rename to group_type_old;
+create type group_type as enum ('security', 'rds-security', 'elb', 'autoscaling', 'tag', 'attribute');
+alter table groups alter column type type group_type using type::text::group_type;
+drop type group_type_old;
+
+-- derived memberships are pruned per instance
+create index idx_groups_instances_instances on groups_instances (customer_id, account_id, region, instance_id);
@@ -0,0 +1,15 @@
+drop trigger trg_instances_tags_insert_delete on instances;
+drop trigger trg_instances_tags_update on instances;
+drop trigger trg_groups_tags_insert_delete on groups;
+drop trigger trg_groups_tags_update on groups;
+drop trigger trg_route_tables_tags_insert_delete on route_tables;
+drop trigger trg_route_tables_tags_update on route_tables;
+drop trigger trg_subnets_tags_insert_delete on subnets;
+drop trigger trg_subnets_tags_update on subnets;
+
+drop function index_entity_tags();
+drop function index_group_tags();
+drop function index_instance_tags();
+drop function replace_entity_tags(UUID, varchar, varchar, varchar, varchar, jsonb);
+
+drop table tags;
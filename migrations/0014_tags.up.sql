@@ -0,0 +1,75 @@
+-- tags indexes the tags in entities' data, so the tag catalog doesn't scan
+-- every entity. Triggers keep it in step with the data, rewriting an
+-- entity's tags only when its data changes.
+create table tags (
+  customer_id UUID not null,
+  region character varying(32) not null default '',
+  account_id character varying(32) not null default '',
+  entity_type character varying(16) not null,
+  entity_id character varying(128) not null,
+  key text not null,
+  value text not null default '',
+	primary key (customer_id, account_id, region, entity_type, entity_id, key)
+);
+
+create index idx_tags_keys on tags (customer_id, key text_pattern_ops, value);
+
+CREATE FUNCTION replace_entity_tags(_customer_id UUID, _region varchar, _account_id varchar, _entity_type varchar, _entity_id varchar, _data jsonb) RETURNS void LANGUAGE plpgsql AS $$
+	BEGIN
+		DELETE FROM tags WHERE customer_id = _customer_id AND account_id = _account_id AND region = _region AND entity_type = _entity_type AND entity_id = _entity_id;
+		IF _data IS NULL OR jsonb_typeof(_data->'Tags') IS DISTINCT FROM 'array' THEN
+			RETURN;
+		END IF;
+		INSERT INTO tags (customer_id, region, account_id, entity_type, entity_id, key, value)
+			SELECT DISTINCT ON (tag->>'Key') _customer_id, _region, _account_id, _entity_type, _entity_id, tag->>'Key', coalesce(tag->>'Value', '')
+			FROM jsonb_array_elements(_data->'Tags') AS tag
+			WHERE coalesce(tag->>'Key', '') <> '';
+	END;
+$$;
+
+CREATE FUNCTION index_instance_tags() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			PERFORM replace_entity_tags(OLD.customer_id, OLD.region, OLD.account_id, OLD.type::text, OLD.id, NULL);
+			RETURN OLD;
+		END IF;
+		PERFORM replace_entity_tags(NEW.customer_id, NEW.region, NEW.account_id, NEW.type::text, NEW.id, NEW.data);
+		RETURN NEW;
+	END;
+$$;
+
+CREATE FUNCTION index_group_tags() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			PERFORM replace_entity_tags(OLD.customer_id, OLD.region, OLD.account_id, OLD.type::text, OLD.name, NULL);
+			RETURN OLD;
+		END IF;
+		PERFORM replace_entity_tags(NEW.customer_id, NEW.region, NEW.account_id, NEW.type::text, NEW.name, NEW.data);
+		RETURN NEW;
+	END;
+$$;
+
+CREATE FUNCTION index_entity_tags() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			PERFORM replace_entity_tags(OLD.customer_id, OLD.region, OLD.account_id, TG_ARGV[0], OLD.id, NULL);
+			RETURN OLD;
+		END IF;
+		PERFORM replace_entity_tags(NEW.customer_id, NEW.region, NEW.account_id, TG_ARGV[0], NEW.id, NEW.data);
+		RETURN NEW;
+	END;
+$$;
+
+create trigger trg_instances_tags_insert_delete after insert or delete on instances for each row execute procedure index_instance_tags();
+create trigger trg_instances_tags_update after update on instances for each row when (OLD.data_hash is distinct from NEW.data_hash) execute procedure index_instance_tags();
+create trigger trg_groups_tags_insert_delete after insert or delete on groups for each row execute procedure index_group_tags();
+create trigger trg_groups_tags_update after update on groups for each row when (OLD.data_hash is distinct from NEW.data_hash) execute procedure index_group_tags();
+create trigger trg_route_tables_tags_insert_delete after insert or delete on route_tables for each row execute procedure index_entity_tags('route_table');
+create trigger trg_route_tables_tags_update after update on route_tables for each row when (OLD.data_hash is distinct from NEW.data_hash) execute procedure index_entity_tags('route_table');
+create trigger trg_subnets_tags_insert_delete after insert or delete on subnets for each row execute procedure index_entity_tags('subnet');
+create trigger trg_subnets_tags_update after update on subnets for each row when (OLD.data_hash is distinct from NEW.data_hash) execute procedure index_entity_tags('subnet');
+
+select replace_entity_tags(customer_id, region, account_id, type::text, id, data) from instances;
+select replace_entity_tags(customer_id, region, account_id, type::text, name, data) from groups;
+select replace_entity_tags(customer_id, region, account_id, 'route_table', id, data) from route_tables;
+select replace_entity_tags(customer_id, region, account_id, 'subnet', id, data) from subnets;
@@ -0,0 +1,2 @@
+alter table instances drop column summary;
+alter table groups drop column summary;
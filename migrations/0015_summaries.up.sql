@@ -0,0 +1,5 @@
+-- summary is the normalized summary of an instance or group's data, written
+-- with it. Rows from before this are filled in the next time they're seen,
+-- and summarized on read until then.
+alter table instances add column summary jsonb;
+alter table groups add column summary jsonb;
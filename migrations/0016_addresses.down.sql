@@ -0,0 +1,16 @@
+drop trigger trg_instances_addresses_insert_delete on instances;
+drop trigger trg_instances_addresses_update on instances;
+drop trigger trg_groups_addresses_insert_delete on groups;
+drop trigger trg_groups_addresses_update on groups;
+drop trigger trg_subnets_addresses_insert_delete on subnets;
+drop trigger trg_subnets_addresses_update on subnets;
+
+drop function index_subnet_addresses();
+drop function index_group_addresses();
+drop function index_instance_addresses();
+drop function replace_entity_addresses(UUID, varchar, varchar, varchar, varchar, jsonb);
+drop function address_elements(jsonb);
+drop function parse_cidr(text);
+drop function parse_inet(text);
+
+drop table addresses;
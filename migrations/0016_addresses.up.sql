@@ -0,0 +1,121 @@
+-- addresses indexes the IPs and DNS names in entities' data, and subnets'
+-- CIDR blocks, for looking up what an address belongs to. Like tags, it's
+-- rewritten by triggers only when an entity's data changes. field is where
+-- in the data the address was found.
+create table addresses (
+  customer_id UUID not null,
+  region character varying(32) not null default '',
+  account_id character varying(32) not null default '',
+  entity_type character varying(16) not null,
+  entity_id character varying(128) not null,
+  field text not null,
+  ip inet,
+  cidr cidr,
+  dns text
+);
+
+create index idx_addresses_entities on addresses (customer_id, account_id, region, entity_type, entity_id);
+create index idx_addresses_ips on addresses (customer_id, ip) where ip is not null;
+create index idx_addresses_dns on addresses (customer_id, dns) where dns is not null;
+create index idx_addresses_cidrs on addresses (customer_id) where cidr is not null;
+
+-- AWS data is trusted to hold addresses, but a malformed one mustn't fail
+-- the write
+CREATE FUNCTION parse_inet(_value text) RETURNS inet LANGUAGE plpgsql IMMUTABLE AS $$
+	BEGIN
+		RETURN _value::inet;
+	EXCEPTION WHEN others THEN
+		RETURN NULL;
+	END;
+$$;
+
+CREATE FUNCTION parse_cidr(_value text) RETURNS cidr LANGUAGE plpgsql IMMUTABLE AS $$
+	BEGIN
+		RETURN _value::cidr;
+	EXCEPTION WHEN others THEN
+		RETURN NULL;
+	END;
+$$;
+
+CREATE FUNCTION address_elements(_value jsonb) RETURNS SETOF jsonb LANGUAGE sql IMMUTABLE AS $$
+	SELECT jsonb_array_elements(CASE WHEN jsonb_typeof(_value) = 'array' THEN _value ELSE '[]'::jsonb END);
+$$;
+
+CREATE FUNCTION replace_entity_addresses(_customer_id UUID, _region varchar, _account_id varchar, _entity_type varchar, _entity_id varchar, _data jsonb) RETURNS void LANGUAGE plpgsql AS $$
+	BEGIN
+		DELETE FROM addresses WHERE customer_id = _customer_id AND account_id = _account_id AND region = _region AND entity_type = _entity_type AND entity_id = _entity_id;
+		IF _data IS NULL THEN
+			RETURN;
+		END IF;
+		INSERT INTO addresses (customer_id, region, account_id, entity_type, entity_id, field, ip, cidr, dns)
+			SELECT DISTINCT _customer_id, _region, _account_id, _entity_type, _entity_id, parsed.field, parsed.ip, parsed.cidr, parsed.dns
+			FROM (SELECT a.field,
+				CASE WHEN a.kind = 'ip' THEN parse_inet(a.value) END AS ip,
+				CASE WHEN a.kind = 'cidr' THEN parse_cidr(a.value) END AS cidr,
+				CASE WHEN a.kind = 'dns' THEN lower(trim(trailing '.' from a.value)) END AS dns
+			FROM (
+				SELECT 'PrivateIpAddress' AS field, 'ip' AS kind, _data->>'PrivateIpAddress' AS value
+				UNION ALL SELECT 'PublicIpAddress', 'ip', _data->>'PublicIpAddress'
+				UNION ALL SELECT 'PrivateDnsName', 'dns', _data->>'PrivateDnsName'
+				UNION ALL SELECT 'PublicDnsName', 'dns', _data->>'PublicDnsName'
+				UNION ALL SELECT 'NetworkInterfaces.PrivateIpAddress', 'ip', i->>'PrivateIpAddress' FROM address_elements(_data->'NetworkInterfaces') i
+				UNION ALL SELECT 'NetworkInterfaces.PrivateDnsName', 'dns', i->>'PrivateDnsName' FROM address_elements(_data->'NetworkInterfaces') i
+				UNION ALL SELECT 'NetworkInterfaces.Association.PublicIp', 'ip', i#>>'{Association,PublicIp}' FROM address_elements(_data->'NetworkInterfaces') i
+				UNION ALL SELECT 'NetworkInterfaces.Association.PublicDnsName', 'dns', i#>>'{Association,PublicDnsName}' FROM address_elements(_data->'NetworkInterfaces') i
+				UNION ALL SELECT 'NetworkInterfaces.PrivateIpAddresses.PrivateIpAddress', 'ip', p->>'PrivateIpAddress' FROM address_elements(_data->'NetworkInterfaces') i, address_elements(i->'PrivateIpAddresses') p
+				UNION ALL SELECT 'NetworkInterfaces.PrivateIpAddresses.PrivateDnsName', 'dns', p->>'PrivateDnsName' FROM address_elements(_data->'NetworkInterfaces') i, address_elements(i->'PrivateIpAddresses') p
+				UNION ALL SELECT 'NetworkInterfaces.PrivateIpAddresses.Association.PublicIp', 'ip', p#>>'{Association,PublicIp}' FROM address_elements(_data->'NetworkInterfaces') i, address_elements(i->'PrivateIpAddresses') p
+				UNION ALL SELECT 'NetworkInterfaces.PrivateIpAddresses.Association.PublicDnsName', 'dns', p#>>'{Association,PublicDnsName}' FROM address_elements(_data->'NetworkInterfaces') i, address_elements(i->'PrivateIpAddresses') p
+				UNION ALL SELECT 'Endpoint.Address', 'dns', _data#>>'{Endpoint,Address}'
+				UNION ALL SELECT 'DNSName', 'dns', _data->>'DNSName'
+				UNION ALL SELECT 'CanonicalHostedZoneName', 'dns', _data->>'CanonicalHostedZoneName'
+				UNION ALL SELECT 'CidrBlock', 'cidr', _data->>'CidrBlock'
+			) a
+			WHERE coalesce(a.value, '') <> '') parsed
+			WHERE parsed.ip IS NOT NULL OR parsed.cidr IS NOT NULL OR parsed.dns IS NOT NULL;
+	END;
+$$;
+
+CREATE FUNCTION index_instance_addresses() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			PERFORM replace_entity_addresses(OLD.customer_id, OLD.region, OLD.account_id, OLD.type::text, OLD.id, NULL);
+			RETURN OLD;
+		END IF;
+		PERFORM replace_entity_addresses(NEW.customer_id, NEW.region, NEW.account_id, NEW.type::text, NEW.id, NEW.data);
+		RETURN NEW;
+	END;
+$$;
+
+CREATE FUNCTION index_group_addresses() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			PERFORM replace_entity_addresses(OLD.customer_id, OLD.region, OLD.account_id, OLD.type::text, OLD.name, NULL);
+			RETURN OLD;
+		END IF;
+		PERFORM replace_entity_addresses(NEW.customer_id, NEW.region, NEW.account_id, NEW.type::text, NEW.name, NEW.data);
+		RETURN NEW;
+	END;
+$$;
+
+CREATE FUNCTION index_subnet_addresses() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			PERFORM replace_entity_addresses(OLD.customer_id, OLD.region, OLD.account_id, 'subnet', OLD.id, NULL);
+			RETURN OLD;
+		END IF;
+		PERFORM replace_entity_addresses(NEW.customer_id, NEW.region, NEW.account_id, 'subnet', NEW.id, NEW.data);
+		RETURN NEW;
+	END;
+$$;
+
+create trigger trg_instances_addresses_insert_delete after insert or delete on instances for each row execute procedure index_instance_addresses();
+create trigger trg_instances_addresses_update after update on instances for each row when (OLD.data_hash is distinct from NEW.data_hash) execute procedure index_instance_addresses();
+create trigger trg_groups_addresses_insert_delete after insert or delete on groups for each row execute procedure index_group_addresses();
+create trigger trg_groups_addresses_update after update on groups for each row when (OLD.data_hash is distinct from NEW.data_hash) execute procedure index_group_addresses();
+create trigger trg_subnets_addresses_insert_delete after insert or delete on subnets for each row execute procedure index_subnet_addresses();
+create trigger trg_subnets_addresses_update after update on subnets for each row when (OLD.data_hash is distinct from NEW.data_hash) execute procedure index_subnet_addresses();
+
+select replace_entity_addresses(customer_id, region, account_id, type::text, id, data) from instances;
+select replace_entity_addresses(customer_id, region, account_id, type::text, name, data) from groups;
+select replace_entity_addresses(customer_id, region, account_id, 'subnet', id, data) from subnets;
@@ -0,0 +1,14 @@
+drop trigger trg_instances_changed_at on instances;
+drop trigger trg_groups_changed_at on groups;
+drop trigger trg_route_tables_changed_at on route_tables;
+drop trigger trg_subnets_changed_at on subnets;
+
+drop index idx_instances_customers_changed;
+drop index idx_groups_customers_changed;
+
+alter table instances drop column changed_at;
+alter table groups drop column changed_at;
+alter table route_tables drop column changed_at;
+alter table subnets drop column changed_at;
+
+drop function update_data_changed_time();
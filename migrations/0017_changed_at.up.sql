@@ -0,0 +1,36 @@
+-- changed_at is when an entity's data last changed, moved only by these
+-- triggers when its data hash does. updated_at can be moved by anything
+-- that touches the row, so changed_since filters on changed_at instead.
+CREATE FUNCTION update_data_changed_time() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		NEW.changed_at := CURRENT_TIMESTAMP;
+		RETURN NEW;
+	END;
+$$;
+
+alter table instances add column changed_at timestamp with time zone;
+alter table groups add column changed_at timestamp with time zone;
+alter table route_tables add column changed_at timestamp with time zone;
+alter table subnets add column changed_at timestamp with time zone;
+
+update instances set changed_at = updated_at;
+update groups set changed_at = updated_at;
+update route_tables set changed_at = updated_at;
+update subnets set changed_at = updated_at;
+
+alter table instances alter column changed_at set default now();
+alter table instances alter column changed_at set not null;
+alter table groups alter column changed_at set default now();
+alter table groups alter column changed_at set not null;
+alter table route_tables alter column changed_at set default now();
+alter table route_tables alter column changed_at set not null;
+alter table subnets alter column changed_at set default now();
+alter table subnets alter column changed_at set not null;
+
+create trigger trg_instances_changed_at before update on instances for each row when (OLD.data_hash is distinct from NEW.data_hash) execute procedure update_data_changed_time();
+create trigger trg_groups_changed_at before update on groups for each row when (OLD.data_hash is distinct from NEW.data_hash) execute procedure update_data_changed_time();
+create trigger trg_route_tables_changed_at before update on route_tables for each row when (OLD.data_hash is distinct from NEW.data_hash) execute procedure update_data_changed_time();
+create trigger trg_subnets_changed_at before update on subnets for each row when (OLD.data_hash is distinct from NEW.data_hash) execute procedure update_data_changed_time();
+
+create index idx_instances_customers_changed on instances (customer_id, changed_at);
+create index idx_groups_customers_changed on groups (customer_id, changed_at);
@@ -0,0 +1,9 @@
+// Package migrations embeds fieri's schema migrations into the binary.
+package migrations
+
+import (
+	"embed"
+)
+
+//go:embed *.sql
+var FS embed.FS
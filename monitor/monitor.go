@@ -0,0 +1,152 @@
+package monitor
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/fieri/store"
+	"sync"
+	"time"
+)
+
+const (
+	StaleEventType     = "stale"
+	RecoveredEventType = "recovered"
+)
+
+// Event announces that a customer's inventory has gone stale, or that a stale
+// customer has synced again.
+type Event struct {
+	Type       string    `json:"type"`
+	CustomerId string    `json:"customer_id"`
+	LastSync   time.Time `json:"last_sync"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+type Notifier interface {
+	Notify(*Event) error
+}
+
+// Monitor periodically marks customers whose last sync is older than
+// staleAfter as stale, and emits an event to each notifier when a customer
+// goes stale or recovers. Customers' last syncs are kept from each check, so
+// they can be read without going to the database.
+type Monitor struct {
+	db         store.Store
+	staleAfter time.Duration
+	interval   time.Duration
+	notifiers  []Notifier
+	lastSyncs  map[string]time.Time
+	syncsMut   *sync.RWMutex
+	stopChan   chan struct{}
+	doneChan   chan struct{}
+}
+
+func New(db store.Store, staleAfter, interval time.Duration, notifiers ...Notifier) *Monitor {
+	return &Monitor{
+		db:         db,
+		staleAfter: staleAfter,
+		interval:   interval,
+		notifiers:  append([]Notifier{&logNotifier{}}, notifiers...),
+		lastSyncs:  make(map[string]time.Time),
+		syncsMut:   &sync.RWMutex{},
+		stopChan:   make(chan struct{}),
+		doneChan:   make(chan struct{}),
+	}
+}
+
+func (m *Monitor) Start() {
+	log.WithField("stale-after", m.staleAfter).Info("starting stale inventory monitor")
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	defer close(m.doneChan)
+
+	// check right away, so last syncs are known before the first tick
+	if err := m.check(); err != nil {
+		log.WithError(err).Error("error checking for stale customers")
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.check(); err != nil {
+				log.WithError(err).Error("error checking for stale customers")
+			}
+
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+// LastSync is a customer's last sync as of the latest check, and whether
+// it's older than staleAfter now. ok is false if the customer wasn't known
+// then.
+func (m *Monitor) LastSync(customerId string) (lastSync time.Time, stale bool, ok bool) {
+	m.syncsMut.RLock()
+	lastSync, ok = m.lastSyncs[customerId]
+	m.syncsMut.RUnlock()
+
+	if !ok {
+		return time.Time{}, false, false
+	}
+
+	return lastSync, time.Since(lastSync) > m.staleAfter, true
+}
+
+// Stop ends the monitor loop, waiting for a check in progress to finish.
+func (m *Monitor) Stop() {
+	close(m.stopChan)
+	<-m.doneChan
+}
+
+func (m *Monitor) check() error {
+	response, err := m.db.UpdateStaleness(&store.StalenessRequest{StaleAfter: m.staleAfter})
+	if err != nil {
+		return err
+	}
+
+	lastSyncs := make(map[string]time.Time, len(response.Customers))
+	for _, customer := range response.Customers {
+		lastSyncs[customer.Id] = customer.LastSync
+	}
+
+	m.syncsMut.Lock()
+	m.lastSyncs = lastSyncs
+	m.syncsMut.Unlock()
+
+	now := time.Now()
+	for _, customer := range response.Stale {
+		m.notify(&Event{StaleEventType, customer.Id, customer.LastSync, now})
+	}
+
+	for _, customer := range response.Recovered {
+		m.notify(&Event{RecoveredEventType, customer.Id, customer.LastSync, now})
+	}
+
+	return nil
+}
+
+func (m *Monitor) notify(event *Event) {
+	for _, n := range m.notifiers {
+		if err := n.Notify(event); err != nil {
+			log.WithError(err).WithField("customer-id", event.CustomerId).Error("error sending stale inventory event")
+		}
+	}
+}
+
+type logNotifier struct{}
+
+func (n *logNotifier) Notify(event *Event) error {
+	logger := log.WithFields(log.Fields{
+		"customer-id": event.CustomerId,
+		"last-sync":   event.LastSync,
+	})
+
+	if event.Type == StaleEventType {
+		logger.Warn("customer inventory is stale")
+	} else {
+		logger.Info("customer inventory recovered")
+	}
+
+	return nil
+}
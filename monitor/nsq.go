@@ -0,0 +1,33 @@
+package monitor
+
+import (
+	"encoding/json"
+	"github.com/nsqio/go-nsq"
+)
+
+type NsqNotifier struct {
+	producer *nsq.Producer
+	topic    string
+}
+
+func NewNsqNotifier(nsqdHost, topic string) (*NsqNotifier, error) {
+	producer, err := nsq.NewProducer(nsqdHost, nsq.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	return &NsqNotifier{producer: producer, topic: topic}, nil
+}
+
+func (n *NsqNotifier) Notify(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return n.producer.Publish(n.topic, body)
+}
+
+func (n *NsqNotifier) Stop() {
+	n.producer.Stop()
+}
@@ -0,0 +1,365 @@
+package reports
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	opsee_aws_autoscaling "github.com/opsee/basic/schema/aws/autoscaling"
+	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
+	opsee_aws_elb "github.com/opsee/basic/schema/aws/elb"
+	opsee_aws_rds "github.com/opsee/basic/schema/aws/rds"
+	"github.com/opsee/fieri/store"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of orphaned and idle resources.
+const (
+	EmptyLoadBalancerKind      = "empty-load-balancer"
+	EmptyAutoScalingGroupKind  = "empty-autoscaling-group"
+	EmptySubnetKind            = "empty-subnet"
+	UnassociatedRouteTableKind = "unassociated-route-table"
+	StoppedInstanceKind        = "stopped-instance"
+	OrphanedReadReplicaKind    = "orphaned-read-replica"
+)
+
+// DefaultStoppedDays is how many days an instance must have been stopped
+// for to be reported, unless asked otherwise.
+const DefaultStoppedDays = 30
+
+const day = 24 * time.Hour
+
+const (
+	stoppedInstanceState = "stopped"
+
+	// where a stopped instance's stop time came from, its launch being
+	// only a lower bound
+	transitionStoppedAtSource = "StateTransitionReason"
+	launchTimeStoppedAtSource = "LaunchTime"
+)
+
+// transitionTime is the time in a StateTransitionReason, e.g.
+// "User initiated (2016-03-10 19:45:43 GMT)".
+var transitionTime = regexp.MustCompile(`\((\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}) GMT\)`)
+
+// Orphan is a resource that looks unused, with the fields of its data that
+// say so in Evidence.
+type Orphan struct {
+	Kind      string                 `json:"kind"`
+	Type      string                 `json:"type"`
+	Id        string                 `json:"id"`
+	Region    string                 `json:"region"`
+	AccountId string                 `json:"account_id"`
+	Evidence  map[string]interface{} `json:"evidence"`
+}
+
+// Orphans are the orphaned and idle resources found, and how many of each
+// kind. StoppedDays is how many days an instance must have been stopped for
+// to be reported. UnknownStopTimes counts the stopped instances launched at
+// least that long ago whose stop time isn't known, which are only reported
+// when asked for. Malformed are the entities skipped because their data
+// couldn't be read.
+type Orphans struct {
+	Orphans          []*Orphan          `json:"orphans"`
+	Counts           map[string]int     `json:"counts"`
+	StoppedDays      int                `json:"stopped_days"`
+	UnknownStopTimes int                `json:"unknown_stop_times"`
+	Malformed        []*MalformedEntity `json:"malformed"`
+}
+
+// OrphansRequest is what to look for orphans in. Only those in Region and
+// AccountId, when they're set, are reported, but everything given is
+// looked at to decide what's orphaned, e.g. a cross-region read replica's
+// source. IncludeUnknownStopTimes reports stopped instances whose stop time
+// isn't known but which launched at least StoppedDays ago.
+type OrphansRequest struct {
+	Instances               []*store.Instance
+	Groups                  []*store.Group
+	Subnets                 []*store.Subnet
+	RouteTables             []*store.RouteTable
+	Region                  string
+	AccountId               string
+	StoppedDays             int
+	IncludeUnknownStopTimes bool
+	Now                     time.Time
+}
+
+// FindOrphans finds load balancers with no registered instances, autoscaling
+// groups scaled to nothing, subnets no instance or load balancer is in, route
+// tables with no associations, EC2 instances stopped for at least
+// StoppedDays, and read replicas whose source instance is gone. Entities
+// whose data can't be read are skipped and listed as malformed.
+func FindOrphans(request *OrphansRequest) *Orphans {
+	report := &Orphans{
+		Orphans:     make([]*Orphan, 0),
+		Counts:      make(map[string]int),
+		StoppedDays: request.StoppedDays,
+		Malformed:   make([]*MalformedEntity, 0),
+	}
+
+	reported := func(region, accountId string) bool {
+		return (request.Region == "" || region == request.Region) && (request.AccountId == "" || accountId == request.AccountId)
+	}
+
+	add := func(kind, entityType, id, region, accountId string, evidence map[string]interface{}) {
+		if !reported(region, accountId) {
+			return
+		}
+
+		report.Counts[kind]++
+		report.Orphans = append(report.Orphans, &Orphan{
+			Kind:      kind,
+			Type:      entityType,
+			Id:        id,
+			Region:    region,
+			AccountId: accountId,
+			Evidence:  evidence,
+		})
+	}
+
+	// subnets are used by the EC2 instances in them, the RDS instances whose
+	// subnet groups include them and the load balancers in them
+	subnetInstances := make(map[string]int)
+	subnetDBInstances := make(map[string]int)
+	subnetLoadBalancers := make(map[string]int)
+
+	// read replicas' sources are found by region, account and identifier
+	dbInstances := make(map[string]bool)
+	replicas := make([]*store.Instance, 0)
+	rdsData := make(map[*store.Instance]*opsee_aws_rds.DBInstance)
+	stopped := make([]*store.Instance, 0)
+	ec2Data := make(map[*store.Instance]*opsee_aws_ec2.Instance)
+
+	for _, instance := range request.Instances {
+		switch instance.Type {
+		case store.InstanceStoreType:
+			ec2 := &opsee_aws_ec2.Instance{}
+			if err := json.Unmarshal(instance.Data, ec2); err != nil {
+				report.Malformed = append(report.Malformed, malformedEntity(instance.Type, instance.Id, instance.Region, instance.AccountId, err))
+				continue
+			}
+
+			subnets := map[string]bool{aws.StringValue(ec2.SubnetId): true}
+			for _, iface := range ec2.NetworkInterfaces {
+				subnets[aws.StringValue(iface.SubnetId)] = true
+			}
+
+			for id := range subnets {
+				subnetInstances[id]++
+			}
+
+			if ec2.State != nil && aws.StringValue(ec2.State.Name) == stoppedInstanceState {
+				stopped = append(stopped, instance)
+				ec2Data[instance] = ec2
+			}
+
+		case store.DBInstanceStoreType:
+			rds := &opsee_aws_rds.DBInstance{}
+			if err := json.Unmarshal(instance.Data, rds); err != nil {
+				report.Malformed = append(report.Malformed, malformedEntity(instance.Type, instance.Id, instance.Region, instance.AccountId, err))
+				continue
+			}
+
+			if rds.DBSubnetGroup != nil {
+				for _, subnet := range rds.DBSubnetGroup.Subnets {
+					subnetDBInstances[aws.StringValue(subnet.SubnetIdentifier)]++
+				}
+			}
+
+			dbInstances[instanceKey(instance.AccountId, instance.Region, instance.Id)] = true
+			if aws.StringValue(rds.ReadReplicaSourceDBInstanceIdentifier) != "" {
+				replicas = append(replicas, instance)
+				rdsData[instance] = rds
+			}
+		}
+	}
+
+	for _, group := range request.Groups {
+		switch group.Type {
+		case store.ELBStoreType:
+			elb := &opsee_aws_elb.LoadBalancerDescription{}
+			if err := json.Unmarshal(group.Data, elb); err != nil {
+				report.Malformed = append(report.Malformed, malformedEntity(group.Type, group.Name, group.Region, group.AccountId, err))
+				continue
+			}
+
+			for _, id := range elb.Subnets {
+				subnetLoadBalancers[id]++
+			}
+
+			if len(elb.Instances) == 0 {
+				add(EmptyLoadBalancerKind, group.Type, group.Name, group.Region, group.AccountId, map[string]interface{}{
+					"Instances": len(elb.Instances),
+					"DNSName":   aws.StringValue(elb.DNSName),
+					"CreatedAt": timestamp(elb.CreatedTime),
+				})
+			}
+
+		case store.AutoScalingGroupStoreType:
+			asg := &opsee_aws_autoscaling.Group{}
+			if err := json.Unmarshal(group.Data, asg); err != nil {
+				report.Malformed = append(report.Malformed, malformedEntity(group.Type, group.Name, group.Region, group.AccountId, err))
+				continue
+			}
+
+			if aws.Int64Value(asg.DesiredCapacity) == 0 {
+				add(EmptyAutoScalingGroupKind, group.Type, group.Name, group.Region, group.AccountId, map[string]interface{}{
+					"DesiredCapacity":         aws.Int64Value(asg.DesiredCapacity),
+					"MinSize":                 aws.Int64Value(asg.MinSize),
+					"MaxSize":                 aws.Int64Value(asg.MaxSize),
+					"Instances":               len(asg.Instances),
+					"LaunchConfigurationName": aws.StringValue(asg.LaunchConfigurationName),
+				})
+			}
+		}
+	}
+
+	for _, subnet := range request.Subnets {
+		if subnetInstances[subnet.Id]+subnetDBInstances[subnet.Id]+subnetLoadBalancers[subnet.Id] > 0 {
+			continue
+		}
+
+		data := &opsee_aws_ec2.Subnet{}
+		if err := json.Unmarshal(subnet.Data, data); err != nil {
+			report.Malformed = append(report.Malformed, malformedEntity(store.SubnetStoreType, subnet.Id, subnet.Region, subnet.AccountId, err))
+			continue
+		}
+
+		add(EmptySubnetKind, store.SubnetStoreType, subnet.Id, subnet.Region, subnet.AccountId, map[string]interface{}{
+			"Instances":               subnetInstances[subnet.Id],
+			"DBInstances":             subnetDBInstances[subnet.Id],
+			"LoadBalancers":           subnetLoadBalancers[subnet.Id],
+			"CidrBlock":               aws.StringValue(data.CidrBlock),
+			"AvailableIpAddressCount": aws.Int64Value(data.AvailableIpAddressCount),
+			"VpcId":                   aws.StringValue(data.VpcId),
+			"DefaultForAz":            aws.BoolValue(data.DefaultForAz),
+		})
+	}
+
+	for _, routeTable := range request.RouteTables {
+		data := &opsee_aws_ec2.RouteTable{}
+		if err := json.Unmarshal(routeTable.Data, data); err != nil {
+			report.Malformed = append(report.Malformed, malformedEntity(store.RouteTableStoreType, routeTable.Id, routeTable.Region, routeTable.AccountId, err))
+			continue
+		}
+
+		if len(data.Associations) == 0 {
+			add(UnassociatedRouteTableKind, store.RouteTableStoreType, routeTable.Id, routeTable.Region, routeTable.AccountId, map[string]interface{}{
+				"Associations": len(data.Associations),
+				"Routes":       len(data.Routes),
+				"VpcId":        aws.StringValue(data.VpcId),
+			})
+		}
+	}
+
+	stoppedFor := time.Duration(request.StoppedDays) * day
+	for _, instance := range stopped {
+		ec2 := ec2Data[instance]
+		reason := aws.StringValue(ec2.StateTransitionReason)
+		launchedAt := timestamp(ec2.LaunchTime)
+
+		evidence := map[string]interface{}{
+			"State":                 aws.StringValue(ec2.State.Name),
+			"StateTransitionReason": reason,
+			"LaunchTime":            launchedAt,
+			"InstanceType":          aws.StringValue(ec2.InstanceType),
+		}
+
+		// StateTransitionReason has when an instance stopped. failing that,
+		// all that's known is it stopped some time after it launched, so
+		// its launch is only a bound, and it's only reported if asked for
+		if stoppedAt := stoppedTime(reason); stoppedAt != nil {
+			if request.Now.Sub(*stoppedAt) < stoppedFor {
+				continue
+			}
+
+			evidence["StoppedAt"] = stoppedAt
+			evidence["StoppedAtSource"] = transitionStoppedAtSource
+			evidence["DaysStopped"] = int(request.Now.Sub(*stoppedAt) / day)
+		} else {
+			if launchedAt == nil || request.Now.Sub(*launchedAt) < stoppedFor {
+				continue
+			}
+
+			if reported(instance.Region, instance.AccountId) {
+				report.UnknownStopTimes++
+			}
+
+			if !request.IncludeUnknownStopTimes {
+				continue
+			}
+
+			evidence["StoppedAtSource"] = launchTimeStoppedAtSource
+			evidence["DaysSinceLaunch"] = int(request.Now.Sub(*launchedAt) / day)
+		}
+
+		add(StoppedInstanceKind, instance.Type, instance.Id, instance.Region, instance.AccountId, evidence)
+	}
+
+	for _, instance := range replicas {
+		source := aws.StringValue(rdsData[instance].ReadReplicaSourceDBInstanceIdentifier)
+		if dbInstances[replicaSourceKey(instance, source)] {
+			continue
+		}
+
+		add(OrphanedReadReplicaKind, instance.Type, instance.Id, instance.Region, instance.AccountId, map[string]interface{}{
+			"ReadReplicaSourceDBInstanceIdentifier": source,
+			"DBInstanceStatus":                      aws.StringValue(rdsData[instance].DBInstanceStatus),
+			"DBInstanceClass":                       aws.StringValue(rdsData[instance].DBInstanceClass),
+		})
+	}
+
+	sort.SliceStable(report.Orphans, func(i, j int) bool {
+		a, b := report.Orphans[i], report.Orphans[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+
+		return instanceKey(a.AccountId, a.Region, a.Id) < instanceKey(b.AccountId, b.Region, b.Id)
+	})
+
+	return report
+}
+
+// replicaSourceKey keys a read replica's source, which is an identifier in
+// the replica's region and account, or an ARN for a cross-region replica,
+// arn:aws:rds:<region>:<account>:db:<identifier>.
+func replicaSourceKey(replica *store.Instance, source string) string {
+	parts := strings.Split(source, ":")
+	if len(parts) == 7 && parts[0] == "arn" && parts[5] == "db" {
+		return instanceKey(parts[4], parts[3], parts[6])
+	}
+
+	return instanceKey(replica.AccountId, replica.Region, source)
+}
+
+// stoppedTime is the time in a stopped instance's StateTransitionReason, if
+// it has one.
+func stoppedTime(reason string) *time.Time {
+	match := transitionTime.FindStringSubmatch(reason)
+	if match == nil {
+		return nil
+	}
+
+	t, err := time.Parse("2006-01-02 15:04:05", match[1])
+	if err != nil {
+		return nil
+	}
+
+	return &t
+}
+
+func timestamp(t *opsee_types.Timestamp) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	tm := time.Unix(0, t.Millis()*int64(time.Millisecond)).UTC()
+	return &tm
+}
+
+func instanceKey(accountId, region, id string) string {
+	return accountId + "/" + region + "/" + id
+}
@@ -0,0 +1,223 @@
+package reports
+
+import (
+	"github.com/opsee/fieri/store"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStoppedTime(t *testing.T) {
+	tests := []struct {
+		reason string
+		want   string
+	}{
+		{"User initiated (2016-03-10 19:45:43 GMT)", "2016-03-10T19:45:43Z"},
+		{"Service initiated (2015-12-01 00:00:01 GMT)", "2015-12-01T00:00:01Z"},
+		{"User initiated", ""},
+		{"", ""},
+		// matches the pattern, but isn't a time
+		{"User initiated (2016-13-40 19:45:43 GMT)", ""},
+	}
+
+	for _, test := range tests {
+		got := stoppedTime(test.reason)
+		if test.want == "" {
+			if got != nil {
+				t.Errorf("%q: got %s, want none", test.reason, got)
+			}
+			continue
+		}
+
+		if got == nil || got.Format(time.RFC3339) != test.want {
+			t.Errorf("%q: got %v, want %s", test.reason, got, test.want)
+		}
+	}
+}
+
+func TestReplicaSourceKey(t *testing.T) {
+	replica := &store.Instance{Id: "db-replica", Region: "us-west-2", AccountId: "123"}
+
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"db-source", "123/us-west-2/db-source"},
+		{"arn:aws:rds:us-east-1:456:db:db-source", "456/us-east-1/db-source"},
+		// not a db arn, so taken as an identifier
+		{"arn:aws:rds:us-east-1:456:snapshot:db-source", "123/us-west-2/arn:aws:rds:us-east-1:456:snapshot:db-source"},
+	}
+
+	for _, test := range tests {
+		if got := replicaSourceKey(replica, test.source); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	now := time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	ec2 := func(id, region, data string) *store.Instance {
+		return &store.Instance{Id: id, Type: store.InstanceStoreType, Region: region, AccountId: "123", Data: []byte(data)}
+	}
+	rds := func(id, region, data string) *store.Instance {
+		return &store.Instance{Id: id, Type: store.DBInstanceStoreType, Region: region, AccountId: "123", Data: []byte(data)}
+	}
+	group := func(groupType, name, data string) *store.Group {
+		return &store.Group{Name: name, Type: groupType, Region: "us-west-2", AccountId: "123", Data: []byte(data)}
+	}
+
+	tests := []struct {
+		name    string
+		request *OrphansRequest
+		// kind and id of each orphan, in order
+		orphans          []string
+		unknownStopTimes int
+		malformed        []string
+	}{
+		{
+			name: "load balancers and autoscaling groups",
+			request: &OrphansRequest{
+				Groups: []*store.Group{
+					group(store.ELBStoreType, "elb-empty", `{"Instances": []}`),
+					group(store.ELBStoreType, "elb-used", `{"Instances": [{"InstanceId": "i-1"}]}`),
+					group(store.AutoScalingGroupStoreType, "asg-empty", `{"DesiredCapacity": 0}`),
+					group(store.AutoScalingGroupStoreType, "asg-used", `{"DesiredCapacity": 2}`),
+				},
+			},
+			orphans: []string{"empty-autoscaling-group asg-empty", "empty-load-balancer elb-empty"},
+		},
+		{
+			name: "subnets and route tables",
+			request: &OrphansRequest{
+				Instances: []*store.Instance{
+					ec2("i-1", "us-west-2", `{"SubnetId": "subnet-ec2", "NetworkInterfaces": [{"SubnetId": "subnet-eni"}]}`),
+					rds("db-1", "us-west-2", `{"DBSubnetGroup": {"Subnets": [{"SubnetIdentifier": "subnet-rds"}]}}`),
+				},
+				Groups: []*store.Group{
+					group(store.ELBStoreType, "elb-1", `{"Instances": [{"InstanceId": "i-1"}], "Subnets": ["subnet-elb"]}`),
+				},
+				Subnets: []*store.Subnet{
+					{Id: "subnet-ec2", Region: "us-west-2", AccountId: "123", Data: []byte(`{}`)},
+					{Id: "subnet-eni", Region: "us-west-2", AccountId: "123", Data: []byte(`{}`)},
+					{Id: "subnet-rds", Region: "us-west-2", AccountId: "123", Data: []byte(`{}`)},
+					{Id: "subnet-elb", Region: "us-west-2", AccountId: "123", Data: []byte(`{}`)},
+					{Id: "subnet-empty", Region: "us-west-2", AccountId: "123", Data: []byte(`{}`)},
+				},
+				RouteTables: []*store.RouteTable{
+					{Id: "rtb-used", Region: "us-west-2", AccountId: "123", Data: []byte(`{"Associations": [{"SubnetId": "subnet-ec2"}]}`)},
+					{Id: "rtb-empty", Region: "us-west-2", AccountId: "123", Data: []byte(`{"Associations": []}`)},
+				},
+			},
+			orphans: []string{"empty-subnet subnet-empty", "unassociated-route-table rtb-empty"},
+		},
+		{
+			name: "stopped instances",
+			request: &OrphansRequest{
+				Instances: []*store.Instance{
+					ec2("i-long", "us-west-2", `{"State": {"Name": "stopped"}, "StateTransitionReason": "User initiated (2016-03-10 19:45:43 GMT)"}`),
+					ec2("i-recent", "us-west-2", `{"State": {"Name": "stopped"}, "StateTransitionReason": "User initiated (2016-05-20 00:00:00 GMT)"}`),
+					ec2("i-unknown", "us-west-2", `{"State": {"Name": "stopped"}, "LaunchTime": "2015-01-01T00:00:00Z"}`),
+					ec2("i-new", "us-west-2", `{"State": {"Name": "stopped"}, "LaunchTime": "2016-05-30T00:00:00Z"}`),
+					ec2("i-running", "us-west-2", `{"State": {"Name": "running"}, "LaunchTime": "2015-01-01T00:00:00Z"}`),
+				},
+				StoppedDays: DefaultStoppedDays,
+			},
+			orphans:          []string{"stopped-instance i-long"},
+			unknownStopTimes: 1,
+		},
+		{
+			name: "stopped instances with unknown stop times",
+			request: &OrphansRequest{
+				Instances: []*store.Instance{
+					ec2("i-long", "us-west-2", `{"State": {"Name": "stopped"}, "StateTransitionReason": "User initiated (2016-03-10 19:45:43 GMT)"}`),
+					ec2("i-unknown", "us-west-2", `{"State": {"Name": "stopped"}, "LaunchTime": "2015-01-01T00:00:00Z"}`),
+				},
+				StoppedDays:             DefaultStoppedDays,
+				IncludeUnknownStopTimes: true,
+			},
+			orphans:          []string{"stopped-instance i-long", "stopped-instance i-unknown"},
+			unknownStopTimes: 1,
+		},
+		{
+			name: "read replicas",
+			request: &OrphansRequest{
+				Instances: []*store.Instance{
+					rds("db-source", "us-west-2", `{}`),
+					rds("db-replica", "us-west-2", `{"ReadReplicaSourceDBInstanceIdentifier": "db-source"}`),
+					rds("db-orphan", "us-west-2", `{"ReadReplicaSourceDBInstanceIdentifier": "db-gone"}`),
+					rds("db-cross-region", "us-east-1", `{"ReadReplicaSourceDBInstanceIdentifier": "arn:aws:rds:us-west-2:123:db:db-source"}`),
+					rds("db-cross-region-orphan", "us-east-1", `{"ReadReplicaSourceDBInstanceIdentifier": "arn:aws:rds:us-west-2:123:db:db-gone"}`),
+				},
+			},
+			orphans: []string{"orphaned-read-replica db-cross-region-orphan", "orphaned-read-replica db-orphan"},
+		},
+		{
+			// the replica's source is in another region, but still found
+			name: "region",
+			request: &OrphansRequest{
+				Instances: []*store.Instance{
+					rds("db-source", "us-west-2", `{}`),
+					rds("db-cross-region", "us-east-1", `{"ReadReplicaSourceDBInstanceIdentifier": "arn:aws:rds:us-west-2:123:db:db-source"}`),
+					rds("db-cross-region-orphan", "us-east-1", `{"ReadReplicaSourceDBInstanceIdentifier": "arn:aws:rds:us-west-2:123:db:db-gone"}`),
+					rds("db-orphan", "us-west-2", `{"ReadReplicaSourceDBInstanceIdentifier": "db-gone"}`),
+					ec2("i-unknown", "us-west-2", `{"State": {"Name": "stopped"}, "LaunchTime": "2015-01-01T00:00:00Z"}`),
+				},
+				Region:      "us-east-1",
+				StoppedDays: DefaultStoppedDays,
+			},
+			orphans: []string{"orphaned-read-replica db-cross-region-orphan"},
+		},
+		{
+			name: "malformed",
+			request: &OrphansRequest{
+				Instances: []*store.Instance{
+					ec2("i-malformed", "us-west-2", `{"State": "stopped"}`),
+				},
+				Groups: []*store.Group{
+					group(store.ELBStoreType, "elb-malformed", `[]`),
+					group(store.ELBStoreType, "elb-empty", `{}`),
+				},
+				RouteTables: []*store.RouteTable{
+					{Id: "rtb-malformed", Region: "us-west-2", AccountId: "123", Data: []byte(`{"Associations": 1}`)},
+				},
+				StoppedDays: DefaultStoppedDays,
+			},
+			orphans:   []string{"empty-load-balancer elb-empty"},
+			malformed: []string{"ec2 i-malformed", "elb elb-malformed", "route_table rtb-malformed"},
+		},
+	}
+
+	for _, test := range tests {
+		test.request.Now = now
+		report := FindOrphans(test.request)
+
+		orphans := make([]string, 0, len(report.Orphans))
+		for _, orphan := range report.Orphans {
+			orphans = append(orphans, orphan.Kind+" "+orphan.Id)
+		}
+
+		if !reflect.DeepEqual(orphans, test.orphans) {
+			t.Errorf("%s: got orphans %q, want %q", test.name, orphans, test.orphans)
+		}
+
+		if report.UnknownStopTimes != test.unknownStopTimes {
+			t.Errorf("%s: got %d unknown stop times, want %d", test.name, report.UnknownStopTimes, test.unknownStopTimes)
+		}
+
+		malformed := make([]string, 0, len(report.Malformed))
+		for _, entity := range report.Malformed {
+			malformed = append(malformed, entity.Type+" "+entity.Id)
+		}
+
+		want := test.malformed
+		if want == nil {
+			want = []string{}
+		}
+
+		if !reflect.DeepEqual(malformed, want) {
+			t.Errorf("%s: got malformed %q, want %q", test.name, malformed, want)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+// Package reports finds resources in a customer's stored inventory worth a
+// second look. Reports are computed from entities' data as fieri stored
+// it, so they only know about what's been ingested.
+package reports
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
+	"github.com/opsee/fieri/store"
+	"sort"
+)
+
+// The rules a reference can be in.
+const (
+	IngressRule = "ingress"
+	EgressRule  = "egress"
+)
+
+// defaultGroupName is the name of a VPC's default security group, which
+// can't be deleted.
+const defaultGroupName = "default"
+
+// Reference is a rule in one security group that names another through its
+// UserIdGroupPairs. ReferencedAccountId is the pair's UserId, which differs
+// from the group's account for groups in peered VPCs.
+type Reference struct {
+	GroupId             string `json:"group_id"`
+	GroupName           string `json:"group_name"`
+	Region              string `json:"region"`
+	AccountId           string `json:"account_id"`
+	Rule                string `json:"rule"`
+	IpProtocol          string `json:"ip_protocol"`
+	FromPort            *int64 `json:"from_port,omitempty"`
+	ToPort              *int64 `json:"to_port,omitempty"`
+	ReferencedGroupId   string `json:"referenced_group_id"`
+	ReferencedAccountId string `json:"referenced_account_id,omitempty"`
+}
+
+// References are the rules naming a security group, Inbound, and the rules
+// of the group naming others, Outbound. A group's rules naming itself are in
+// both. Malformed are the groups whose rules couldn't be read, which may
+// name it too.
+type References struct {
+	GroupId   string             `json:"group_id"`
+	Inbound   []*Reference       `json:"inbound"`
+	Outbound  []*Reference       `json:"outbound"`
+	Malformed []*MalformedEntity `json:"malformed"`
+}
+
+// UnusedSecurityGroup is a security group attached to nothing.
+type UnusedSecurityGroup struct {
+	GroupId   string `json:"group_id"`
+	GroupName string `json:"group_name"`
+	VpcId     string `json:"vpc_id,omitempty"`
+	Region    string `json:"region"`
+	AccountId string `json:"account_id"`
+	// Outbound are the groups its rules name, which may be unused too once
+	// it's gone.
+	Outbound []string `json:"outbound"`
+}
+
+// UnusedSecurityGroups is the security groups no instance, load balancer or
+// RDS instance is in, and no other group's rules name. Checked counts the
+// groups looked at, Defaults the VPC default groups left out, and Coverage
+// says where attachments were and weren't looked for.
+type UnusedSecurityGroups struct {
+	Groups   []*UnusedSecurityGroup `json:"groups"`
+	Checked  int                    `json:"checked"`
+	Defaults int                    `json:"defaults"`
+	Coverage *Coverage              `json:"coverage"`
+}
+
+// Coverage is what a report looked at, Checked, and what it couldn't,
+// Unchecked, since fieri doesn't ingest it, or Malformed, since its stored
+// data couldn't be read. A group reported unused may be used by something
+// unchecked or malformed.
+type Coverage struct {
+	Checked   []string           `json:"checked"`
+	Unchecked []string           `json:"unchecked"`
+	Malformed []*MalformedEntity `json:"malformed"`
+}
+
+// MalformedEntity is an entity a report skipped because its data couldn't
+// be read, with why in Error.
+type MalformedEntity struct {
+	Type      string `json:"type"`
+	Id        string `json:"id"`
+	Region    string `json:"region"`
+	AccountId string `json:"account_id"`
+	Error     string `json:"error"`
+}
+
+func malformedEntity(entityType, id, region, accountId string, err error) *MalformedEntity {
+	return &MalformedEntity{
+		Type:      entityType,
+		Id:        id,
+		Region:    region,
+		AccountId: accountId,
+		Error:     err.Error(),
+	}
+}
+
+// unusedSecurityGroupsCoverage is where FindUnusedSecurityGroups looks for
+// a group's use, and where else AWS lets one be used.
+var unusedSecurityGroupsCoverage = &Coverage{
+	Checked: []string{
+		"EC2 instances and their network interfaces",
+		"RDS instances",
+		"classic load balancers",
+		"security group rules",
+	},
+	Unchecked: []string{
+		"Lambda functions",
+		"ElastiCache clusters",
+		"Redshift clusters",
+		"EFS mount targets",
+		"application and network load balancers",
+		"VPC endpoints",
+		"network interfaces not attached to an instance",
+	},
+}
+
+// securityGroup is a stored security group's data, with the rules naming
+// other groups.
+type securityGroup struct {
+	group      *store.Group
+	data       *opsee_aws_ec2.SecurityGroup
+	references []*Reference
+}
+
+func newSecurityGroup(group *store.Group) (*securityGroup, error) {
+	data := &opsee_aws_ec2.SecurityGroup{}
+	if err := json.Unmarshal(group.Data, data); err != nil {
+		return nil, err
+	}
+
+	sg := &securityGroup{group: group, data: data, references: make([]*Reference, 0)}
+
+	rules := []struct {
+		rule        string
+		permissions []*opsee_aws_ec2.IpPermission
+	}{
+		{IngressRule, data.IpPermissions},
+		{EgressRule, data.IpPermissionsEgress},
+	}
+
+	for _, r := range rules {
+		for _, permission := range r.permissions {
+			for _, pair := range permission.UserIdGroupPairs {
+				if aws.StringValue(pair.GroupId) == "" {
+					continue
+				}
+
+				sg.references = append(sg.references, &Reference{
+					GroupId:             group.Name,
+					GroupName:           aws.StringValue(data.GroupName),
+					Region:              group.Region,
+					AccountId:           group.AccountId,
+					Rule:                r.rule,
+					IpProtocol:          aws.StringValue(permission.IpProtocol),
+					FromPort:            permission.FromPort,
+					ToPort:              permission.ToPort,
+					ReferencedGroupId:   aws.StringValue(pair.GroupId),
+					ReferencedAccountId: aws.StringValue(pair.UserId),
+				})
+			}
+		}
+	}
+
+	return sg, nil
+}
+
+// elbAttachments, ec2Attachments and rdsAttachments are the parts of load
+// balancer and instance data naming the security groups they're in.
+type elbAttachments struct {
+	SecurityGroups []string
+}
+
+type ec2Attachments struct {
+	SecurityGroups []struct {
+		GroupId string
+	}
+	// an instance's secondary interfaces can be in groups its primary
+	// isn't
+	NetworkInterfaces []struct {
+		Groups []struct {
+			GroupId string
+		}
+	}
+}
+
+type rdsAttachments struct {
+	VpcSecurityGroups []struct {
+		VpcSecurityGroupId string
+	}
+}
+
+// securityGroups reads the security groups among groups, skipping those
+// whose data can't be read, which are returned as malformed.
+func securityGroups(groups []*store.Group) ([]*securityGroup, []*MalformedEntity) {
+	sgs := make([]*securityGroup, 0, len(groups))
+	malformed := make([]*MalformedEntity, 0)
+	for _, group := range groups {
+		if group.Type != store.SecurityGroupStoreType {
+			continue
+		}
+
+		sg, err := newSecurityGroup(group)
+		if err != nil {
+			malformed = append(malformed, malformedEntity(group.Type, group.Name, group.Region, group.AccountId, err))
+			continue
+		}
+
+		sgs = append(sgs, sg)
+	}
+
+	return sgs, malformed
+}
+
+// FindReferences finds the references to and from a security group among a
+// customer's security groups, which should include those of every account,
+// since groups in peered VPCs can reference each other. Other groups whose
+// data can't be read are skipped and reported as malformed, but the group's
+// own must be readable.
+func FindReferences(group *store.Group, groups []*store.Group) (*References, error) {
+	sg, err := newSecurityGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	sgs, malformed := securityGroups(groups)
+
+	references := &References{
+		GroupId:   group.Name,
+		Inbound:   make([]*Reference, 0),
+		Outbound:  sg.references,
+		Malformed: malformed,
+	}
+
+	for _, other := range sgs {
+		for _, reference := range other.references {
+			if reference.ReferencedGroupId == group.Name {
+				references.Inbound = append(references.Inbound, reference)
+			}
+		}
+	}
+
+	return references, nil
+}
+
+// FindUnusedSecurityGroups finds the security groups among groups that
+// nothing uses: no EC2 instance, RDS instance or load balancer among
+// instances and groups is in them, and no other security group's rules name
+// them. VPC default groups, which can't be deleted, are left out. Only
+// groups in region and account, when they're set, are reported, but
+// attachments and references are looked for in everything given. Entities
+// whose data can't be read are skipped and listed in the report's coverage.
+func FindUnusedSecurityGroups(groups []*store.Group, instances []*store.Instance, region, accountId string) *UnusedSecurityGroups {
+	sgs, malformed := securityGroups(groups)
+
+	used := make(map[string]bool)
+
+	for _, sg := range sgs {
+		for _, reference := range sg.references {
+			if reference.ReferencedGroupId != sg.group.Name {
+				used[reference.ReferencedGroupId] = true
+			}
+		}
+	}
+
+	for _, group := range groups {
+		if group.Type != store.ELBStoreType {
+			continue
+		}
+
+		elb := &elbAttachments{}
+		if err := json.Unmarshal(group.Data, elb); err != nil {
+			malformed = append(malformed, malformedEntity(group.Type, group.Name, group.Region, group.AccountId, err))
+			continue
+		}
+
+		for _, id := range elb.SecurityGroups {
+			used[id] = true
+		}
+	}
+
+	for _, instance := range instances {
+		switch instance.Type {
+		case store.InstanceStoreType:
+			ec2 := &ec2Attachments{}
+			if err := json.Unmarshal(instance.Data, ec2); err != nil {
+				malformed = append(malformed, malformedEntity(instance.Type, instance.Id, instance.Region, instance.AccountId, err))
+				continue
+			}
+
+			for _, group := range ec2.SecurityGroups {
+				used[group.GroupId] = true
+			}
+
+			for _, iface := range ec2.NetworkInterfaces {
+				for _, group := range iface.Groups {
+					used[group.GroupId] = true
+				}
+			}
+
+		case store.DBInstanceStoreType:
+			rds := &rdsAttachments{}
+			if err := json.Unmarshal(instance.Data, rds); err != nil {
+				malformed = append(malformed, malformedEntity(instance.Type, instance.Id, instance.Region, instance.AccountId, err))
+				continue
+			}
+
+			for _, group := range rds.VpcSecurityGroups {
+				used[group.VpcSecurityGroupId] = true
+			}
+		}
+	}
+
+	// the coverage is shared, so the malformed entities go in a copy
+	coverage := *unusedSecurityGroupsCoverage
+	coverage.Malformed = malformed
+
+	report := &UnusedSecurityGroups{Groups: make([]*UnusedSecurityGroup, 0), Coverage: &coverage}
+
+	for _, sg := range sgs {
+		if region != "" && sg.group.Region != region {
+			continue
+		}
+
+		if accountId != "" && sg.group.AccountId != accountId {
+			continue
+		}
+
+		report.Checked++
+
+		if aws.StringValue(sg.data.GroupName) == defaultGroupName {
+			report.Defaults++
+			continue
+		}
+
+		if used[sg.group.Name] {
+			continue
+		}
+
+		unused := &UnusedSecurityGroup{
+			GroupId:   sg.group.Name,
+			GroupName: aws.StringValue(sg.data.GroupName),
+			VpcId:     aws.StringValue(sg.data.VpcId),
+			Region:    sg.group.Region,
+			AccountId: sg.group.AccountId,
+			Outbound:  make([]string, 0),
+		}
+
+		seen := make(map[string]bool)
+		for _, reference := range sg.references {
+			if id := reference.ReferencedGroupId; id != sg.group.Name && !seen[id] {
+				seen[id] = true
+				unused.Outbound = append(unused.Outbound, id)
+			}
+		}
+
+		report.Groups = append(report.Groups, unused)
+	}
+
+	sort.Slice(report.Groups, func(i, j int) bool { return report.Groups[i].GroupId < report.Groups[j].GroupId })
+
+	return report
+}
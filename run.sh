@@ -6,5 +6,5 @@ APPENV=${APPENV:-fierienv}
 /opt/bin/s3kms -r us-west-1 get -b opsee-keys -o dev/$APPENV > /$APPENV
 
 source /$APPENV && \
-	/opt/bin/migrate -url "$POSTGRES_CONN" -path /migrations up && \
+	/fieri migrate up && \
 	/fieri
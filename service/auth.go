@@ -0,0 +1,310 @@
+package service
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	AdminRole = "admin"
+)
+
+var (
+	errMissingToken      = errors.New("missing bearer token (Authorization: Bearer <token>).")
+	errUnsupportedToken  = errors.New("unsupported token format.")
+	errInvalidSignature  = errors.New("invalid token signature.")
+	errUnsupportedAlg    = errors.New("unsupported token algorithm.")
+	errTokenExpired      = errors.New("token has expired.")
+	errTokenNotYetValid  = errors.New("token is not valid yet.")
+	errAdminRequired     = errors.New("this route requires the admin role.")
+	errNoCustomerInToken = errors.New("token does not identify a customer.")
+)
+
+// Identity is the verified caller of a request.
+type Identity struct {
+	CustomerId string
+	Admin      bool
+}
+
+// Claims are the verified contents of a bearer token or JWT.
+type Claims struct {
+	CustomerId string   `json:"customer_id,omitempty"`
+	Roles      []string `json:"roles,omitempty"`
+	ExpiresAt  int64    `json:"exp,omitempty"`
+	NotBefore  int64    `json:"nbf,omitempty"`
+}
+
+func (c *Claims) valid() error {
+	now := time.Now().Unix()
+	if c.ExpiresAt != 0 && now >= c.ExpiresAt {
+		return errTokenExpired
+	}
+
+	if c.NotBefore != 0 && now < c.NotBefore {
+		return errTokenNotYetValid
+	}
+
+	return nil
+}
+
+func (c *Claims) identity() *Identity {
+	id := &Identity{CustomerId: c.CustomerId}
+	for _, role := range c.Roles {
+		if role == AdminRole {
+			id.Admin = true
+		}
+	}
+
+	return id
+}
+
+// Authenticator verifies the credentials on a request. Implementations return
+// errUnsupportedToken for credentials they don't understand, so that several
+// can be chained.
+type Authenticator interface {
+	Authenticate(token string) (*Identity, error)
+}
+
+type chainAuthenticator []Authenticator
+
+// NewAuthenticator returns an authenticator that accepts a token if any of
+// authenticators does.
+func NewAuthenticator(authenticators ...Authenticator) Authenticator {
+	return chainAuthenticator(authenticators)
+}
+
+func (c chainAuthenticator) Authenticate(token string) (*Identity, error) {
+	for _, a := range c {
+		id, err := a.Authenticate(token)
+		if err == errUnsupportedToken {
+			continue
+		}
+
+		return id, err
+	}
+
+	return nil, errUnsupportedToken
+}
+
+type staticAdminAuthenticator struct {
+	token []byte
+}
+
+// NewStaticAdminAuthenticator accepts a single shared secret as an admin
+// credential.
+func NewStaticAdminAuthenticator(token string) Authenticator {
+	return &staticAdminAuthenticator{[]byte(token)}
+}
+
+func (a *staticAdminAuthenticator) Authenticate(token string) (*Identity, error) {
+	if subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+		return nil, errUnsupportedToken
+	}
+
+	return &Identity{Admin: true}, nil
+}
+
+type hmacAuthenticator struct {
+	keys [][]byte
+}
+
+// NewHMACAuthenticator accepts tokens of the form <claims>.<signature>, both
+// base64url encoded, where the signature is an HMAC-SHA256 of the encoded
+// claims under one of keys.
+func NewHMACAuthenticator(keys ...string) Authenticator {
+	return &hmacAuthenticator{byteKeys(keys)}
+}
+
+func (a *hmacAuthenticator) Authenticate(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errUnsupportedToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidSignature
+	}
+
+	if !verifyHMAC(a.keys, []byte(parts[0]), sig) {
+		return nil, errInvalidSignature
+	}
+
+	return decodeClaims(parts[0])
+}
+
+// SignToken mints a bearer token for NewHMACAuthenticator.
+func SignToken(key string, claims *Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(encoded))
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+type jwtAuthenticator struct {
+	hmacKeys [][]byte
+	rsaKeys  []*rsa.PublicKey
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+// NewJWTAuthenticator accepts HS256 JWTs signed with one of hmacKeys and RS256
+// JWTs signed by the private half of one of rsaKeys.
+func NewJWTAuthenticator(hmacKeys []string, rsaKeys []*rsa.PublicKey) Authenticator {
+	return &jwtAuthenticator{
+		hmacKeys: byteKeys(hmacKeys),
+		rsaKeys:  rsaKeys,
+	}
+}
+
+func (a *jwtAuthenticator) Authenticate(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errUnsupportedToken
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errUnsupportedToken
+	}
+
+	header := &jwtHeader{}
+	if err = json.Unmarshal(headerJSON, header); err != nil {
+		return nil, errUnsupportedToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidSignature
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch header.Alg {
+	case "HS256":
+		if !verifyHMAC(a.hmacKeys, signed, sig) {
+			return nil, errInvalidSignature
+		}
+
+	case "RS256":
+		if !a.verifyRSA(signed, sig) {
+			return nil, errInvalidSignature
+		}
+
+	default:
+		return nil, errUnsupportedAlg
+	}
+
+	return decodeClaims(parts[1])
+}
+
+func (a *jwtAuthenticator) verifyRSA(signed, sig []byte) bool {
+	digest := sha256.Sum256(signed)
+	for _, key := range a.rsaKeys {
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LoadRSAPublicKey reads a PEM encoded RSA public key (PKIX or PKCS#1) from
+// path.
+func LoadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found in " + path)
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key: " + path)
+	}
+
+	return rsaKey, nil
+}
+
+func decodeClaims(encoded string) (*Identity, error) {
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errUnsupportedToken
+	}
+
+	claims := &Claims{}
+	if err = json.Unmarshal(payload, claims); err != nil {
+		return nil, errUnsupportedToken
+	}
+
+	if err = claims.valid(); err != nil {
+		return nil, err
+	}
+
+	return claims.identity(), nil
+}
+
+func verifyHMAC(keys [][]byte, signed, sig []byte) bool {
+	for _, key := range keys {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		if hmac.Equal(mac.Sum(nil), sig) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func byteKeys(keys []string) [][]byte {
+	bkeys := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		if k != "" {
+			bkeys = append(bkeys, []byte(k))
+		}
+	}
+
+	return bkeys
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
@@ -1,46 +1,173 @@
 package service
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/julienschmidt/httprouter"
+	"github.com/opsee/fieri/consumer"
+	"github.com/opsee/fieri/ingest"
+	"github.com/opsee/fieri/metrics"
+	"github.com/opsee/fieri/reports"
 	"github.com/opsee/fieri/store"
+	"github.com/opsee/fieri/webhooks"
 	"github.com/yeller/yeller-golang"
 	"golang.org/x/net/context"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type handlerFunc func(ctx context.Context, request interface{}) (interface{}, int, error)
-type decodeFunc func(r *http.Request, p httprouter.Params) (interface{}, error)
+type decodeFunc func(r *http.Request, p httprouter.Params, id *Identity) (interface{}, error)
 type panicFunc func(rw http.ResponseWriter, r *http.Request, data interface{})
 
+type access int
+
+const (
+	// publicAccess routes need no credentials.
+	publicAccess access = iota
+	// customerAccess routes act on the customer identified by the caller's
+	// credentials.
+	customerAccess
+	// adminAccess routes act across customers and require the admin role.
+	adminAccess
+)
+
+var (
+	httpRequests        = metrics.NewCounter("fieri_http_requests_total", "HTTP requests by route, method and status.", "route", "method", "status")
+	httpRequestDuration = metrics.NewHistogram("fieri_http_request_duration_seconds", "HTTP request latency by route, method and status.", metrics.DefaultBuckets, "route", "method", "status")
+	eventsSent          = metrics.NewCounter("fieri_events_sent_total", "Inventory events sent to /events streams by entity type.", "type")
+)
+
 func (s *service) StartHTTP(addr string) {
 	ctx := context.Background()
 
 	router := httprouter.New()
 	router.HandleMethodNotAllowed = true
 	router.PanicHandler = s.makePanicHandler()
-	router.OPTIONS("/*any", s.wrapHandler(ctx, decodeIdentity, s.okHandler))
-	router.GET("/health", s.wrapHandler(ctx, decodeIdentity, s.okHandler))
-	router.GET("/instances", s.wrapHandler(ctx, decodeInstancesRequest, s.instancesHandler))
-	router.GET("/instances/:type", s.wrapHandler(ctx, decodeInstancesRequest, s.instancesHandler))
-	router.GET("/instance/:type/:id", s.wrapHandler(ctx, decodeInstanceRequest, s.instanceHandler))
-	router.GET("/groups", s.wrapHandler(ctx, decodeGroupsRequest, s.groupsHandler))
-	router.GET("/groups/:type", s.wrapHandler(ctx, decodeGroupsRequest, s.groupsHandler))
-	router.GET("/group/:type/:id", s.wrapHandler(ctx, decodeGroupRequest, s.groupHandler))
-	router.POST("/entity/:type", s.wrapHandler(ctx, decodeEntityRequest, s.entityHandler))
-	router.GET("/customer", s.wrapHandler(ctx, decodeCustomerRequest, s.customerHandler))
-	http.ListenAndServe(addr, router)
-}
-
-func (s *service) wrapHandler(ctx context.Context, decoder decodeFunc, handler handlerFunc) httprouter.Handle {
+
+	handleWithTimeout := func(method, path string, level access, timeout time.Duration, decoder decodeFunc, handler handlerFunc) {
+		router.Handle(method, path, s.instrument(path, s.wrapHandler(ctx, level, timeout, decoder, handler)))
+	}
+
+	handle := func(method, path string, level access, decoder decodeFunc, handler handlerFunc) {
+		handleWithTimeout(method, path, level, forwardTimeout, decoder, handler)
+	}
+
+	handle("OPTIONS", "/*any", publicAccess, decodeIdentity, s.okHandler)
+	handle("GET", "/health", publicAccess, decodeIdentity, s.healthHandler)
+	handle("GET", "/instances", customerAccess, decodeInstancesRequest, s.instancesHandler)
+	handle("GET", "/instances/:type", customerAccess, decodeInstancesRequest, s.instancesHandler)
+	handle("GET", "/instance/:type/:id", customerAccess, decodeInstanceRequest, s.instanceHandler)
+	handle("GET", "/groups", customerAccess, decodeGroupsRequest, s.groupsHandler)
+	handle("GET", "/groups/:type", customerAccess, decodeGroupsRequest, s.groupsHandler)
+	handle("GET", "/group/:type/:id", customerAccess, decodeGroupRequest, s.groupHandler)
+	handle("GET", "/group/:type/:id/references", customerAccess, decodeReferencesRequest, s.referencesHandler)
+	handle("POST", "/entity/:type", customerAccess, decodeEntityRequest, s.entityHandler)
+	handle("GET", "/tags", customerAccess, decodeTagsRequest, s.tagsHandler)
+	handle("GET", "/lookup", customerAccess, decodeLookupRequest, s.lookupHandler)
+	handle("GET", "/costs", customerAccess, decodeCostsRequest, s.costsHandler)
+	handleWithTimeout("GET", "/reports/unused-security-groups", customerAccess, reportTimeout, decodeReportRequest, s.unusedSecurityGroupsHandler)
+	handleWithTimeout("GET", "/reports/orphans", customerAccess, reportTimeout, decodeOrphansRequest, s.orphansHandler)
+	handle("GET", "/customer", customerAccess, decodeCustomerRequest, s.customerHandler)
+	handle("GET", "/baselines", customerAccess, decodeBaselinesRequest(false), s.baselinesHandler)
+	handle("GET", "/baselines/:type/:id", customerAccess, decodeBaselineRequest, s.baselineHandler)
+	handle("PUT", "/baselines/:type/:id", customerAccess, decodePutBaselineRequest, s.putBaselineHandler)
+	handle("DELETE", "/baselines/:type/:id", customerAccess, decodeBaselineRequest, s.deleteBaselineHandler)
+	handle("GET", "/drift", customerAccess, decodeBaselinesRequest(true), s.baselinesHandler)
+	handle("GET", "/webhooks", customerAccess, decodeWebhooksRequest, s.webhooksHandler)
+	handle("POST", "/webhooks", customerAccess, decodePutWebhookRequest, s.putWebhookHandler)
+	handle("GET", "/webhooks/:id", customerAccess, decodeWebhookRequest, s.webhookHandler)
+	handle("DELETE", "/webhooks/:id", customerAccess, decodeWebhookRequest, s.deleteWebhookHandler)
+	handle("GET", "/webhooks/:id/deliveries", customerAccess, decodeWebhookDeliveriesRequest, s.webhookDeliveriesHandler)
+	handle("POST", "/webhooks/:id/enable", customerAccess, decodeWebhookRequest, s.enableWebhookHandler)
+	handleWithTimeout("POST", "/webhooks/:id/ping", customerAccess, pingTimeout, decodeWebhookRequest, s.pingWebhookHandler)
+	handle("GET", "/admin/customers", adminAccess, decodeIdentity, s.adminCustomersHandler)
+	handle("GET", "/admin/customers/:id", adminAccess, decodeAdminCustomerRequest, s.adminCustomerHandler)
+	handle("DELETE", "/admin/customers/:id", adminAccess, decodeAdminCustomerRequest, s.adminDeleteCustomerHandler)
+	handle("GET", "/admin/customers/:id/export", adminAccess, decodeAdminCustomerRequest, s.adminExportCustomerHandler)
+	handle("GET", "/admin/dead-letters", adminAccess, decodeDeadLettersRequest, s.deadLettersHandler)
+	handle("DELETE", "/admin/dead-letters", adminAccess, decodeDeadLettersRequest, s.purgeDeadLettersHandler)
+	handle("GET", "/admin/dead-letters/:id", adminAccess, decodeDeadLetterRequest, s.deadLetterHandler)
+	handle("DELETE", "/admin/dead-letters/:id", adminAccess, decodeDeadLetterRequest, s.deleteDeadLetterHandler)
+	handle("POST", "/admin/dead-letters/:id/replay", adminAccess, decodeDeadLetterRequest, s.replayDeadLetterHandler)
+	handle("GET", "/admin/dead-letter-summary", adminAccess, decodeIdentity, s.deadLetterSummaryHandler)
+	handle("GET", "/admin/ingest", adminAccess, decodeIdentity, s.ingestHandler)
+	handle("PUT", "/admin/ingest/global", adminAccess, decodeIngestPause(store.GlobalIngestScope, ""), s.pauseIngestHandler)
+	handle("DELETE", "/admin/ingest/global", adminAccess, decodeIngestPause(store.GlobalIngestScope, ""), s.resumeIngestHandler)
+	handle("PUT", "/admin/ingest/customers/:id", adminAccess, decodeIngestPause(store.CustomerIngestScope, "id"), s.pauseIngestHandler)
+	handle("DELETE", "/admin/ingest/customers/:id", adminAccess, decodeIngestPause(store.CustomerIngestScope, "id"), s.resumeIngestHandler)
+	handle("PUT", "/admin/ingest/types/:type", adminAccess, decodeIngestPause(store.TypeIngestScope, "type"), s.pauseIngestHandler)
+	handle("DELETE", "/admin/ingest/types/:type", adminAccess, decodeIngestPause(store.TypeIngestScope, "type"), s.resumeIngestHandler)
+	handleWithTimeout("POST", "/admin/customers/:id/import", adminAccess, archiveTimeout, decodeAdminRestoreRequest, s.adminRestoreCustomerHandler)
+
+	// event streams outlive any handler timeout, so they're served directly
+	router.Handle("GET", "/events", s.instrument("/events", s.eventsHandler))
+
+	s.serverMut.Lock()
+	s.server = &http.Server{Addr: addr, Handler: router}
+	s.serverMut.Unlock()
+
+	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.WithError(err).Error("http server failed")
+	}
+}
+
+// statusRecorder remembers the status written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streamed responses through the recorder.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// instrument records the count and latency of requests to a route, and
+// tracks the requests in flight for shutdown.
+func (s *service) instrument(route string, handle httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		atomic.AddInt64(&s.inFlight, 1)
+		defer atomic.AddInt64(&s.inFlight, -1)
+
+		start := time.Now()
+		recorder := &statusRecorder{rw, http.StatusOK}
+		handle(recorder, r, params)
+
+		status := strconv.Itoa(recorder.status)
+		httpRequests.Inc(route, r.Method, status)
+		httpRequestDuration.Observe(time.Since(start).Seconds(), route, r.Method, status)
+	}
+}
+
+func (s *service) wrapHandler(ctx context.Context, level access, timeout time.Duration, decoder decodeFunc, handler handlerFunc) httprouter.Handle {
 	return func(rw http.ResponseWriter, r *http.Request, params httprouter.Params) {
-		ctx, cancel := context.WithTimeout(ctx, forwardTimeout)
+		ctx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
 
-		req, err := decoder(r, params)
+		id, status, err := s.authorize(r, level)
+		if err != nil {
+			s.renderAuthError(rw, r, status, err)
+			return
+		}
+
+		req, err := decoder(r, params, id)
 		if err != nil {
 			s.renderBadRequest(rw, r, err)
 			return
@@ -60,19 +187,29 @@ func (s *service) wrapHandler(ctx context.Context, decoder decodeFunc, handler h
 				return
 			}
 
-			encodedResponse, err := encodeResponse(rf.response)
-			if err != nil {
-				s.renderServerError(rw, r, err)
-				return
+			if level == customerAccess {
+				s.setSyncHeaders(rw, id.CustomerId)
+			}
+
+			if stream, ok := rf.response.(*streamResponse); ok {
+				s.renderStream(rw, r, rf.status, stream)
+			} else {
+				encodedResponse, err := encodeResponse(rf.response)
+				if err != nil {
+					s.renderServerError(rw, r, err)
+					return
+				}
+
+				rw.WriteHeader(rf.status)
+				rw.Write(encodedResponse)
 			}
 
-			rw.WriteHeader(rf.status)
-			rw.Write(encodedResponse)
 			log.WithFields(log.Fields{
 				"status":      rf.status,
 				"path":        r.URL.RequestURI(),
 				"method":      r.Method,
-				"customer-id": r.Header.Get("Customer-Id"),
+				"customer-id": id.CustomerId,
+				"admin":       id.Admin,
 			}).Info("http request")
 
 		case <-ctx.Done():
@@ -83,67 +220,321 @@ func (s *service) wrapHandler(ctx context.Context, decoder decodeFunc, handler h
 	}
 }
 
-func decodeIdentity(r *http.Request, params httprouter.Params) (interface{}, error) {
-	return struct{}{}, nil
+// authorize verifies the request's credentials for the given access level,
+// returning the caller's identity or the status to reject the request with.
+// Admins may act on behalf of a customer by naming it in the Customer-Id
+// header; everyone else gets the customer from their credentials.
+func (s *service) authorize(r *http.Request, level access) (*Identity, int, error) {
+	if level == publicAccess {
+		return &Identity{}, http.StatusOK, nil
+	}
+
+	token := bearerToken(r)
+	if token == "" {
+		return nil, http.StatusUnauthorized, errMissingToken
+	}
+
+	if s.auth == nil {
+		return nil, http.StatusUnauthorized, errUnsupportedToken
+	}
+
+	id, err := s.auth.Authenticate(token)
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+
+	switch level {
+	case adminAccess:
+		if !id.Admin {
+			return nil, http.StatusForbidden, errAdminRequired
+		}
+
+	case customerAccess:
+		if id.Admin {
+			if customerId := r.Header.Get("Customer-Id"); customerId != "" {
+				id = &Identity{CustomerId: customerId, Admin: true}
+			}
+		}
+
+		if id.CustomerId == "" {
+			if id.Admin {
+				return nil, http.StatusBadRequest, errMissingCustomerId
+			}
+
+			return nil, http.StatusForbidden, errNoCustomerInToken
+		}
+	}
+
+	return id, http.StatusOK, nil
 }
 
-func decodeInstanceRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
-	customerId := r.Header.Get("Customer-Id")
+// setSyncHeaders reports the freshness of a customer's inventory on
+// customer-scoped responses, from the last syncs the stale monitor keeps.
+func (s *service) setSyncHeaders(rw http.ResponseWriter, customerId string) {
 	if customerId == "" {
-		return nil, errMissingCustomerId
+		return
+	}
+
+	lastSync, stale, ok := s.monitor.LastSync(customerId)
+	if !ok {
+		return
+	}
+
+	rw.Header().Set("X-Fieri-Last-Sync", lastSync.UTC().Format(time.RFC3339))
+	rw.Header().Set("X-Fieri-Stale", strconv.FormatBool(stale))
+}
+
+func decodeIdentity(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	return struct{}{}, nil
+}
+
+func decodeInstanceRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	changedSince, err := decodeChangedSince(r)
+	if err != nil {
+		return nil, err
+	}
+
+	view, err := decodeView(r)
+	if err != nil {
+		return nil, err
 	}
 
 	return &store.InstanceRequest{
-		CustomerId: customerId,
-		InstanceId: params.ByName("id"),
-		Type:       params.ByName("type"),
+		CustomerId:   id.CustomerId,
+		InstanceId:   params.ByName("id"),
+		Type:         params.ByName("type"),
+		Region:       r.URL.Query().Get("region"),
+		AccountId:    r.URL.Query().Get("account"),
+		ChangedSince: changedSince,
+		View:         view,
 	}, nil
 }
 
-func decodeInstancesRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
-	customerId := r.Header.Get("Customer-Id")
-	if customerId == "" {
-		return nil, errMissingCustomerId
+func decodeInstancesRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	changedSince, err := decodeChangedSince(r)
+	if err != nil {
+		return nil, err
+	}
+
+	view, err := decodeView(r)
+	if err != nil {
+		return nil, err
 	}
 
 	return &store.InstancesRequest{
-		CustomerId: customerId,
-		Type:       params.ByName("type"),
+		CustomerId:   id.CustomerId,
+		Type:         params.ByName("type"),
+		Region:       r.URL.Query().Get("region"),
+		AccountId:    r.URL.Query().Get("account"),
+		ChangedSince: changedSince,
+		View:         view,
 	}, nil
 }
 
-func decodeGroupRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
-	customerId := r.Header.Get("Customer-Id")
-	if customerId == "" {
-		return nil, errMissingCustomerId
+// decodeTagsRequest reads the tag catalog's filters: ?prefix= and
+// ?value_prefix= match the start of keys and values, and ?key=, ?type=,
+// ?region= and ?account= match exactly.
+func decodeTagsRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	query := r.URL.Query()
+
+	entityType := query.Get("type")
+	if entityType != "" && !contains(store.StoreTypes, entityType) {
+		return nil, errUnknownStoreType
+	}
+
+	return &store.TagsRequest{
+		CustomerId:  id.CustomerId,
+		Prefix:      query.Get("prefix"),
+		Key:         query.Get("key"),
+		ValuePrefix: query.Get("value_prefix"),
+		EntityType:  entityType,
+		Region:      query.Get("region"),
+		AccountId:   query.Get("account"),
+	}, nil
+}
+
+// decodeReferencesRequest reads the security group whose references are
+// found. Only security groups have rules naming other groups.
+func decodeReferencesRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	if params.ByName("type") != store.SecurityGroupStoreType {
+		return nil, errUnsupportedReferences
 	}
 
 	return &store.GroupRequest{
-		CustomerId: customerId,
+		CustomerId: id.CustomerId,
 		GroupId:    params.ByName("id"),
-		Type:       params.ByName("type"),
+		Type:       store.SecurityGroupStoreType,
+		Region:     r.URL.Query().Get("region"),
+		AccountId:  r.URL.Query().Get("account"),
 	}, nil
 }
 
-func decodeGroupsRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
-	customerId := r.Header.Get("Customer-Id")
-	if customerId == "" {
-		return nil, errMissingCustomerId
+// decodeReportRequest reads what a report covers, all of a customer's
+// inventory, or what's in ?region= and ?account=.
+func decodeReportRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	return &store.GroupsRequest{
+		CustomerId: id.CustomerId,
+		Region:     r.URL.Query().Get("region"),
+		AccountId:  r.URL.Query().Get("account"),
+	}, nil
+}
+
+// decodeOrphansRequest reads what the orphans report covers, ?stopped_days=,
+// how long an instance must have been stopped for to be reported, and
+// ?include_unknown_stop_times=true to report stopped instances whose stop
+// time isn't known.
+func decodeOrphansRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	query := r.URL.Query()
+	request := &orphansRequest{
+		customerId:  id.CustomerId,
+		region:      query.Get("region"),
+		accountId:   query.Get("account"),
+		stoppedDays: reports.DefaultStoppedDays,
+	}
+
+	if days := query.Get("stopped_days"); days != "" {
+		var err error
+		if request.stoppedDays, err = strconv.Atoi(days); err != nil || request.stoppedDays < 0 {
+			return nil, errMalformedStoppedDays
+		}
+	}
+
+	if include := query.Get("include_unknown_stop_times"); include != "" {
+		var err error
+		if request.includeUnknownStopTimes, err = strconv.ParseBool(include); err != nil {
+			return nil, errMalformedUnknownStops
+		}
+	}
+
+	return request, nil
+}
+
+// decodeLookupRequest reads the address to look up, exactly one of ?ip=
+// and ?dns=.
+func decodeLookupRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	query := r.URL.Query()
+
+	ip := query.Get("ip")
+	dns := query.Get("dns")
+	if (ip == "") == (dns == "") {
+		return nil, errMissingLookup
+	}
+
+	if ip != "" && net.ParseIP(ip) == nil {
+		return nil, errMalformedIp
+	}
+
+	view, err := decodeView(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &store.LookupRequest{
+		CustomerId: id.CustomerId,
+		Ip:         ip,
+		Dns:        dns,
+		View:       view,
+	}, nil
+}
+
+// decodeCostsRequest reads the instances whose costs are estimated, all
+// of a customer's, or those in ?region= and ?account=.
+func decodeCostsRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	return &store.InstancesRequest{
+		CustomerId: id.CustomerId,
+		Region:     r.URL.Query().Get("region"),
+		AccountId:  r.URL.Query().Get("account"),
+	}, nil
+}
+
+func decodeGroupRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	changedSince, err := decodeChangedSince(r)
+	if err != nil {
+		return nil, err
+	}
+
+	view, err := decodeView(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &store.GroupRequest{
+		CustomerId:   id.CustomerId,
+		GroupId:      params.ByName("id"),
+		Type:         params.ByName("type"),
+		Region:       r.URL.Query().Get("region"),
+		AccountId:    r.URL.Query().Get("account"),
+		ChangedSince: changedSince,
+		View:         view,
+	}, nil
+}
+
+func decodeGroupsRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	changedSince, err := decodeChangedSince(r)
+	if err != nil {
+		return nil, err
+	}
+
+	view, err := decodeView(r)
+	if err != nil {
+		return nil, err
 	}
 
 	return &store.GroupsRequest{
-		CustomerId: customerId,
-		Type:       params.ByName("type"),
+		CustomerId:   id.CustomerId,
+		Type:         params.ByName("type"),
+		Region:       r.URL.Query().Get("region"),
+		AccountId:    r.URL.Query().Get("account"),
+		ChangedSince: changedSince,
+		View:         view,
 	}, nil
 }
 
-func decodeEntityRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
+// decodeView reads the optional view query parameter, the data view when
+// it's absent.
+func decodeView(r *http.Request) (string, error) {
+	view := r.URL.Query().Get("view")
+	if view == "" {
+		return store.DataView, nil
+	}
+
+	if !contains(store.Views, view) {
+		return "", errUnknownView
+	}
+
+	return view, nil
+}
+
+// unchanged is whether an entity that last changed at changedAt hasn't
+// changed since changedSince, if that's given.
+func unchanged(changedAt, changedSince time.Time) bool {
+	return !changedSince.IsZero() && !changedAt.After(changedSince)
+}
+
+// decodeChangedSince reads the optional changed_since query parameter, the
+// zero time when it's absent.
+func decodeChangedSince(r *http.Request) (time.Time, error) {
+	changedSince := r.URL.Query().Get("changed_since")
+	if changedSince == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, changedSince)
+	if err != nil {
+		return time.Time{}, errMalformedChangedSince
+	}
+
+	return t, nil
+}
+
+func decodeEntityRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	entity, err := store.NewEntity(params.ByName("type"), r.Header.Get("Customer-Id"), body)
+	query := r.URL.Query()
+	entity, err := store.NewEntity(params.ByName("type"), id.CustomerId, query.Get("region"), query.Get("account"), body)
 	if err != nil {
 		log.WithError(err).WithField("body", string(body)).Error("failed decoding entity")
 		return nil, errMalformedRequestBody
@@ -152,95 +543,1123 @@ func decodeEntityRequest(r *http.Request, params httprouter.Params) (interface{}
 	return entity, nil
 }
 
-func decodeCustomerRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
-	customerId := r.Header.Get("Customer-Id")
+func decodeCustomerRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	request := &store.CustomerRequest{Id: id.CustomerId}
+	return request, nil
+}
+
+func decodeAdminCustomerRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	customerId := params.ByName("id")
 	if customerId == "" {
 		return nil, errMissingCustomerId
 	}
 
-	request := &store.CustomerRequest{Id: customerId}
-	return request, nil
+	return &store.CustomerRequest{Id: customerId}, nil
 }
 
-func (s *service) okHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
-	return map[string]bool{"ok": true}, http.StatusOK, nil
-}
+func decodeAdminRestoreRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	customerId := params.ByName("id")
+	if customerId == "" {
+		return nil, errMissingCustomerId
+	}
 
-func (s *service) instancesHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
-	response, err := s.ListInstances(request.(*store.InstancesRequest))
+	archive, err := store.NewArchiveReader(r.Body)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	return response, http.StatusOK, nil
+	return &store.RestoreRequest{CustomerId: customerId, Archive: archive}, nil
 }
 
-func (s *service) instanceHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
-	response, err := s.GetInstance(request.(*store.InstanceRequest))
+func decodeDeadLetterRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	deadLetterId, err := strconv.ParseInt(params.ByName("id"), 10, 64)
 	if err != nil {
-		return nil, 0, err
+		return nil, errMalformedDeadLetterId
 	}
 
-	return response, http.StatusOK, nil
+	return &store.DeadLetterRequest{Id: deadLetterId}, nil
 }
 
-func (s *service) groupsHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
-	response, err := s.ListGroups(request.(*store.GroupsRequest))
-	if err != nil {
-		return nil, 0, err
+func decodeDeadLettersRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	request := &store.DeadLettersRequest{
+		CustomerId: r.URL.Query().Get("customer"),
+		EntityType: r.URL.Query().Get("type"),
 	}
 
-	return response, http.StatusOK, nil
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		var err error
+		if request.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, errMalformedLimit
+		}
+	}
+
+	return request, nil
 }
 
-func (s *service) groupHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
-	response, err := s.GetGroup(request.(*store.GroupRequest))
-	if err != nil {
-		return nil, 0, err
+// decodeEventsRequest reads the event id to resume after from the
+// Last-Event-ID header, which browsers send when they reconnect, or the
+// last_event_id query parameter. After is -1 when there is neither, for a
+// stream of new events only. ?type= takes a comma-separated list of entity
+// types.
+func decodeEventsRequest(r *http.Request, id *Identity) (*store.InventoryEventsRequest, error) {
+	request := &store.InventoryEventsRequest{
+		CustomerId: id.CustomerId,
+		After:      -1,
+		Limit:      eventsPageSize,
 	}
 
-	return response, http.StatusOK, nil
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("last_event_id")
+	}
+
+	if lastEventId != "" {
+		after, err := strconv.ParseInt(lastEventId, 10, 64)
+		if err != nil || after < 0 {
+			return nil, errMalformedLastEventId
+		}
+		request.After = after
+	}
+
+	isComma := func(c rune) bool { return c == ',' }
+	for _, entityType := range strings.FieldsFunc(r.URL.Query().Get("type"), isComma) {
+		if !contains(store.InventoryEventTypes, entityType) {
+			return nil, errUnknownEventType
+		}
+
+		request.EntityTypes = append(request.EntityTypes, entityType)
+	}
+
+	return request, nil
 }
 
-func (s *service) entityHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
-	response, err := s.PutEntity(request)
+// decodeBaselinesRequest returns a decoder for listing baselines, of
+// ?type= when it's given, and only drifted ones when drifted is set.
+func decodeBaselinesRequest(drifted bool) decodeFunc {
+	return func(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+		entityType := r.URL.Query().Get("type")
+		if entityType != "" && !contains(store.StoreTypes, entityType) {
+			return nil, errUnknownStoreType
+		}
+
+		return &store.BaselinesRequest{CustomerId: id.CustomerId, EntityType: entityType, Drifted: drifted}, nil
+	}
+}
+
+func decodeBaselineRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	entityType := params.ByName("type")
+	if !contains(store.StoreTypes, entityType) {
+		return nil, errUnknownStoreType
+	}
+
+	return &store.BaselineRequest{
+		CustomerId: id.CustomerId,
+		EntityType: entityType,
+		EntityId:   params.ByName("id"),
+		Region:     r.URL.Query().Get("region"),
+		AccountId:  r.URL.Query().Get("account"),
+	}, nil
+}
+
+// decodePutBaselineRequest reads a baseline from the body, either
+// {"expected": {...}, "exact": false} or {"snapshot": true}.
+func decodePutBaselineRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	baselineRequest, err := decodeBaselineRequest(r, params, id)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	return response, http.StatusCreated, nil
+	request := &store.PutBaselineRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		return nil, errMalformedRequestBody
+	}
+
+	if request.Snapshot == (len(request.Expected) > 0) {
+		return nil, errMalformedBaseline
+	}
+
+	if !request.Snapshot && !strings.HasPrefix(strings.TrimSpace(string(request.Expected)), "{") {
+		return nil, errMalformedBaseline
+	}
+
+	// the route names the entity, the body only what's expected of it
+	request.BaselineRequest = *baselineRequest.(*store.BaselineRequest)
+
+	return request, nil
 }
 
-func (s *service) customerHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
-	response, err := s.GetCustomer(request.(*store.CustomerRequest))
+func decodeWebhooksRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	return &store.WebhooksRequest{CustomerId: id.CustomerId}, nil
+}
+
+func decodeWebhookRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	webhookId, err := strconv.ParseInt(params.ByName("id"), 10, 64)
 	if err != nil {
-		return MessageResponse{"No customer exists."}, http.StatusOK, nil
+		return nil, errMalformedWebhookId
 	}
 
-	return response, http.StatusOK, nil
+	return &store.WebhookRequest{CustomerId: id.CustomerId, Id: webhookId}, nil
 }
 
-func (s *service) makePanicHandler() panicFunc {
-	return func(rw http.ResponseWriter, r *http.Request, data interface{}) {
-		yeller.NotifyPanic(data)
-		s.renderServerError(rw, r, fmt.Errorf("panic data: %#v", data))
+func decodeWebhookDeliveriesRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	webhookId, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil {
+		return nil, errMalformedWebhookId
+	}
+
+	request := &store.WebhookDeliveriesRequest{CustomerId: id.CustomerId, WebhookId: webhookId}
+
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		if request.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, errMalformedLimit
+		}
 	}
+
+	return request, nil
 }
 
-func (s *service) renderServerError(rw http.ResponseWriter, r *http.Request, err error) {
-	log.WithError(err).WithField("request", *r).Error("internal server error")
-	msg, _ := encodeResponse(MessageResponse{"An unexpected error happened."})
-	rw.WriteHeader(http.StatusInternalServerError)
-	rw.Write(msg)
+// decodePutWebhookRequest reads a new webhook from the body:
+// {"url": "...", "secret": "...", "entity_types": [...], "actions": [...]}.
+// Only the url is required, empty filters match every event.
+func decodePutWebhookRequest(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+	body := struct {
+		Url         string   `json:"url"`
+		Secret      string   `json:"secret"`
+		EntityTypes []string `json:"entity_types"`
+		Actions     []string `json:"actions"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, errMalformedRequestBody
+	}
+
+	u, err := url.Parse(body.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errMalformedWebhookUrl
+	}
+
+	for _, entityType := range body.EntityTypes {
+		if !contains(store.InventoryEventTypes, entityType) {
+			return nil, errUnknownWebhookType
+		}
+	}
+
+	for _, action := range body.Actions {
+		if !contains(store.InventoryEventActions, action) {
+			return nil, errUnknownWebhookAction
+		}
+	}
+
+	return &store.Webhook{
+		CustomerId:  id.CustomerId,
+		Url:         body.Url,
+		Secret:      body.Secret,
+		EntityTypes: store.StringList(body.EntityTypes),
+		Actions:     store.StringList(body.Actions),
+	}, nil
 }
 
-func (s *service) renderBadRequest(rw http.ResponseWriter, r *http.Request, err error) {
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decodeIngestPause returns a decoder for pauses of scope, whose value is
+// the route parameter named param. The body may give a reason:
+// {"reason": "..."}.
+func decodeIngestPause(scope, param string) decodeFunc {
+	return func(r *http.Request, params httprouter.Params, id *Identity) (interface{}, error) {
+		pause := &store.IngestPause{Scope: scope}
+		if param != "" {
+			pause.Value = params.ByName(param)
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, pause); err != nil {
+				return nil, errMalformedRequestBody
+			}
+			// the route decides what is paused, the body only explains why
+			pause.Scope = scope
+			if param != "" {
+				pause.Value = params.ByName(param)
+			}
+		}
+
+		return pause, nil
+	}
+}
+
+func (s *service) okHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	return map[string]bool{"ok": true}, http.StatusOK, nil
+}
+
+func (s *service) instancesHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.ListInstances(request.(*store.InstancesRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+// instanceHandler answers 304 Not Modified if ?changed_since= is given and
+// the instance's data hasn't changed since.
+func (s *service) instanceHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	instanceRequest := request.(*store.InstanceRequest)
+
+	response, err := s.GetInstance(instanceRequest)
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No instance exists."}, http.StatusNotFound, nil
+	}
+
+	if err == store.ErrAmbiguousEntity {
+		return MessageResponse{fmt.Sprint("Bad request: ", err)}, http.StatusBadRequest, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if unchanged(response.Instance.ChangedAt, instanceRequest.ChangedSince) {
+		return nil, http.StatusNotModified, nil
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) groupsHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.ListGroups(request.(*store.GroupsRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+// groupHandler answers 304 Not Modified if ?changed_since= is given and the
+// group's own data hasn't changed since, whatever its members'.
+func (s *service) groupHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	groupRequest := request.(*store.GroupRequest)
+
+	response, err := s.GetGroup(groupRequest)
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No group exists."}, http.StatusNotFound, nil
+	}
+
+	if err == store.ErrAmbiguousEntity {
+		return MessageResponse{fmt.Sprint("Bad request: ", err)}, http.StatusBadRequest, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if unchanged(response.Group.ChangedAt, groupRequest.ChangedSince) {
+		return nil, http.StatusNotModified, nil
+	}
+
+	return response, http.StatusOK, nil
+}
+
+// referencesHandler finds the references to and from a security group
+// among all of the customer's security groups, whatever their account, since
+// groups in peered VPCs can reference each other.
+func (s *service) referencesHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	groupRequest := request.(*store.GroupRequest)
+
+	groupsResponse, err := s.ListGroups(&store.GroupsRequest{
+		CustomerId: groupRequest.CustomerId,
+		Type:       store.SecurityGroupStoreType,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var matches []*store.Group
+	groups := make([]*store.Group, 0, len(groupsResponse.Groups))
+	for _, response := range groupsResponse.Groups {
+		g := response.Group
+		groups = append(groups, g)
+
+		if g.Name != groupRequest.GroupId {
+			continue
+		}
+
+		if (groupRequest.Region == "" || g.Region == groupRequest.Region) && (groupRequest.AccountId == "" || g.AccountId == groupRequest.AccountId) {
+			matches = append(matches, g)
+		}
+	}
+
+	if len(matches) == 0 {
+		return MessageResponse{"No security group exists."}, http.StatusNotFound, nil
+	}
+
+	if len(matches) > 1 {
+		return MessageResponse{fmt.Sprint("Bad request: ", store.ErrAmbiguousEntity)}, http.StatusBadRequest, nil
+	}
+	group := matches[0]
+
+	references, err := reports.FindReferences(group, groups)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return references, http.StatusOK, nil
+}
+
+// unusedSecurityGroupsHandler reports the unused security groups in the
+// request's region and account, looking for their attachments and
+// references in all of the customer's inventory.
+func (s *service) unusedSecurityGroupsHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	reportRequest := request.(*store.GroupsRequest)
+
+	groupsResponse, err := s.ListGroups(&store.GroupsRequest{CustomerId: reportRequest.CustomerId})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	instancesResponse, err := s.ListInstances(&store.InstancesRequest{CustomerId: reportRequest.CustomerId})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	groups := make([]*store.Group, 0, len(groupsResponse.Groups))
+	for _, response := range groupsResponse.Groups {
+		groups = append(groups, response.Group)
+	}
+
+	instances := make([]*store.Instance, 0, len(instancesResponse.Instances))
+	for _, response := range instancesResponse.Instances {
+		instances = append(instances, response.Instance)
+	}
+
+	return reports.FindUnusedSecurityGroups(groups, instances, reportRequest.Region, reportRequest.AccountId), http.StatusOK, nil
+}
+
+// orphansHandler reports the orphaned and idle resources in the request's
+// region and account, looking at all of the customer's inventory to decide
+// what's orphaned.
+func (s *service) orphansHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	orphans := request.(*orphansRequest)
+	customerId := orphans.customerId
+
+	instancesResponse, err := s.ListInstances(&store.InstancesRequest{CustomerId: customerId})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	groupsResponse, err := s.ListGroups(&store.GroupsRequest{CustomerId: customerId})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	subnetsResponse, err := s.ListSubnets(&store.SubnetsRequest{CustomerId: customerId})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	routeTablesResponse, err := s.ListRouteTables(&store.RouteTablesRequest{CustomerId: customerId})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reportRequest := &reports.OrphansRequest{
+		Instances:               make([]*store.Instance, 0, len(instancesResponse.Instances)),
+		Groups:                  make([]*store.Group, 0, len(groupsResponse.Groups)),
+		Subnets:                 subnetsResponse.Subnets,
+		RouteTables:             routeTablesResponse.RouteTables,
+		Region:                  orphans.region,
+		AccountId:               orphans.accountId,
+		StoppedDays:             orphans.stoppedDays,
+		IncludeUnknownStopTimes: orphans.includeUnknownStopTimes,
+		Now:                     time.Now().UTC(),
+	}
+
+	for _, response := range instancesResponse.Instances {
+		reportRequest.Instances = append(reportRequest.Instances, response.Instance)
+	}
+
+	for _, response := range groupsResponse.Groups {
+		reportRequest.Groups = append(reportRequest.Groups, response.Group)
+	}
+
+	return reports.FindOrphans(reportRequest), http.StatusOK, nil
+}
+
+func (s *service) tagsHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.ListTags(request.(*store.TagsRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) lookupHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.Lookup(request.(*store.LookupRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) costsHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	instancesRequest := request.(*store.InstancesRequest)
+
+	instancesResponse, err := s.ListInstances(instancesRequest)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	groupsResponse, err := s.ListGroups(&store.GroupsRequest{
+		CustomerId: instancesRequest.CustomerId,
+		Region:     instancesRequest.Region,
+		AccountId:  instancesRequest.AccountId,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	membershipsResponse, err := s.ListMemberships(&store.MembershipsRequest{
+		CustomerId: instancesRequest.CustomerId,
+		Region:     instancesRequest.Region,
+		AccountId:  instancesRequest.AccountId,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	instances := make([]*store.Instance, 0, len(instancesResponse.Instances))
+	for _, response := range instancesResponse.Instances {
+		instances = append(instances, response.Instance)
+	}
+
+	groups := make([]*store.Group, 0, len(groupsResponse.Groups))
+	for _, response := range groupsResponse.Groups {
+		groups = append(groups, response.Group)
+	}
+
+	return s.costs.Estimate(instances, groups, membershipsResponse.Memberships), http.StatusOK, nil
+}
+
+func (s *service) entityHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.PutEntity(request)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusCreated, nil
+}
+
+func (s *service) customerHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.GetCustomer(request.(*store.CustomerRequest))
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No customer exists."}, http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) adminCustomersHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.ListCustomers()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) adminCustomerHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.GetCustomerSummary(request.(*store.CustomerRequest))
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No customer exists."}, http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) adminDeleteCustomerHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.DeleteCustomer(request.(*store.CustomerRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	log.WithFields(log.Fields{
+		"customer-id":  response.Id,
+		"customer":     response.Customer,
+		"instances":    response.Instances,
+		"groups":       response.Groups,
+		"memberships":  response.Memberships,
+		"subnets":      response.Subnets,
+		"route-tables": response.RouteTables,
+		"webhooks":     response.Webhooks,
+		"baselines":    response.Baselines,
+		"dead-letters": response.DeadLetters,
+		"events":       response.Events,
+		"pauses":       response.Pauses,
+	}).Info("purged customer")
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) adminExportCustomerHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	customerRequest := request.(*store.CustomerRequest)
+
+	_, err := s.GetCustomer(customerRequest)
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No customer exists."}, http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the archive is written after the handler returns, so big customers
+	// aren't cut off by the forwarding timeout
+	return &streamResponse{
+		contentType: "application/gzip",
+		filename:    fmt.Sprintf("fieri-%s-%s.ndjson.gz", customerRequest.Id, time.Now().UTC().Format("20060102T150405Z")),
+		write: func(w io.Writer) error {
+			archive := store.NewArchiveWriter(w)
+			if err := s.ExportCustomer(customerRequest, archive); err != nil {
+				return err
+			}
+
+			return archive.Close()
+		},
+	}, http.StatusOK, nil
+}
+
+func (s *service) adminRestoreCustomerHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.RestoreCustomer(request.(*store.RestoreRequest))
+	if _, ok := err.(*store.ArchiveError); ok {
+		return MessageResponse{fmt.Sprint("Bad request: ", err)}, http.StatusBadRequest, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	log.WithFields(log.Fields{
+		"customer-id":        response.Id,
+		"source-customer-id": response.SourceCustomerId,
+		"instances":          response.Instances,
+		"groups":             response.Groups,
+		"memberships":        response.Memberships,
+		"subnets":            response.Subnets,
+		"route-tables":       response.RouteTables,
+	}).Info("restored customer")
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) deadLettersHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.ListDeadLetters(request.(*store.DeadLettersRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) deadLetterHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.GetDeadLetter(request.(*store.DeadLetterRequest))
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No dead letter exists."}, http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) deleteDeadLetterHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	err := s.DeleteDeadLetter(request.(*store.DeadLetterRequest))
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No dead letter exists."}, http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return MessageResponse{"Dead letter deleted."}, http.StatusOK, nil
+}
+
+func (s *service) purgeDeadLettersHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	deadLettersRequest := request.(*store.DeadLettersRequest)
+
+	response, err := s.PurgeDeadLetters(deadLettersRequest)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	log.WithFields(log.Fields{
+		"customer-id": deadLettersRequest.CustomerId,
+		"type":        deadLettersRequest.EntityType,
+		"deleted":     response.Deleted,
+	}).Info("purged dead letters")
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) deadLetterSummaryHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.SummarizeDeadLetters()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+// replayDeadLetterHandler stores a dead letter's message the way the
+// consumer would have, deleting the dead letter if that works and recording
+// the new error if it doesn't.
+func (s *service) replayDeadLetterHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.GetDeadLetter(request.(*store.DeadLetterRequest))
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No dead letter exists."}, http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	deadLetter := response.DeadLetter
+
+	_, entity, err := consumer.DecodeEntity(deadLetter.Body)
+	if err == nil {
+		_, err = s.PutEntity(entity)
+	}
+
+	if err != nil {
+		deadLetter.Error = err.Error()
+		deadLetter.Attempts++
+		if updateErr := s.UpdateDeadLetter(deadLetter); updateErr != nil {
+			return nil, 0, updateErr
+		}
+
+		deadLetter.Body = nil
+		return &ReplayResponse{DeadLetter: deadLetter, Replayed: false}, http.StatusUnprocessableEntity, nil
+	}
+
+	if err = s.DeleteDeadLetter(&store.DeadLetterRequest{Id: deadLetter.Id}); err != nil {
+		return nil, 0, err
+	}
+
+	log.WithFields(log.Fields{
+		"dead-letter-id": deadLetter.Id,
+		"customer-id":    deadLetter.CustomerId,
+		"type":           deadLetter.EntityType,
+	}).Info("replayed dead letter")
+
+	deadLetter.Body = nil
+	return &ReplayResponse{DeadLetter: deadLetter, Replayed: true}, http.StatusOK, nil
+}
+
+func (s *service) healthHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	state := s.ingest.State()
+
+	return &HealthResponse{
+		Ok: true,
+		Ingest: &IngestHealth{
+			Paused:          state.Global,
+			PausedCustomers: len(state.Customers),
+			PausedTypes:     state.Types,
+		},
+	}, http.StatusOK, nil
+}
+
+func (s *service) ingestHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	return s.ingest.State(), http.StatusOK, nil
+}
+
+// pauseIngestHandler refuses to pause a type no message has, which would
+// pause nothing. Resuming one is allowed, to clear it out.
+func (s *service) pauseIngestHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	pause := request.(*store.IngestPause)
+
+	if pause.Scope == store.TypeIngestScope && !contains(store.EntityTypes, pause.Value) {
+		return MessageResponse{fmt.Sprint("Bad request: ", errUnknownEntityType)}, http.StatusBadRequest, nil
+	}
+
+	if err := s.ingest.Pause(pause); err != nil {
+		return nil, 0, err
+	}
+
+	log.WithFields(log.Fields{"scope": pause.Scope, "value": pause.Value, "reason": pause.Reason}).Warn("paused ingestion")
+
+	return s.ingest.State(), http.StatusOK, nil
+}
+
+func (s *service) resumeIngestHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	pause := request.(*store.IngestPause)
+
+	err := s.ingest.Resume(pause)
+	switch err {
+	case nil:
+	case ingest.ErrNotPaused:
+		return MessageResponse{"Not paused."}, http.StatusNotFound, nil
+	case ingest.ErrPausedByConfig:
+		return MessageResponse{fmt.Sprint("Conflict: ", err)}, http.StatusConflict, nil
+	default:
+		return nil, 0, err
+	}
+
+	log.WithFields(log.Fields{"scope": pause.Scope, "value": pause.Value}).Warn("resumed ingestion")
+
+	return s.ingest.State(), http.StatusOK, nil
+}
+
+func (s *service) baselinesHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.ListBaselines(request.(*store.BaselinesRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) baselineHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.GetBaseline(request.(*store.BaselineRequest))
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No baseline exists."}, http.StatusNotFound, nil
+	}
+
+	if err == store.ErrAmbiguousEntity {
+		return MessageResponse{fmt.Sprint("Bad request: ", err)}, http.StatusBadRequest, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) putBaselineHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.PutBaseline(request.(*store.PutBaselineRequest))
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No entity exists to snapshot."}, http.StatusNotFound, nil
+	}
+
+	if err == store.ErrMalformedBaseline || err == store.ErrAmbiguousEntity {
+		return MessageResponse{fmt.Sprint("Bad request: ", err)}, http.StatusBadRequest, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) deleteBaselineHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	err := s.DeleteBaseline(request.(*store.BaselineRequest))
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No baseline exists."}, http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return MessageResponse{"Baseline deleted."}, http.StatusOK, nil
+}
+
+func (s *service) webhooksHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.ListWebhooks(request.(*store.WebhooksRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, webhook := range response.Webhooks {
+		webhook.Secret = ""
+	}
+
+	return response, http.StatusOK, nil
+}
+
+// putWebhookHandler registers a webhook, generating its secret if none was
+// given. It's the only response that includes the secret. The webhook
+// starts at the customer's latest event, so it only hears of changes made
+// after it was registered.
+func (s *service) putWebhookHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	webhook := request.(*store.Webhook)
+
+	if err := s.webhooks.CheckUrl(webhook.Url); err != nil {
+		return MessageResponse{fmt.Sprint("Bad request: ", errPrivateWebhookUrl)}, http.StatusBadRequest, nil
+	}
+
+	if webhook.Secret == "" {
+		secret, err := webhooks.NewSecret()
+		if err != nil {
+			return nil, 0, err
+		}
+		webhook.Secret = secret
+	}
+
+	lastEventId, err := s.LastInventoryEventId(&store.CustomerRequest{Id: webhook.CustomerId})
+	if err != nil {
+		return nil, 0, err
+	}
+	webhook.LastEventId = lastEventId
+
+	if err = s.PutWebhook(webhook); err != nil {
+		return nil, 0, err
+	}
+
+	log.WithFields(log.Fields{"customer-id": webhook.CustomerId, "webhook-id": webhook.Id, "url": webhook.Url}).Info("registered webhook")
+
+	return &store.WebhookResponse{Webhook: webhook}, http.StatusCreated, nil
+}
+
+func (s *service) webhookHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.GetWebhook(request.(*store.WebhookRequest))
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No webhook exists."}, http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response.Webhook.Secret = ""
+	return response, http.StatusOK, nil
+}
+
+func (s *service) deleteWebhookHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	webhookRequest := request.(*store.WebhookRequest)
+
+	err := s.DeleteWebhook(webhookRequest)
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No webhook exists."}, http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	log.WithFields(log.Fields{"customer-id": webhookRequest.CustomerId, "webhook-id": webhookRequest.Id}).Info("deleted webhook")
+
+	return MessageResponse{"Webhook deleted."}, http.StatusOK, nil
+}
+
+func (s *service) webhookDeliveriesHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	deliveriesRequest := request.(*store.WebhookDeliveriesRequest)
+
+	_, err := s.GetWebhook(&store.WebhookRequest{CustomerId: deliveriesRequest.CustomerId, Id: deliveriesRequest.WebhookId})
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No webhook exists."}, http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response, err := s.ListWebhookDeliveries(deliveriesRequest)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+// enableWebhookHandler re-enables a webhook disabled after too many
+// failures. Delivery resumes from the event it failed on.
+func (s *service) enableWebhookHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.EnableWebhook(request.(*store.WebhookRequest))
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No webhook exists."}, http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response.Webhook.Secret = ""
+	return response, http.StatusOK, nil
+}
+
+// pingWebhookHandler sends a webhook a ping event and returns the delivery,
+// so a customer can check their endpoint and signature verification. The
+// ping doesn't count towards the webhook's failures.
+func (s *service) pingWebhookHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.GetWebhook(request.(*store.WebhookRequest))
+	if err == sql.ErrNoRows {
+		return MessageResponse{"No webhook exists."}, http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &PingResponse{Delivery: s.webhooks.Ping(response.Webhook)}, http.StatusOK, nil
+}
+
+// eventsHandler streams the customer's inventory events as server-sent
+// events, until the client goes away or the server shuts down. Each event's
+// id is its inventory event id, its name the action and its data the event
+// as json. The events are read from postgres whenever the broker is notified
+// of new ones, so a stream sees changes written through any replica.
+func (s *service) eventsHandler(rw http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, status, err := s.authorize(r, customerAccess)
+	if err != nil {
+		s.renderAuthError(rw, r, status, err)
+		return
+	}
+
+	request, err := decodeEventsRequest(r, id)
+	if err != nil {
+		s.renderBadRequest(rw, r, err)
+		return
+	}
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		s.renderServerError(rw, r, errStreamingUnsupported)
+		return
+	}
+
+	// subscribe before looking for events, so none committed in between are
+	// missed
+	sub := s.events.Subscribe(id.CustomerId)
+	defer s.events.Unsubscribe(sub)
+
+	if request.After < 0 {
+		if request.After, err = s.LastInventoryEventId(&store.CustomerRequest{Id: id.CustomerId}); err != nil {
+			s.renderServerError(rw, r, err)
+			return
+		}
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	logger := log.WithFields(log.Fields{"customer-id": id.CustomerId, "admin": id.Admin, "after": request.After, "types": request.EntityTypes})
+	logger.Info("event stream opened")
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	sent := 0
+	defer func() {
+		logger.WithField("sent", sent).Info("event stream closed")
+	}()
+
+	for {
+		response, err := s.ListInventoryEvents(request)
+		if err != nil {
+			// the client reconnects with the last id it saw
+			logger.WithError(err).Error("error listing inventory events")
+			return
+		}
+
+		for _, event := range response.Events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				logger.WithError(err).Error("error encoding inventory event")
+				return
+			}
+
+			if _, err = fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Action, data); err != nil {
+				return
+			}
+
+			request.After = event.Id
+			eventsSent.Inc(event.EntityType)
+			sent++
+		}
+		flusher.Flush()
+
+		if len(response.Events) == request.Limit {
+			continue
+		}
+
+		select {
+		case <-sub.C:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(rw, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-sub.Done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *service) makePanicHandler() panicFunc {
+	return func(rw http.ResponseWriter, r *http.Request, data interface{}) {
+		yeller.NotifyPanic(data)
+		s.renderServerError(rw, r, fmt.Errorf("panic data: %#v", data))
+	}
+}
+
+func (s *service) renderServerError(rw http.ResponseWriter, r *http.Request, err error) {
+	log.WithError(err).WithField("request", *r).Error("internal server error")
+	msg, _ := encodeResponse(MessageResponse{"An unexpected error happened."})
+	rw.WriteHeader(http.StatusInternalServerError)
+	rw.Write(msg)
+}
+
+func (s *service) renderBadRequest(rw http.ResponseWriter, r *http.Request, err error) {
 	log.WithError(err).WithField("request", *r).Error("bad request")
 	msg, _ := encodeResponse(MessageResponse{fmt.Sprint("Bad request: ", err)})
 	rw.WriteHeader(http.StatusBadRequest)
 	rw.Write(msg)
 }
 
+func (s *service) renderAuthError(rw http.ResponseWriter, r *http.Request, status int, err error) {
+	log.WithError(err).WithFields(log.Fields{"status": status, "path": r.URL.RequestURI(), "method": r.Method}).Warn("request not authorized")
+	msg, _ := encodeResponse(MessageResponse{fmt.Sprint(http.StatusText(status), ": ", err)})
+	if status == http.StatusUnauthorized {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="fieri"`)
+	}
+	rw.WriteHeader(status)
+	rw.Write(msg)
+}
+
+// renderStream writes a streamed response. Once the status is written a
+// failure can only be logged, and the client sees a truncated body.
+func (s *service) renderStream(rw http.ResponseWriter, r *http.Request, status int, stream *streamResponse) {
+	rw.Header().Set("Content-Type", stream.contentType)
+	if stream.filename != "" {
+		rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", stream.filename))
+	}
+
+	rw.WriteHeader(status)
+	if err := stream.write(rw); err != nil {
+		log.WithError(err).WithFields(log.Fields{"path": r.URL.RequestURI(), "method": r.Method}).Error("streaming response failed")
+	}
+}
+
 func encodeResponse(response interface{}) ([]byte, error) {
 	return json.Marshal(response)
 }
@@ -1,8 +1,20 @@
 package service
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"github.com/opsee/fieri/costs"
+	"github.com/opsee/fieri/events"
+	"github.com/opsee/fieri/ingest"
+	"github.com/opsee/fieri/monitor"
 	"github.com/opsee/fieri/store"
+	"github.com/opsee/fieri/webhooks"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,12 +24,66 @@ type Service interface {
 
 type service struct {
 	store.Store
+	auth      Authenticator
+	ingest    *ingest.Switch
+	events    *events.Broker
+	webhooks  *webhooks.Dispatcher
+	costs     *costs.Estimator
+	monitor   *monitor.Monitor
+	server    *http.Server
+	serverMut *sync.Mutex
+	inFlight  int64
 }
 
 type MessageResponse struct {
 	Message string `json:"message"`
 }
 
+// streamResponse is returned by handlers whose body is written directly
+// rather than encoded as json.
+type streamResponse struct {
+	contentType string
+	filename    string
+	write       func(io.Writer) error
+}
+
+// orphansRequest is what the orphans report covers, a customer's inventory
+// in region and account when they're set, how many days an instance must
+// have been stopped for to be reported, and whether to report those whose
+// stop time isn't known.
+type orphansRequest struct {
+	customerId              string
+	region                  string
+	accountId               string
+	stoppedDays             int
+	includeUnknownStopTimes bool
+}
+
+// ReplayResponse is the dead letter after a replay. Replayed is false, and
+// the dead letter's error updated, if storing it failed again.
+type ReplayResponse struct {
+	DeadLetter *store.DeadLetter `json:"dead_letter"`
+	Replayed   bool              `json:"replayed"`
+}
+
+// PingResponse is the delivery of a webhook's ping.
+type PingResponse struct {
+	Delivery *store.WebhookDelivery `json:"delivery"`
+}
+
+type HealthResponse struct {
+	Ok     bool          `json:"ok"`
+	Ingest *IngestHealth `json:"ingest"`
+}
+
+// IngestHealth says what ingestion is paused. Paused customers are only
+// counted, since /health is public.
+type IngestHealth struct {
+	Paused          bool     `json:"paused"`
+	PausedCustomers int      `json:"paused_customers"`
+	PausedTypes     []string `json:"paused_types"`
+}
+
 type requestForwarder struct {
 	response interface{}
 	status   int
@@ -26,19 +92,84 @@ type requestForwarder struct {
 
 const (
 	forwardTimeout = 5 * time.Second
+	// archiveTimeout bounds restoring a customer archive.
+	archiveTimeout = 5 * time.Minute
+	// eventsHeartbeat is how often an idle /events stream sends a comment, so
+	// proxies don't close it.
+	eventsHeartbeat = 15 * time.Second
+	eventsPageSize  = 500
+	// pingTimeout bounds pinging a webhook, which waits for its response.
+	pingTimeout = time.Minute
+	// reportTimeout bounds the reports, which read all of a customer's
+	// inventory.
+	reportTimeout = 30 * time.Second
 )
 
 var (
-	errMissingCustomerId    = errors.New("missing customer id header (Customer-Id).")
-	errMalformedRequestBody = errors.New("malformed request body.")
-	errMissingAccessKey     = errors.New("missing access_key.")
-	errMissingSecretKey     = errors.New("missing secret_key.")
-	errMissingRegion        = errors.New("missing region.")
-	errMissingEmail         = errors.New("missing email.")
-	errMissingRequestId     = errors.New("missing request_id.")
-	errMissingUserId        = errors.New("missing user_id.")
+	errMissingCustomerId     = errors.New("missing customer id header (Customer-Id).")
+	errMalformedChangedSince = errors.New("changed_since must be an RFC 3339 time, e.g. 2016-01-02T15:04:05Z.")
+	errMalformedDeadLetterId = errors.New("dead letter id must be a number.")
+	errMalformedLastEventId  = errors.New("Last-Event-ID must be a number.")
+	errStreamingUnsupported  = errors.New("streaming unsupported.")
+	errUnknownEventType      = fmt.Errorf("type must be one of %s.", strings.Join(store.InventoryEventTypes, ", "))
+	errMalformedBaseline     = errors.New("body must be {\"expected\": {...}}, optionally with \"exact\": true, or {\"snapshot\": true}.")
+	errUnknownStoreType      = fmt.Errorf("type must be one of %s.", strings.Join(store.StoreTypes, ", "))
+	errUnknownView           = fmt.Errorf("view must be one of %s.", strings.Join(store.Views, ", "))
+	errUnknownEntityType     = fmt.Errorf("type must be one of %s.", strings.Join(store.EntityTypes, ", "))
+	errUnsupportedReferences = errors.New("only security groups have references.")
+	errMalformedWebhookId    = errors.New("webhook id must be a number.")
+	errMalformedWebhookUrl   = errors.New("url must be an absolute http or https url.")
+	errPrivateWebhookUrl     = errors.New("url must not be a private, loopback or link-local address.")
+	errUnknownWebhookAction  = fmt.Errorf("actions must be among %s.", strings.Join(store.InventoryEventActions, ", "))
+	errUnknownWebhookType    = fmt.Errorf("entity_types must be among %s.", strings.Join(store.InventoryEventTypes, ", "))
+	errMalformedLimit        = errors.New("limit must be a number.")
+	errMalformedStoppedDays  = errors.New("stopped_days must be a number of days.")
+	errMalformedUnknownStops = errors.New("include_unknown_stop_times must be true or false.")
+	errMissingLookup         = errors.New("must look up one of ip or dns.")
+	errMalformedIp           = errors.New("ip must be an IPv4 or IPv6 address.")
+	errMalformedRequestBody  = errors.New("malformed request body.")
+	errMissingAccessKey      = errors.New("missing access_key.")
+	errMissingSecretKey      = errors.New("missing secret_key.")
+	errMissingRegion         = errors.New("missing region.")
+	errMissingEmail          = errors.New("missing email.")
+	errMissingRequestId      = errors.New("missing request_id.")
+	errMissingUserId         = errors.New("missing user_id.")
 )
 
-func NewService(store store.Store) *service {
-	return &service{store}
+// NewService returns a service backed by store, whose routes verify callers
+// with auth, report and control ingestion through sw and stream inventory
+// events from broker. Webhooks are pinged through dispatcher, and costs
+// estimated with estimator.
+func NewService(store store.Store, auth Authenticator, sw *ingest.Switch, broker *events.Broker, dispatcher *webhooks.Dispatcher, estimator *costs.Estimator, staleMonitor *monitor.Monitor) *service {
+	return &service{
+		Store:     store,
+		auth:      auth,
+		ingest:    sw,
+		events:    broker,
+		webhooks:  dispatcher,
+		costs:     estimator,
+		monitor:   staleMonitor,
+		serverMut: &sync.Mutex{},
+	}
+}
+
+// StopHTTP stops accepting connections and waits up to timeout for in-flight
+// requests to finish.
+func (s *service) StopHTTP(timeout time.Duration) error {
+	s.serverMut.Lock()
+	server := s.server
+	s.serverMut.Unlock()
+
+	if server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("%s, abandoned %d in-flight requests", err, atomic.LoadInt64(&s.inFlight))
+	}
+
+	return nil
 }
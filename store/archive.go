@@ -0,0 +1,147 @@
+package store
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// ArchiveVersion is bumped whenever the archive records change shape.
+	ArchiveVersion = 1
+
+	ArchiveHeaderKind     = "header"
+	ArchiveCustomerKind   = "customer"
+	ArchiveGroupKind      = "group"
+	ArchiveInstanceKind   = "instance"
+	ArchiveMembershipKind = "membership"
+	ArchiveSubnetKind     = "subnet"
+	ArchiveRouteTableKind = "route_table"
+)
+
+var (
+	ErrMissingArchiveHeader = errors.New("archive doesn't start with a header")
+	ErrMalformedArchive     = errors.New("malformed archive record")
+)
+
+// ArchiveError is returned for archives that can't be read, as opposed to
+// failures writing them to the database.
+type ArchiveError struct {
+	Err error
+}
+
+func (e *ArchiveError) Error() string {
+	return "archive: " + e.Err.Error()
+}
+
+// ArchiveRecord is one line of a customer archive. Kind says which of the
+// other fields is set.
+type ArchiveRecord struct {
+	Kind       string             `json:"kind"`
+	Header     *ArchiveHeader     `json:"header,omitempty"`
+	Customer   *ArchiveCustomer   `json:"customer,omitempty"`
+	Entity     *ArchiveEntity     `json:"entity,omitempty"`
+	Membership *ArchiveMembership `json:"membership,omitempty"`
+}
+
+type ArchiveHeader struct {
+	Version    int       `json:"version"`
+	CustomerId string    `json:"customer_id"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+type ArchiveCustomer struct {
+	LastSync  time.Time `json:"last_sync" db:"last_sync"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// ArchiveEntity is a row of instances, groups, subnets or route_tables. Id
+// holds a group's name, and Type is empty for subnets and route tables.
+type ArchiveEntity struct {
+	Id        string          `json:"id" db:"id"`
+	Region    string          `json:"region" db:"region"`
+	AccountId string          `json:"account_id" db:"account_id"`
+	Type      string          `json:"type,omitempty" db:"type"`
+	Data      json.RawMessage `json:"data" db:"data"`
+}
+
+type ArchiveMembership struct {
+	Region     string `json:"region" db:"region"`
+	AccountId  string `json:"account_id" db:"account_id"`
+	GroupName  string `json:"group_name" db:"group_name"`
+	InstanceId string `json:"instance_id" db:"instance_id"`
+}
+
+// ArchiveWriter writes a gzipped, newline delimited stream of archive
+// records.
+type ArchiveWriter struct {
+	gz  *gzip.Writer
+	enc *json.Encoder
+}
+
+func NewArchiveWriter(w io.Writer) *ArchiveWriter {
+	gz := gzip.NewWriter(w)
+	return &ArchiveWriter{gz: gz, enc: json.NewEncoder(gz)}
+}
+
+func (a *ArchiveWriter) Write(record *ArchiveRecord) error {
+	return a.enc.Encode(record)
+}
+
+// Close flushes the archive, it doesn't close the underlying writer.
+func (a *ArchiveWriter) Close() error {
+	return a.gz.Close()
+}
+
+// ArchiveReader reads the records written by an ArchiveWriter.
+type ArchiveReader struct {
+	header *ArchiveHeader
+	dec    *json.Decoder
+}
+
+// NewArchiveReader reads the archive's header, returning an error unless it
+// is a version this build of fieri can restore.
+func NewArchiveReader(r io.Reader) (*ArchiveReader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, &ArchiveError{err}
+	}
+
+	a := &ArchiveReader{dec: json.NewDecoder(gz)}
+
+	record, err := a.Next()
+	if err == io.EOF || (err == nil && (record.Kind != ArchiveHeaderKind || record.Header == nil)) {
+		return nil, &ArchiveError{ErrMissingArchiveHeader}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if record.Header.Version < 1 || record.Header.Version > ArchiveVersion {
+		return nil, &ArchiveError{fmt.Errorf("unsupported version %d, expected at most %d", record.Header.Version, ArchiveVersion)}
+	}
+
+	a.header = record.Header
+
+	return a, nil
+}
+
+func (a *ArchiveReader) Header() *ArchiveHeader {
+	return a.header
+}
+
+// Next returns the next record, or io.EOF at the end of the archive.
+func (a *ArchiveReader) Next() (*ArchiveRecord, error) {
+	record := &ArchiveRecord{}
+	if err := a.dec.Decode(record); err == io.EOF {
+		return nil, err
+	} else if err != nil {
+		return nil, &ArchiveError{err}
+	}
+
+	return record, nil
+}
@@ -0,0 +1,292 @@
+package store
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Kinds of difference between a baseline and its entity.
+const (
+	ChangedDifference    = "changed"
+	MissingDifference    = "missing"
+	UnexpectedDifference = "unexpected"
+)
+
+var ErrMalformedBaseline = errors.New("baseline must be a json object")
+
+// BaselineRequest names a baselined entity by its store type (ec2, rds,
+// security, elb, autoscaling, rds-security, route_table or subnet) and id.
+// Region and account may be left empty when the id is unambiguous.
+type BaselineRequest struct {
+	CustomerId string `json:"customer_id"`
+	EntityType string `json:"entity_type"`
+	EntityId   string `json:"entity_id"`
+	Region     string `json:"region"`
+	AccountId  string `json:"account_id"`
+}
+
+// PutBaselineRequest pins an entity's expected state. Expected is a subset
+// of the entity's data. With Snapshot, the entity's current data is the
+// baseline instead, and later data must match it exactly.
+type PutBaselineRequest struct {
+	BaselineRequest
+	Expected json.RawMessage `json:"expected"`
+	Exact    bool            `json:"exact"`
+	Snapshot bool            `json:"snapshot"`
+}
+
+// BaselinesRequest lists a customer's baselines, optionally only those of
+// an entity type or only those that have drifted.
+type BaselinesRequest struct {
+	CustomerId string `json:"customer_id"`
+	EntityType string `json:"entity_type"`
+	Drifted    bool   `json:"drifted"`
+}
+
+type BaselineResponse struct {
+	Baseline *Baseline `json:"baseline"`
+}
+
+type BaselinesResponse struct {
+	Baselines []*Baseline `json:"baselines"`
+}
+
+// Baseline is the expected state of an entity. Drifted and Differences are
+// re-evaluated whenever the entity's data changes, and when the baseline is
+// put. EvaluatedAt is nil until the entity has been seen, and only moves
+// when the result changes.
+type Baseline struct {
+	CustomerId  string          `json:"customer_id" db:"customer_id"`
+	EntityType  string          `json:"entity_type" db:"entity_type"`
+	EntityId    string          `json:"entity_id" db:"entity_id"`
+	Region      string          `json:"region"`
+	AccountId   string          `json:"account_id" db:"account_id"`
+	Expected    json.RawMessage `json:"expected"`
+	Exact       bool            `json:"exact"`
+	Drifted     bool            `json:"drifted"`
+	Differences Differences     `json:"differences"`
+	EvaluatedAt *time.Time      `json:"evaluated_at" db:"evaluated_at"`
+	CreatedAt   time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+// Applies reports whether the baseline is for an entity written in region
+// and account.
+func (b *Baseline) Applies(region, accountId string) bool {
+	return (b.Region == "" || b.Region == region) && (b.AccountId == "" || b.AccountId == accountId)
+}
+
+// Evaluate compares the baseline to an entity's data.
+func (b *Baseline) Evaluate(data []byte) error {
+	differences, err := Diff(b.Expected, data, b.Exact)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	b.Differences = differences
+	b.Drifted = len(differences) > 0
+	b.EvaluatedAt = &now
+
+	return nil
+}
+
+// Difference is a field whose value isn't what its baseline expects. Path
+// is dotted, e.g. State.Name, and arrays are reported whole. A missing field
+// has no actual value, and an unexpected one, only reported for exact
+// baselines, has no expected value.
+type Difference struct {
+	Path     string      `json:"path"`
+	Change   string      `json:"change"`
+	Expected interface{} `json:"expected,omitempty"`
+	Actual   interface{} `json:"actual,omitempty"`
+}
+
+// Differences are stored as a jsonb array.
+type Differences []*Difference
+
+func (d Differences) Value() (driver.Value, error) {
+	if d == nil {
+		d = Differences{}
+	}
+
+	return json.Marshal(d)
+}
+
+// Equal is whether d and other store the same differences.
+func (d Differences) Equal(other Differences) bool {
+	a, err := d.Value()
+	if err != nil {
+		return false
+	}
+
+	b, err := other.Value()
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(a.([]byte), b.([]byte))
+}
+
+func (d *Differences) Scan(src interface{}) error {
+	var b []byte
+
+	switch s := src.(type) {
+	case []byte:
+		b = s
+	case string:
+		b = []byte(s)
+	case nil:
+		*d = Differences{}
+		return nil
+	default:
+		return fmt.Errorf("can't scan %T into Differences", src)
+	}
+
+	return json.Unmarshal(b, d)
+}
+
+// Diff compares an entity's data to what a baseline expects. Objects in the
+// baseline are subsets: fields it doesn't mention may hold anything, unless
+// exact is set. Arrays must hold as many elements as expected, each
+// matching a different expected element in any order, since AWS doesn't
+// promise an order. Anything else must be equal.
+func Diff(expected, actual []byte, exact bool) (Differences, error) {
+	var e, a interface{}
+
+	if err := json.Unmarshal(expected, &e); err != nil {
+		return nil, ErrMalformedBaseline
+	}
+
+	if _, ok := e.(map[string]interface{}); !ok {
+		return nil, ErrMalformedBaseline
+	}
+
+	if err := json.Unmarshal(actual, &a); err != nil {
+		return nil, err
+	}
+
+	differences := make(Differences, 0)
+	diffValues("", e, a, exact, &differences)
+
+	return differences, nil
+}
+
+func diffValues(path string, expected, actual interface{}, exact bool, differences *Differences) {
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			*differences = append(*differences, &Difference{Path: rootPath(path), Change: ChangedDifference, Expected: expected, Actual: actual})
+			return
+		}
+
+		for _, key := range sortedKeys(e) {
+			value, ok := a[key]
+			if !ok {
+				*differences = append(*differences, &Difference{Path: joinPath(path, key), Change: MissingDifference, Expected: e[key]})
+				continue
+			}
+
+			diffValues(joinPath(path, key), e[key], value, exact, differences)
+		}
+
+		if exact {
+			for _, key := range sortedKeys(a) {
+				if _, ok := e[key]; !ok {
+					*differences = append(*differences, &Difference{Path: joinPath(path, key), Change: UnexpectedDifference, Actual: a[key]})
+				}
+			}
+		}
+
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok || !matchElements(e, a, exact) {
+			*differences = append(*differences, &Difference{Path: rootPath(path), Change: ChangedDifference, Expected: expected, Actual: actual})
+		}
+
+	default:
+		if !reflect.DeepEqual(expected, actual) {
+			*differences = append(*differences, &Difference{Path: rootPath(path), Change: ChangedDifference, Expected: expected, Actual: actual})
+		}
+	}
+}
+
+// matchElements reports whether each expected element can be paired with a
+// different actual element it matches, and there are no more actual
+// elements than expected.
+func matchElements(expected, actual []interface{}, exact bool) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+
+	// pairs[j] is the expected element actual element j is paired with
+	pairs := make([]int, len(actual))
+	for j := range pairs {
+		pairs[j] = -1
+	}
+
+	var pair func(i int, tried []bool) bool
+	pair = func(i int, tried []bool) bool {
+		for j := range actual {
+			if tried[j] || !matches(expected[i], actual[j], exact) {
+				continue
+			}
+			tried[j] = true
+
+			if pairs[j] < 0 || pair(pairs[j], tried) {
+				pairs[j] = i
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for i := range expected {
+		if !pair(i, make([]bool, len(actual))) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matches(expected, actual interface{}, exact bool) bool {
+	differences := make(Differences, 0)
+	diffValues("", expected, actual, exact, &differences)
+
+	return len(differences) == 0
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+func rootPath(path string) string {
+	if path == "" {
+		return "."
+	}
+
+	return path
+}
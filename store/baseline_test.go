@@ -0,0 +1,150 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		actual   string
+		exact    bool
+		// path and change of each difference, in order
+		differences []string
+	}{
+		{
+			name:     "equal",
+			expected: `{"InstanceType": "t2.micro"}`,
+			actual:   `{"InstanceType": "t2.micro"}`,
+		},
+		{
+			name:     "unmentioned fields",
+			expected: `{"InstanceType": "t2.micro"}`,
+			actual:   `{"InstanceType": "t2.micro", "ImageId": "ami-1"}`,
+		},
+		{
+			name:        "changed field",
+			expected:    `{"InstanceType": "t2.micro"}`,
+			actual:      `{"InstanceType": "m4.large"}`,
+			differences: []string{"InstanceType changed"},
+		},
+		{
+			name:        "missing field",
+			expected:    `{"InstanceType": "t2.micro", "ImageId": "ami-1"}`,
+			actual:      `{"InstanceType": "t2.micro"}`,
+			differences: []string{"ImageId missing"},
+		},
+		{
+			name:        "nested field",
+			expected:    `{"State": {"Name": "running"}}`,
+			actual:      `{"State": {"Name": "stopped", "Code": 80}}`,
+			differences: []string{"State.Name changed"},
+		},
+		{
+			name:        "object replaced",
+			expected:    `{"State": {"Name": "running"}}`,
+			actual:      `{"State": "running"}`,
+			differences: []string{"State changed"},
+		},
+		{
+			name:     "array in another order",
+			expected: `{"SecurityGroups": [{"GroupId": "sg-1"}, {"GroupId": "sg-2"}]}`,
+			actual:   `{"SecurityGroups": [{"GroupId": "sg-2", "GroupName": "b"}, {"GroupId": "sg-1", "GroupName": "a"}]}`,
+		},
+		{
+			name:        "array element changed",
+			expected:    `{"SecurityGroups": [{"GroupId": "sg-1"}, {"GroupId": "sg-2"}]}`,
+			actual:      `{"SecurityGroups": [{"GroupId": "sg-1"}, {"GroupId": "sg-3"}]}`,
+			differences: []string{"SecurityGroups changed"},
+		},
+		{
+			name:        "array element added",
+			expected:    `{"SecurityGroups": [{"GroupId": "sg-1"}]}`,
+			actual:      `{"SecurityGroups": [{"GroupId": "sg-1"}, {"GroupId": "sg-2"}]}`,
+			differences: []string{"SecurityGroups changed"},
+		},
+		{
+			// each expected element needs its own actual element
+			name:        "array element matched twice",
+			expected:    `{"SecurityGroups": [{"GroupId": "sg-1"}, {"GroupId": "sg-1"}]}`,
+			actual:      `{"SecurityGroups": [{"GroupId": "sg-1"}, {"GroupId": "sg-2"}]}`,
+			differences: []string{"SecurityGroups changed"},
+		},
+		{
+			// the first expected element matches both actual ones, so it
+			// has to give up the first for the second to be matched
+			name:     "array elements re-paired",
+			expected: `{"Tags": [{"Key": "Name"}, {"Key": "Name", "Value": "web"}]}`,
+			actual:   `{"Tags": [{"Key": "Name", "Value": "web"}, {"Key": "Name", "Value": "db"}]}`,
+		},
+		{
+			name:     "exact equal",
+			expected: `{"InstanceType": "t2.micro"}`,
+			actual:   `{"InstanceType": "t2.micro"}`,
+			exact:    true,
+		},
+		{
+			name:        "exact unexpected fields",
+			expected:    `{"State": {"Name": "running"}}`,
+			actual:      `{"State": {"Name": "running", "Code": 16}, "ImageId": "ami-1"}`,
+			exact:       true,
+			differences: []string{"State.Code unexpected", "ImageId unexpected"},
+		},
+		{
+			name:        "exact array elements",
+			expected:    `{"SecurityGroups": [{"GroupId": "sg-1"}]}`,
+			actual:      `{"SecurityGroups": [{"GroupId": "sg-1", "GroupName": "a"}]}`,
+			exact:       true,
+			differences: []string{"SecurityGroups changed"},
+		},
+	}
+
+	for _, test := range tests {
+		differences, err := Diff([]byte(test.expected), []byte(test.actual), test.exact)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		got := make([]string, 0, len(differences))
+		for _, d := range differences {
+			got = append(got, d.Path+" "+d.Change)
+		}
+
+		want := test.differences
+		if want == nil {
+			want = []string{}
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got differences %q, want %q", test.name, got, want)
+		}
+	}
+}
+
+func TestDiffMalformed(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		actual   string
+		baseline bool
+	}{
+		{"baseline not json", `{`, `{}`, true},
+		{"baseline not an object", `["sg-1"]`, `{}`, true},
+		{"data not json", `{}`, `{`, false},
+	}
+
+	for _, test := range tests {
+		_, err := Diff([]byte(test.expected), []byte(test.actual), false)
+		if err == nil {
+			t.Errorf("%s: got no error", test.name)
+			continue
+		}
+
+		if (err == ErrMalformedBaseline) != test.baseline {
+			t.Errorf("%s: got error %q", test.name, err)
+		}
+	}
+}
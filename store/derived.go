@@ -0,0 +1,173 @@
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	opsee_aws_autoscaling "github.com/opsee/basic/schema/aws/autoscaling"
+	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
+	"unicode/utf8"
+)
+
+// Attributes instances are grouped by.
+const (
+	AvailabilityZoneAttribute    = "availability-zone"
+	SubnetAttribute              = "subnet"
+	VpcAttribute                 = "vpc"
+	InstanceTypeAttribute        = "instance-type"
+	KeyPairAttribute             = "key-pair"
+	InstanceProfileAttribute     = "instance-profile"
+	ImageAttribute               = "ami"
+	LaunchConfigurationAttribute = "launch-configuration"
+)
+
+// maxGroupNameLength is the longest group name the schema holds.
+const maxGroupNameLength = 128
+
+// DerivedGroup is the data of a tag group, with the tag's key, or of an
+// attribute group, with the attribute.
+type DerivedGroup struct {
+	Key       string `json:"Key,omitempty"`
+	Attribute string `json:"Attribute,omitempty"`
+	Value     string `json:"Value"`
+}
+
+// DeriveGroups returns the tag and attribute groups an EC2 instance belongs
+// to, from its data and that of the autoscaling groups it's a member of.
+// Tag groups are named tag:<key>=<value>, and attribute groups
+// <attribute>:<value>, e.g. vpc:vpc-31a0d654.
+func DeriveGroups(instance *Instance, autoscalingGroups []*Group) ([]*Group, error) {
+	groups := make([]*Group, 0)
+	seen := make(map[string]bool)
+
+	add := func(groupType, name string, derived *DerivedGroup) error {
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+
+		data, err := json.Marshal(derived)
+		if err != nil {
+			return err
+		}
+
+		groups = append(groups, &Group{
+			Name:       name,
+			CustomerId: instance.CustomerId,
+			Region:     instance.Region,
+			AccountId:  instance.AccountId,
+			Type:       groupType,
+			Data:       data,
+			Instances:  []*Instance{instance},
+		})
+
+		return nil
+	}
+
+	addTag := func(key, value *string) error {
+		derived := &DerivedGroup{Key: aws.StringValue(key), Value: aws.StringValue(value)}
+		if derived.Key == "" {
+			return nil
+		}
+
+		return add(TagStoreType, derivedGroupName(TagStoreType, derived.Key+"="+derived.Value), derived)
+	}
+
+	addAttribute := func(attribute string, value *string) error {
+		derived := &DerivedGroup{Attribute: attribute, Value: aws.StringValue(value)}
+		if derived.Value == "" {
+			return nil
+		}
+
+		return add(AttributeStoreType, derivedGroupName(attribute, derived.Value), derived)
+	}
+
+	ec2Instance := &opsee_aws_ec2.Instance{}
+	if err := json.Unmarshal(instance.Data, ec2Instance); err != nil {
+		return nil, err
+	}
+
+	for _, tag := range ec2Instance.Tags {
+		if err := addTag(tag.Key, tag.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	if ec2Instance.Placement != nil {
+		if err := addAttribute(AvailabilityZoneAttribute, ec2Instance.Placement.AvailabilityZone); err != nil {
+			return nil, err
+		}
+	}
+
+	if ec2Instance.IamInstanceProfile != nil {
+		if err := addAttribute(InstanceProfileAttribute, ec2Instance.IamInstanceProfile.Arn); err != nil {
+			return nil, err
+		}
+	}
+
+	attributes := []struct {
+		attribute string
+		value     *string
+	}{
+		{SubnetAttribute, ec2Instance.SubnetId},
+		{VpcAttribute, ec2Instance.VpcId},
+		{InstanceTypeAttribute, ec2Instance.InstanceType},
+		{KeyPairAttribute, ec2Instance.KeyName},
+		{ImageAttribute, ec2Instance.ImageId},
+	}
+
+	for _, a := range attributes {
+		if err := addAttribute(a.attribute, a.value); err != nil {
+			return nil, err
+		}
+	}
+
+	// an autoscaling group's tags apply to all of its instances, whether
+	// they're propagated at launch or not, and its launch configuration is
+	// the one each instance was launched with
+	for _, group := range autoscalingGroups {
+		autoscalingGroup := &opsee_aws_autoscaling.Group{}
+		if err := json.Unmarshal(group.Data, autoscalingGroup); err != nil {
+			return nil, err
+		}
+
+		for _, tag := range autoscalingGroup.Tags {
+			if err := addTag(tag.Key, tag.Value); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, member := range autoscalingGroup.Instances {
+			if aws.StringValue(member.InstanceId) != instance.Id {
+				continue
+			}
+
+			if err := addAttribute(LaunchConfigurationAttribute, member.LaunchConfigurationName); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return groups, nil
+}
+
+// derivedGroupName names a derived group prefix:value. Names too long for
+// the schema are cut short and end in a hash of the whole name, so they stay
+// distinct; the group's data still has the whole value.
+func derivedGroupName(prefix, value string) string {
+	name := prefix + ":" + value
+	if len(name) <= maxGroupNameLength {
+		return name
+	}
+
+	sum := sha1.Sum([]byte(name))
+	suffix := "~" + hex.EncodeToString(sum[:])[:8]
+
+	cut := maxGroupNameLength - len(suffix)
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+
+	return name[:cut] + suffix
+}
@@ -0,0 +1,154 @@
+package store
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestDeriveGroups(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		autoscaled []string
+		// type and name of each derived group, in order
+		groups []string
+	}{
+		{
+			name: "tags",
+			data: `{"Tags": [{"Key": "Name", "Value": "web"}, {"Key": "env", "Value": ""}, {"Key": "", "Value": "keyless"}]}`,
+			groups: []string{
+				"tag tag:Name=web",
+				"tag tag:env=",
+			},
+		},
+		{
+			name: "attributes",
+			data: `{
+				"Placement": {"AvailabilityZone": "us-west-2a"},
+				"IamInstanceProfile": {"Arn": "arn:aws:iam::123:instance-profile/web"},
+				"SubnetId": "subnet-1",
+				"VpcId": "vpc-1",
+				"InstanceType": "t2.micro",
+				"KeyName": "",
+				"ImageId": "ami-1"
+			}`,
+			groups: []string{
+				"attribute availability-zone:us-west-2a",
+				"attribute instance-profile:arn:aws:iam::123:instance-profile/web",
+				"attribute subnet:subnet-1",
+				"attribute vpc:vpc-1",
+				"attribute instance-type:t2.micro",
+				"attribute ami:ami-1",
+			},
+		},
+		{
+			name: "autoscaling groups",
+			data: `{"Tags": [{"Key": "Name", "Value": "web"}]}`,
+			autoscaled: []string{
+				`{"Tags": [{"Key": "Name", "Value": "web"}, {"Key": "role", "Value": "frontend"}], "Instances": [{"InstanceId": "i-1", "LaunchConfigurationName": "web-v2"}, {"InstanceId": "i-2", "LaunchConfigurationName": "web-v1"}]}`,
+			},
+			groups: []string{
+				"tag tag:Name=web",
+				"tag tag:role=frontend",
+				"attribute launch-configuration:web-v2",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		instance := &Instance{Id: "i-1", CustomerId: "customer", Region: "us-west-2", AccountId: "123", Type: InstanceStoreType, Data: []byte(test.data)}
+
+		autoscalingGroups := make([]*Group, 0, len(test.autoscaled))
+		for _, data := range test.autoscaled {
+			autoscalingGroups = append(autoscalingGroups, &Group{Name: "asg", Type: AutoScalingGroupStoreType, Data: []byte(data)})
+		}
+
+		groups, err := DeriveGroups(instance, autoscalingGroups)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		got := make([]string, 0, len(groups))
+		for _, group := range groups {
+			got = append(got, group.Type+" "+group.Name)
+
+			if group.CustomerId != instance.CustomerId || group.Region != instance.Region || group.AccountId != instance.AccountId {
+				t.Errorf("%s: %s isn't in the instance's customer, region and account", test.name, group.Name)
+			}
+		}
+
+		if !reflect.DeepEqual(got, test.groups) {
+			t.Errorf("%s: got groups %q, want %q", test.name, got, test.groups)
+		}
+	}
+}
+
+func TestDeriveGroupsMalformed(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		autoscaled string
+	}{
+		{"instance", `{"Tags": "Name=web"}`, `{}`},
+		{"autoscaling group", `{}`, `{"Tags": "Name=web"}`},
+	}
+
+	for _, test := range tests {
+		instance := &Instance{Id: "i-1", Type: InstanceStoreType, Data: []byte(test.data)}
+		autoscalingGroups := []*Group{{Name: "asg", Type: AutoScalingGroupStoreType, Data: []byte(test.autoscaled)}}
+
+		if _, err := DeriveGroups(instance, autoscalingGroups); err == nil {
+			t.Errorf("%s: got no error", test.name)
+		}
+	}
+}
+
+func TestDerivedGroupName(t *testing.T) {
+	long := strings.Repeat("a", maxGroupNameLength)
+	// a multibyte rune straddles where the name is cut
+	multibyte := strings.Repeat("a", maxGroupNameLength-len("tag:")-len("~01234567")-1) + strings.Repeat("é", 10)
+
+	tests := []struct {
+		name   string
+		prefix string
+		value  string
+		// whether the name is cut short and hashed
+		cut bool
+	}{
+		{"short", TagStoreType, "Name=web", false},
+		{"at the limit", TagStoreType, long[:maxGroupNameLength-len("tag:")], false},
+		{"over the limit", TagStoreType, long, true},
+		{"multibyte", TagStoreType, multibyte, true},
+	}
+
+	for _, test := range tests {
+		got := derivedGroupName(test.prefix, test.value)
+
+		if len(got) > maxGroupNameLength {
+			t.Errorf("%s: %q is %d bytes long, more than %d", test.name, got, len(got), maxGroupNameLength)
+		}
+
+		if !utf8.ValidString(got) {
+			t.Errorf("%s: %q isn't valid utf-8", test.name, got)
+		}
+
+		if !test.cut {
+			if want := test.prefix + ":" + test.value; got != want {
+				t.Errorf("%s: got %q, want %q", test.name, got, want)
+			}
+			continue
+		}
+
+		if !strings.Contains(got, "~") || !strings.HasPrefix(test.prefix+":"+test.value, got[:strings.LastIndex(got, "~")]) {
+			t.Errorf("%s: %q isn't a prefix of the name and a hash", test.name, got)
+		}
+	}
+
+	// names cut to the same prefix stay distinct
+	if a, b := derivedGroupName(TagStoreType, long+"a"), derivedGroupName(TagStoreType, long+"b"); a == b {
+		t.Errorf("%q and %q both named %q", long+"a", long+"b", a)
+	}
+}
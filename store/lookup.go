@@ -0,0 +1,45 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// How a lookup matched an entity: by one of its IPs, by a subnet's CIDR
+// block containing the IP, or by one of its DNS names.
+const (
+	IpMatch     = "ip"
+	SubnetMatch = "subnet"
+	DnsMatch    = "dns"
+)
+
+var ErrMissingLookup = errors.New("must look up an ip or a dns name")
+
+// LookupRequest finds what an IP or DNS name belongs to. Only one of Ip
+// and Dns is used, Ip if both are given.
+type LookupRequest struct {
+	CustomerId string `json:"customer_id"`
+	Ip         string `json:"ip"`
+	Dns        string `json:"dns"`
+	View       string `json:"view"`
+}
+
+type LookupResponse struct {
+	Matches []*LookupMatch `json:"matches"`
+}
+
+// LookupMatch is an entity an address matched. Field is where in the
+// entity's data the matching address is, e.g.
+// NetworkInterfaces.PrivateIpAddresses.PrivateIpAddress, and Value the
+// address, or the CIDR block of a subnet match. Entity is the entity's data,
+// or its summary in the summary view.
+type LookupMatch struct {
+	Match      string          `json:"match"`
+	Field      string          `json:"field"`
+	Value      string          `json:"value"`
+	EntityType string          `json:"entity_type" db:"entity_type"`
+	EntityId   string          `json:"entity_id" db:"entity_id"`
+	Region     string          `json:"region"`
+	AccountId  string          `json:"account_id" db:"account_id"`
+	Entity     json.RawMessage `json:"entity" db:"data"`
+}
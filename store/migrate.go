@@ -0,0 +1,294 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/opsee/fieri/migrations"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+const (
+	// migrationLockKey is the postgres advisory lock held while migrating, so
+	// pods started together don't race to apply the same migration.
+	migrationLockKey = 4242001
+)
+
+// migrationFile matches names like 0004_subnets_routetables.up.sql.
+var migrationFile = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// EmbeddedMigrations returns the migrations compiled into this binary.
+func EmbeddedMigrations() ([]*Migration, error) {
+	return ReadMigrations(migrations.FS)
+}
+
+// Migration is one numbered schema change.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version int64  `json:"version"`
+	Name    string `json:"name"`
+	Applied bool   `json:"applied"`
+}
+
+// ReadMigrations loads the *.up.sql and *.down.sql files at the root of fsys,
+// ordered by version.
+func ReadMigrations(fsys fs.FS) ([]*Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		match := migrationFile.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Migrator applies migrations, recording them in the same schema_migrations
+// table as the standalone migrate tool so existing databases carry over.
+type Migrator struct {
+	db         *sqlx.DB
+	migrations []*Migration
+}
+
+func NewMigrator(connection string, migrations []*Migration) (*Migrator, error) {
+	db, err := sqlx.Open("postgres", connection)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec("create table if not exists schema_migrations (version bigint not null primary key)")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Up applies every pending migration in order, returning those it applied.
+func (m *Migrator) Up() ([]*Migration, error) {
+	done := make([]*Migration, 0)
+
+	err := m.locked(func(conn *sql.Conn) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if applied[migration.Version] {
+				continue
+			}
+
+			if err := m.run(conn, migration.Up, "insert into schema_migrations (version) values ($1)", migration.Version); err != nil {
+				return fmt.Errorf("migration %d_%s: %s", migration.Version, migration.Name, err)
+			}
+
+			done = append(done, migration)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Down reverts the most recently applied migration, returning nil if none
+// are applied.
+func (m *Migrator) Down() (*Migration, error) {
+	var reverted *Migration
+
+	err := m.locked(func(conn *sql.Conn) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if !applied[migration.Version] {
+				continue
+			}
+
+			if err := m.run(conn, migration.Down, "delete from schema_migrations where version = $1", migration.Version); err != nil {
+				return fmt.Errorf("migration %d_%s: %s", migration.Version, migration.Name, err)
+			}
+
+			reverted = migration
+			return nil
+		}
+
+		return nil
+	})
+
+	return reverted, err
+}
+
+func (m *Migrator) Status() ([]*MigrationStatus, error) {
+	conn, err := m.db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	applied, err := m.applied(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]*MigrationStatus, len(m.migrations))
+	for i, migration := range m.migrations {
+		statuses[i] = &MigrationStatus{
+			Version: migration.Version,
+			Name:    migration.Name,
+			Applied: applied[migration.Version],
+		}
+	}
+
+	return statuses, nil
+}
+
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+// Check returns an error unless exactly the known migrations are applied.
+func (m *Migrator) Check() error {
+	statuses, err := m.Status()
+	if err != nil {
+		return fmt.Errorf("checking database schema version: %s (has \"fieri migrate up\" been run?)", err)
+	}
+
+	pending := 0
+	var expected int64
+	for _, s := range statuses {
+		if !s.Applied {
+			pending++
+		}
+		expected = s.Version
+	}
+
+	conn, err := m.db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var current int64
+	err = conn.QueryRowContext(context.Background(), "select coalesce(max(version), 0) from schema_migrations").Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	if current > expected {
+		return fmt.Errorf("database schema is at version %d, newer than the %d this build of fieri expects; deploy a newer fieri or run an older one's \"fieri migrate down\"", current, expected)
+	}
+
+	if pending > 0 {
+		return fmt.Errorf("database schema is at version %d but fieri expects %d (%d migrations pending); run \"fieri migrate up\"", current, expected, pending)
+	}
+
+	return nil
+}
+
+// locked runs fn on a single connection holding the migration lock.
+func (m *Migrator) locked(fn func(*sql.Conn) error) error {
+	ctx := context.Background()
+
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, "select pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "select pg_advisory_unlock($1)", migrationLockKey)
+
+	return fn(conn)
+}
+
+func (m *Migrator) applied(conn *sql.Conn) (map[int64]bool, error) {
+	rows, err := conn.QueryContext(context.Background(), "select version from schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]bool)
+	for rows.Next() {
+		var v int64
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[v] = true
+	}
+
+	return applied, rows.Err()
+}
+
+// run executes a migration's sql and the bookkeeping statement together.
+func (m *Migrator) run(conn *sql.Conn, migrationSQL, bookkeeping string, version int64) error {
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if migrationSQL != "" {
+		if _, err = tx.Exec(migrationSQL); err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.Exec(bookkeeping, version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -1,10 +1,17 @@
 package store
 
 import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"github.com/opsee/fieri/metrics"
+	"io"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,13 +22,106 @@ type Postgres struct {
 	expireMut       *sync.Mutex
 	expireInterval  int64
 	expireThreshold int
+	expireWg        *sync.WaitGroup
+	expiring        int64
+	stopChan        chan struct{}
+	stopOnce        *sync.Once
+	started         int32
 }
 
+var (
+	putEntityDuration = metrics.NewHistogram("fieri_put_entity_duration_seconds", "PutEntity latency by entity type.", metrics.DefaultBuckets, "type")
+	expiryRuns        = metrics.NewCounter("fieri_expiry_runs_total", "Expiry runs by customer.", "customer_id")
+	expiredRows       = metrics.NewCounter("fieri_expired_rows_total", "Rows deleted by expiry runs, by customer and table.", "customer_id", "table")
+)
+
 type expireReq struct {
 	timestamp  int64
 	customerId string
 }
 
+// where accumulates the conditions and positional arguments of a query's
+// where clause, so optional filters don't need a query per combination.
+type where struct {
+	conditions []string
+	args       []interface{}
+}
+
+// add appends a condition, substituting the next positional placeholder for
+// %s in the condition's format.
+func (w *where) add(format string, arg interface{}) {
+	w.args = append(w.args, arg)
+	w.conditions = append(w.conditions, fmt.Sprintf(format, fmt.Sprintf("$%d", len(w.args))))
+}
+
+// addIf adds the condition only when value is non-empty.
+func (w *where) addIf(format string, value string) {
+	if value != "" {
+		w.add(format, value)
+	}
+}
+
+// addIn adds a condition that column is one of values, when there are any.
+func (w *where) addIn(column string, values []string) {
+	w.addList(column+" in", values)
+}
+
+// addNotIn adds a condition that column is none of values, when there are
+// any.
+func (w *where) addNotIn(column string, values []string) {
+	w.addList(column+" not in", values)
+}
+
+func (w *where) addList(condition string, values []string) {
+	if len(values) == 0 {
+		return
+	}
+
+	placeholders := make([]string, len(values))
+	for i, value := range values {
+		w.args = append(w.args, value)
+		placeholders[i] = fmt.Sprintf("$%d", len(w.args))
+	}
+
+	w.conditions = append(w.conditions, condition+" ("+strings.Join(placeholders, ", ")+")")
+}
+
+func (w *where) String() string {
+	if len(w.conditions) == 0 {
+		return ""
+	}
+
+	return " where " + strings.Join(w.conditions, " and ")
+}
+
+// getUnique gets the one row query selects into dest. It returns
+// sql.ErrNoRows when there's none, and ErrAmbiguousEntity when there's more
+// than one, e.g. an id in two accounts and no account to tell them apart.
+func getUnique(q sqlx.Queryer, dest interface{}, query string, args ...interface{}) error {
+	rows, err := q.Queryx(query+" limit 2", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+
+	if err = rows.StructScan(dest); err != nil {
+		return err
+	}
+
+	if rows.Next() {
+		return ErrAmbiguousEntity
+	}
+
+	return rows.Err()
+}
+
 func NewPostgres(connection string, expireInterval, expireThreshold int) (Store, error) {
 	db, err := sqlx.Open("postgres", connection)
 	if err != nil {
@@ -30,28 +130,72 @@ func NewPostgres(connection string, expireInterval, expireThreshold int) (Store,
 	db.SetMaxOpenConns(64)
 	db.SetMaxIdleConns(8)
 
-	return &Postgres{
+	// refuse to serve against a schema this build doesn't know
+	migrations, err := EmbeddedMigrations()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err = (&Migrator{db: db, migrations: migrations}).Check(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	pg := &Postgres{
 		db:              db,
 		expireChan:      make(chan expireReq),
 		expirys:         make(map[string]int64),
 		expireInterval:  int64(expireInterval),
 		expireThreshold: expireThreshold,
 		expireMut:       &sync.Mutex{},
-	}, nil
+		expireWg:        &sync.WaitGroup{},
+		stopChan:        make(chan struct{}),
+		stopOnce:        &sync.Once{},
+	}
+
+	metrics.NewGaugeFunc("fieri_expiry_customers", "Customers tracked by the expiry loop.", func() float64 {
+		pg.expireMut.Lock()
+		defer pg.expireMut.Unlock()
+		return float64(len(pg.expirys))
+	})
+
+	return pg, nil
 }
 
 func (pg *Postgres) Start() {
 	log.Info("starting db expiry channel")
+	atomic.StoreInt32(&pg.started, 1)
 
-	for req := range pg.expireChan {
+	for {
+		var req expireReq
+
+		select {
+		case req = <-pg.expireChan:
+		case <-pg.stopChan:
+			log.Info("stopped db expiry channel")
+			return
+		}
+
+		pg.expireMut.Lock()
 		lastEx, ok := pg.expirys[req.customerId]
 		if !ok {
 			pg.expirys[req.customerId] = req.timestamp
+		}
+		pg.expireMut.Unlock()
+
+		if !ok {
 			continue
 		}
 
 		if req.timestamp-lastEx > pg.expireInterval {
+			pg.expireWg.Add(1)
+			atomic.AddInt64(&pg.expiring, 1)
+
 			go func(req expireReq) {
+				defer pg.expireWg.Done()
+				defer atomic.AddInt64(&pg.expiring, -1)
+
 				logger := log.WithFields(log.Fields{
 					"customer-id": req.customerId,
 					"timestamp":   req.timestamp,
@@ -73,47 +217,138 @@ func (pg *Postgres) Start() {
 	}
 }
 
+// Stop ends the expiry loop, waits up to timeout for running expiries to
+// finish, and closes the connection pool.
+func (pg *Postgres) Stop(timeout time.Duration) error {
+	pg.stopOnce.Do(func() { close(pg.stopChan) })
+
+	done := make(chan struct{})
+	go func() {
+		pg.expireWg.Wait()
+		close(done)
+	}()
+
+	var err error
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		err = fmt.Errorf("timed out waiting for expiry, abandoned %d expiry runs", atomic.LoadInt64(&pg.expiring))
+	}
+
+	if closeErr := pg.db.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
 func (pg *Postgres) PutEntity(entity interface{}) (*EntityResponse, error) {
-	var (
-		err        error
-		response   *EntityResponse
-		customerId string
-	)
-
-	switch entity.(type) {
-	case *Instance:
-		err = pg.putInstance(entity.(*Instance))
-		response = &EntityResponse{entity}
-		customerId = entity.(*Instance).CustomerId
-
-	case *Group:
-		err = pg.putGroup(entity.(*Group))
-		response = &EntityResponse{entity}
-		customerId = entity.(*Group).CustomerId
-
-	case *RouteTable:
-		err = pg.putRouteTable(entity.(*RouteTable))
-		response = &EntityResponse{entity}
-		customerId = entity.(*RouteTable).CustomerId
-
-	case *Subnet:
-		err = pg.putSubnet(entity.(*Subnet))
-		response = &EntityResponse{entity}
-		customerId = entity.(*Subnet).CustomerId
-	}
-
-	if err == nil {
-		lastSync := time.Now()
-		customer := &Customer{Id: customerId, LastSync: lastSync}
-		err = pg.putCustomer(customer)
+	customerId, err := EntityCustomerId(entity)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := pg.PutEntities(&PutEntitiesRequest{CustomerId: customerId, Entities: []interface{}{entity}})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Entities[0], nil
+}
+
+// PutEntities writes a batch of one customer's entities, and the customer's
+// last sync, in a single transaction. The baselines of the entities are
+// re-evaluated in the same transaction.
+func (pg *Postgres) PutEntities(request *PutEntitiesRequest) (*PutEntitiesResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	tx, err := pg.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	baselines, err := loadBaselines(tx, request.CustomerId)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &PutEntitiesResponse{Entities: make([]*EntityResponse, 0, len(request.Entities))}
+
+	for _, entity := range request.Entities {
+		customerId, err := EntityCustomerId(entity)
+		if err != nil {
+			return nil, err
+		}
+
+		if customerId != request.CustomerId {
+			return nil, fmt.Errorf("entity belongs to customer %s, not %s", customerId, request.CustomerId)
+		}
+
+		var (
+			created, changed                      bool
+			entityType, entityId, region, account string
+			data                                  []byte
+		)
+
+		start := time.Now()
+
+		switch e := entity.(type) {
+		case *Instance:
+			created, changed, err = putInstance(tx, e)
+			entityType, entityId, region, account, data = e.Type, e.Id, e.Region, e.AccountId, e.Data
+
+		case *Group:
+			created, changed, err = putGroup(tx, e)
+			entityType, entityId, region, account, data = e.Type, e.Name, e.Region, e.AccountId, e.Data
+
+		case *RouteTable:
+			created, changed, err = putRouteTable(tx, e)
+			entityType, entityId, region, account, data = RouteTableStoreType, e.Id, e.Region, e.AccountId, e.Data
+
+		case *Subnet:
+			created, changed, err = putSubnet(tx, e)
+			entityType, entityId, region, account, data = SubnetStoreType, e.Id, e.Region, e.AccountId, e.Data
+		}
+
 		if err != nil {
 			return nil, err
 		}
 
-		pg.expireChan <- expireReq{lastSync.Unix(), customerId}
+		// baselines only need a second look when the data they compare did
+		// change
+		if changed {
+			if err = evaluateBaselines(tx, baselines, entityType, entityId, region, account, data); err != nil {
+				return nil, err
+			}
+		}
+
+		putEntityDuration.Observe(time.Since(start).Seconds(), entityType)
+		response.Entities = append(response.Entities, &EntityResponse{Entity: entity, Created: created})
+	}
+
+	lastSync := time.Now()
+	if err = putCustomer(tx, &Customer{Id: request.CustomerId, LastSync: lastSync}); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// entities are only expired while the expiry loop runs, so one-off
+	// writers (imports, restores) don't block on it
+	if atomic.LoadInt32(&pg.started) == 1 {
+		select {
+		case pg.expireChan <- expireReq{lastSync.Unix(), request.CustomerId}:
+		case <-pg.stopChan:
+		}
 	}
 
-	return response, err
+	return response, nil
 }
 
 func (pg *Postgres) GetInstance(request *InstanceRequest) (*InstanceResponse, error) {
@@ -125,9 +360,24 @@ func (pg *Postgres) GetInstance(request *InstanceRequest) (*InstanceResponse, er
 		return nil, ErrMissingInstanceId
 	}
 
+	w := &where{}
+	w.add("customer_id = %s", request.CustomerId)
+	w.add("id = %s", request.InstanceId)
+	w.addIf("type = %s", request.Type)
+	w.addIf("region = %s", request.Region)
+	w.addIf("account_id = %s", request.AccountId)
+
 	instance := new(Instance)
-	err := pg.db.Get(instance, "select * from instances where customer_id = $1 and id = $2", request.CustomerId, request.InstanceId)
-	return &InstanceResponse{instance}, err
+	err := getUnique(pg.db, instance, "select * from instances"+w.String(), w.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = viewInstances(request.View, []*Instance{instance}); err != nil {
+		return nil, err
+	}
+
+	return newInstanceResponse(instance), nil
 }
 
 func (pg *Postgres) ListInstances(request *InstancesRequest) (*InstancesResponse, error) {
@@ -136,9 +386,13 @@ func (pg *Postgres) ListInstances(request *InstancesRequest) (*InstancesResponse
 		return nil, err
 	}
 
+	if err = viewInstances(request.View, instances); err != nil {
+		return nil, err
+	}
+
 	responses := make([]*InstanceResponse, len(instances))
 	for i, inst := range instances {
-		responses[i] = &InstanceResponse{inst}
+		responses[i] = newInstanceResponse(inst)
 	}
 
 	return &InstancesResponse{responses}, err
@@ -149,14 +403,14 @@ func (pg *Postgres) CountInstances(request *InstancesRequest) (*CountResponse, e
 		return nil, ErrMissingCustomerId
 	}
 
-	var err error
-	var count int
+	w := &where{}
+	w.add("customer_id = %s", request.CustomerId)
+	w.addIf("type = %s", request.Type)
+	w.addIf("region = %s", request.Region)
+	w.addIf("account_id = %s", request.AccountId)
 
-	if request.Type == "" {
-		err = pg.db.Get(&count, "select count(id) from instances where customer_id = $1", request.CustomerId)
-	} else {
-		err = pg.db.Get(&count, "select count(id) from instances where customer_id = $1 and type = $2", request.CustomerId, request.Type)
-	}
+	var count int
+	err := pg.db.Get(&count, "select count(id) from instances"+w.String(), w.args...)
 
 	return &CountResponse{count}, err
 }
@@ -175,23 +429,50 @@ func (pg *Postgres) GetGroup(request *GroupRequest) (*GroupResponse, error) {
 		return nil, ErrMissingGroupId
 	}
 
+	w := &where{}
+	w.add("customer_id = %s", request.CustomerId)
+	w.add("name = %s", request.GroupId)
+	w.addIf("type = %s", request.Type)
+	w.addIf("region = %s", request.Region)
+	w.addIf("account_id = %s", request.AccountId)
+
 	group := new(Group)
-	err := pg.db.Get(group, "select * from groups where customer_id = $1 and name = $2", request.CustomerId, request.GroupId)
+	err := getUnique(pg.db, group, "select * from groups"+w.String(), w.args...)
 	if err != nil {
 		return nil, err
 	}
 
-	instances, err := pg.listInstances(&InstancesRequest{CustomerId: request.CustomerId, GroupId: request.GroupId, Type: request.Type})
+	instances, err := pg.listInstances(&InstancesRequest{
+		CustomerId: request.CustomerId,
+		GroupId:    request.GroupId,
+		Type:       request.Type,
+		Region:     group.Region,
+		AccountId:  group.AccountId,
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	if err = viewGroups(request.View, []*Group{group}); err != nil {
+		return nil, err
+	}
+
+	if err = viewInstances(request.View, instances); err != nil {
+		return nil, err
+	}
+
 	iresponses := make([]*InstanceResponse, len(instances))
 	for i, inst := range instances {
-		iresponses[i] = &InstanceResponse{inst}
+		iresponses[i] = newInstanceResponse(inst)
 	}
 
-	return &GroupResponse{group, iresponses, len(instances)}, err
+	return &GroupResponse{
+		Group:         group,
+		Instances:     iresponses,
+		InstanceCount: len(instances),
+		Region:        group.Region,
+		AccountId:     group.AccountId,
+	}, err
 }
 
 func (pg *Postgres) ListGroups(request *GroupsRequest) (*GroupsResponse, error) {
@@ -199,177 +480,1533 @@ func (pg *Postgres) ListGroups(request *GroupsRequest) (*GroupsResponse, error)
 		return nil, ErrMissingCustomerId
 	}
 
-	var err error
-	groups := make([]*Group, 0)
-
-	if request.Type == "" {
-		err = pg.db.Select(&groups, "select groups.*, count(distinct(groups_instances.instance_id)) as instance_count from groups left outer join groups_instances on groups_instances.group_name = groups.name and groups_instances.customer_id = groups.customer_id where groups.customer_id = $1 group by groups.name, groups.customer_id", request.CustomerId)
-	} else {
-		err = pg.db.Select(&groups, "select groups.*, count(distinct(groups_instances.instance_id)) as instance_count from groups left outer join groups_instances on groups_instances.group_name = groups.name and groups_instances.customer_id = groups.customer_id where groups.customer_id = $1 and groups.type = $2 group by groups.name, groups.customer_id", request.CustomerId, request.Type)
+	w := &where{}
+	w.add("groups.customer_id = %s", request.CustomerId)
+	w.addIf("groups.type = %s", request.Type)
+	w.addIf("groups.region = %s", request.Region)
+	w.addIf("groups.account_id = %s", request.AccountId)
+	if !request.ChangedSince.IsZero() {
+		w.add("groups.changed_at > %s", request.ChangedSince)
 	}
 
+	groups := make([]*Group, 0)
+	err := pg.db.Select(&groups, "select groups.*, count(distinct(groups_instances.instance_id)) as instance_count from groups left outer join groups_instances on groups_instances.group_name = groups.name and groups_instances.customer_id = groups.customer_id and groups_instances.region = groups.region and groups_instances.account_id = groups.account_id"+w.String()+" group by groups.name, groups.customer_id, groups.region, groups.account_id", w.args...)
 	if err != nil {
 		return nil, err
 	}
 
+	if err = viewGroups(request.View, groups); err != nil {
+		return nil, err
+	}
+
 	grouprs := make([]*GroupResponse, len(groups))
 	for i, g := range groups {
 		grouprs[i] = &GroupResponse{
 			Group:         g,
 			InstanceCount: g.InstanceCount,
+			Region:        g.Region,
+			AccountId:     g.AccountId,
 		}
 	}
 
 	return &GroupsResponse{grouprs}, nil
 }
 
-func (pg *Postgres) CountGroups(request *GroupsRequest) (*CountResponse, error) {
+// ListMemberships returns every group membership of a customer's
+// instances.
+func (pg *Postgres) ListMemberships(request *MembershipsRequest) (*MembershipsResponse, error) {
 	if request.CustomerId == "" {
 		return nil, ErrMissingCustomerId
 	}
 
-	var err error
-	var count int
+	w := &where{}
+	w.add("customer_id = %s", request.CustomerId)
+	w.addIf("region = %s", request.Region)
+	w.addIf("account_id = %s", request.AccountId)
 
-	if request.Type == "" {
-		err = pg.db.Get(&count, "select count(name) from groups where customer_id = $1", request.CustomerId)
-	} else {
-		err = pg.db.Get(&count, "select count(name) from groups where customer_id = $1 and type = $2", request.CustomerId, request.Type)
+	memberships := make([]*Membership, 0)
+	err := pg.db.Select(&memberships, "select region, account_id, group_name, instance_id from groups_instances"+w.String(), w.args...)
+	if err != nil {
+		return nil, err
 	}
 
-	return &CountResponse{count}, err
-}
-
-func (pg *Postgres) DeleteGroups() error {
-	_, err := pg.db.Exec("delete from groups")
-	return err
+	return &MembershipsResponse{memberships}, nil
 }
 
-func (pg *Postgres) GetCustomer(request *CustomerRequest) (*CustomerResponse, error) {
-	if request.Id == "" {
+// ListSubnets returns a customer's subnets.
+func (pg *Postgres) ListSubnets(request *SubnetsRequest) (*SubnetsResponse, error) {
+	if request.CustomerId == "" {
 		return nil, ErrMissingCustomerId
 	}
 
-	customer := new(Customer)
-	err := pg.db.Get(customer, "select * from customers where id = $1", request.Id)
+	w := &where{}
+	w.add("customer_id = %s", request.CustomerId)
+	w.addIf("region = %s", request.Region)
+	w.addIf("account_id = %s", request.AccountId)
 
-	return &CustomerResponse{customer}, err
+	subnets := make([]*Subnet, 0)
+	err := pg.db.Select(&subnets, "select * from subnets"+w.String(), w.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SubnetsResponse{subnets}, nil
 }
 
-func (pg *Postgres) listInstances(request *InstancesRequest) ([]*Instance, error) {
+// ListRouteTables returns a customer's route tables.
+func (pg *Postgres) ListRouteTables(request *RouteTablesRequest) (*RouteTablesResponse, error) {
 	if request.CustomerId == "" {
 		return nil, ErrMissingCustomerId
 	}
 
-	var err error
-	instances := make([]*Instance, 0)
+	w := &where{}
+	w.add("customer_id = %s", request.CustomerId)
+	w.addIf("region = %s", request.Region)
+	w.addIf("account_id = %s", request.AccountId)
 
-	if request.GroupId != "" {
-		err = pg.db.Select(&instances, "select * from instances where customer_id = $1 and id in (select instance_id from groups_instances where customer_id = $1 and group_name = $2)", request.CustomerId, request.GroupId)
-	} else if request.Type == "" {
-		err = pg.db.Select(&instances, "select * from instances where customer_id = $1", request.CustomerId)
-	} else {
-		err = pg.db.Select(&instances, "select * from instances where customer_id = $1 and type = $2", request.CustomerId, request.Type)
+	routeTables := make([]*RouteTable, 0)
+	err := pg.db.Select(&routeTables, "select * from route_tables"+w.String(), w.args...)
+	if err != nil {
+		return nil, err
 	}
 
-	return instances, err
+	return &RouteTablesResponse{routeTables}, nil
 }
 
-func (pg *Postgres) putInstance(instance *Instance) error {
-	query := "with update_instances as (update instances set (type, data) = (:type, :data) where id = :id and customer_id = :customer_id returning id), insert_instances as (insert into instances (id, customer_id, type, data) select :id as id, :customer_id as customer_id, :type as type, :data as data where not exists (select id from update_instances limit 1) returning id) select * from update_instances union all select * from insert_instances;"
-	_, err := pg.db.NamedExec(query, instance)
+// ListTags returns the catalog of a customer's tag keys and values, from the
+// tags index rather than the entities' data.
+func (pg *Postgres) ListTags(request *TagsRequest) (*TagsResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	w := &where{}
+	w.add("customer_id = %s", request.CustomerId)
+	w.addIf("key = %s", request.Key)
+	w.addIf("entity_type = %s", request.EntityType)
+	w.addIf("region = %s", request.Region)
+	w.addIf("account_id = %s", request.AccountId)
+	if request.Prefix != "" {
+		w.add("key like %s", likePrefix(request.Prefix))
+	}
+	if request.ValuePrefix != "" {
+		w.add("value like %s", likePrefix(request.ValuePrefix))
+	}
+
+	counts := make([]*tagCount, 0)
+	err := pg.db.Select(&counts, "select key, value, count(*) as resources from tags"+w.String()+" group by key, value order by key, value", w.args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// i don't really want to use transactions for this right now until a refactor
-	for _, group := range instance.Groups {
-		err := pg.ensureGroup(group)
-		if err != nil {
-			return err
-		}
+	response := &TagsResponse{Tags: make([]*TagKey, 0)}
 
-		_, err = pg.db.Exec("insert into groups_instances (customer_id, group_name, instance_id) select $1 as customer_id, ($2::varchar(128)) as group_name, ($3::varchar(128)) as instance_id where not exists (select instance_id from groups_instances where customer_id = $1 and group_name = $2 and instance_id = $3)", group.CustomerId, group.Name, instance.Id)
-		if err != nil {
-			return err
+	var key *TagKey
+	for _, count := range counts {
+		if key == nil || key.Key != count.Key {
+			key = &TagKey{Key: count.Key, Values: make([]*TagValue, 0, 1)}
+			response.Tags = append(response.Tags, key)
 		}
+
+		key.Resources += count.Resources
+		key.Values = append(key.Values, &TagValue{Value: count.Value, Resources: count.Resources})
 	}
 
-	return nil
+	return response, nil
 }
 
-func (pg *Postgres) putGroup(group *Group) error {
-	query := "with update_groups as (update groups set (type, data) = (:type, :data) where name = :name and customer_id = :customer_id returning name), insert_groups as (insert into groups (name, customer_id, type, data) select :name as name, :customer_id as customer_id, :type as type, :data as data where not exists (select name from update_groups limit 1) returning name) select * from update_groups union all select * from insert_groups;"
-	_, err := pg.db.NamedExec(query, group)
+// lookupQuery finds the entities with an address in the addresses index,
+// with their data. Instances and groups are told apart by type, so only
+// the matching table's join finds a row.
+const lookupQuery = `select addresses.field, addresses.entity_type, addresses.entity_id, addresses.region, addresses.account_id,
+	case when addresses.cidr is not null then 'subnet' when addresses.ip is not null then 'ip' else 'dns' end as match,
+	coalesce(host(addresses.ip), text(addresses.cidr), addresses.dns) as value,
+	coalesce(instances.data, groups.data, subnets.data) as data
+	from addresses
+	left join instances on instances.customer_id = addresses.customer_id and instances.account_id = addresses.account_id and instances.region = addresses.region and instances.id = addresses.entity_id and cast(instances.type as text) = addresses.entity_type
+	left join groups on groups.customer_id = addresses.customer_id and groups.account_id = addresses.account_id and groups.region = addresses.region and groups.name = addresses.entity_id and cast(groups.type as text) = addresses.entity_type
+	left join subnets on subnets.customer_id = addresses.customer_id and subnets.account_id = addresses.account_id and subnets.region = addresses.region and subnets.id = addresses.entity_id and addresses.entity_type = 'subnet'`
+
+// Lookup finds the instances, load balancers and subnets an IP or DNS name
+// belongs to, from the addresses index. An IP matches the entities that
+// have it and the subnets whose CIDR block contains it.
+func (pg *Postgres) Lookup(request *LookupRequest) (*LookupResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	w := &where{}
+	w.add("addresses.customer_id = %s", request.CustomerId)
+
+	switch {
+	case request.Ip != "":
+		w.add("(addresses.ip = cast(%[1]s as inet) or addresses.cidr >>= cast(%[1]s as inet))", request.Ip)
+	case request.Dns != "":
+		w.add("addresses.dns = lower(trim(trailing '.' from %s))", request.Dns)
+	default:
+		return nil, ErrMissingLookup
+	}
+
+	matches := make([]*LookupMatch, 0)
+	err := pg.db.Select(&matches, lookupQuery+w.String()+" order by addresses.entity_type, addresses.entity_id, addresses.field", w.args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// i don't really want to use transactions for this right now until a refactor
-	for _, instance := range group.Instances {
-		err := pg.ensureInstance(instance)
-		if err != nil {
-			return err
-		}
+	if request.View == SummaryView {
+		for _, match := range matches {
+			summary, err := Summarize(match.EntityType, match.EntityId, match.Entity)
+			if err != nil {
+				return nil, err
+			}
 
-		_, err = pg.db.Exec("insert into groups_instances (customer_id, group_name, instance_id) select $1 as customer_id, ($2::varchar(128)) as group_name, ($3::varchar(128)) as instance_id where not exists (select instance_id from groups_instances where customer_id = $1 and group_name = $2 and instance_id = $3)", group.CustomerId, group.Name, instance.Id)
-		if err != nil {
-			return err
+			if match.Entity, err = json.Marshal(summary); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	return nil
+	return &LookupResponse{Matches: matches}, nil
 }
 
-func (pg *Postgres) putCustomer(customer *Customer) error {
-	query := "with update_customers as (update customers set last_sync = :last_sync where id = :id returning id), insert_customers as (insert into customers (id, last_sync) select :id as id, :last_sync as last_sync where not exists (select id from update_customers limit 1) returning id) select * from update_customers union all select * from insert_customers;"
-	_, err := pg.db.NamedExec(query, customer)
-	return err
-}
+func (pg *Postgres) CountGroups(request *GroupsRequest) (*CountResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
 
-func (pg *Postgres) putRouteTable(routeTable *RouteTable) error {
-	query := `with update_route_tables as
-		  (update route_tables set data = :data where customer_id = :customer_id and id = :id returning id),
-		  insert_route_tables as (insert into route_tables (id, customer_id, data) select :id as id,
-		  :customer_id as customer_id, :data as data where not exists (select id from update_route_tables limit 1) returning id)
-		  select * from update_route_tables union all select * from insert_route_tables;
-		  `
-	_, err := pg.db.NamedExec(query, routeTable)
-	return err
+	w := &where{}
+	w.add("customer_id = %s", request.CustomerId)
+	w.addIf("type = %s", request.Type)
+	w.addIf("region = %s", request.Region)
+	w.addIf("account_id = %s", request.AccountId)
+
+	var count int
+	err := pg.db.Get(&count, "select count(name) from groups"+w.String(), w.args...)
+
+	return &CountResponse{count}, err
 }
 
-func (pg *Postgres) putSubnet(subnet *Subnet) error {
-	query := `with update_subnets as
-		  (update subnets set data = :data where customer_id = :customer_id and id = :id returning id),
-		  insert_subnets as (insert into subnets (id, customer_id, data) select :id as id,
-		  :customer_id as customer_id, :data as data where not exists (select id from update_subnets limit 1) returning id)
-		  select * from update_subnets union all select * from insert_subnets;
-		  `
-	_, err := pg.db.NamedExec(query, subnet)
+func (pg *Postgres) DeleteGroups() error {
+	_, err := pg.db.Exec("delete from groups")
 	return err
 }
 
-func (pg *Postgres) expireEntities(customerId string, lastSync int64) error {
-	lastSyncTime := time.Unix(lastSync, 0).Add(time.Duration(-1*pg.expireThreshold) * time.Second)
+func (pg *Postgres) GetCustomer(request *CustomerRequest) (*CustomerResponse, error) {
+	if request.Id == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	customer := new(Customer)
+	err := pg.db.Get(customer, "select * from customers where id = $1", request.Id)
+
+	return &CustomerResponse{customer}, err
+}
 
-	groupExpireQuery := "delete from groups where customer_id = $1 and updated_at < $2"
-	_, err := pg.db.Exec(groupExpireQuery, customerId, lastSyncTime)
+const customerSummaryQuery = `select customers.id, coalesce(customers.last_sync, customers.created_at) as last_sync,
+	customers.stale, customers.created_at, customers.updated_at,
+	(select count(id) from instances where customer_id = customers.id) as instance_count,
+	(select count(name) from groups where customer_id = customers.id) as group_count,
+	(select count(id) from subnets where customer_id = customers.id) as subnet_count,
+	(select count(id) from route_tables where customer_id = customers.id) as route_table_count
+	from customers`
+
+func (pg *Postgres) ListCustomers() (*CustomersResponse, error) {
+	customers := make([]*CustomerSummary, 0)
+	err := pg.db.Select(&customers, customerSummaryQuery+" order by last_sync desc")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	instanceExpireQuery := "delete from instances where customer_id = $1 and updated_at < $2"
-	_, err = pg.db.Exec(instanceExpireQuery, customerId, lastSyncTime)
+	now := time.Now()
+	for _, c := range customers {
+		c.Staleness = int64(now.Sub(c.LastSync).Seconds())
+	}
 
-	return err
+	return &CustomersResponse{customers}, nil
 }
 
-func (pg *Postgres) ensureInstance(instance *Instance) error {
-	_, err := pg.db.Exec("insert into instances (id, customer_id, type, data) select ($1::varchar(128)) as id, $2 as customer_id, $3 as type, $4 as data where not exists (select id from instances where id = $1 and customer_id = $2)", instance.Id, instance.CustomerId, instance.Type, instance.Data)
-	return err
+func (pg *Postgres) GetCustomerSummary(request *CustomerRequest) (*CustomerSummaryResponse, error) {
+	if request.Id == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	customer := new(CustomerSummary)
+	err := pg.db.Get(customer, customerSummaryQuery+" where customers.id = $1", request.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	customer.Staleness = int64(time.Since(customer.LastSync).Seconds())
+
+	return &CustomerSummaryResponse{customer}, nil
 }
 
-func (pg *Postgres) ensureGroup(group *Group) error {
-	_, err := pg.db.Exec("insert into groups (name, customer_id, type, data) select ($1::varchar(128)) as name, $2 as customer_id, $3 as type, $4 as data where not exists (select name from groups where name = $1 and customer_id = $2)", group.Name, group.CustomerId, group.Type, group.Data)
-	return err
+// UpdateStaleness flips the stale flag of customers that crossed the
+// threshold since the last call. The updates are conditional on the current
+// flag, so only one caller observes each transition. Every customer's last
+// sync is returned too, for callers that keep it.
+func (pg *Postgres) UpdateStaleness(request *StalenessRequest) (*StalenessResponse, error) {
+	threshold := time.Now().Add(-1 * request.StaleAfter)
+	response := &StalenessResponse{
+		Stale:     make([]*Customer, 0),
+		Recovered: make([]*Customer, 0),
+		Customers: make([]*Customer, 0),
+	}
+
+	err := pg.db.Select(&response.Stale, "update customers set stale = true where stale = false and coalesce(last_sync, created_at) < $1 returning id, coalesce(last_sync, created_at) as last_sync, stale, created_at, updated_at", threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pg.db.Select(&response.Recovered, "update customers set stale = false where stale = true and last_sync >= $1 returning id, coalesce(last_sync, created_at) as last_sync, stale, created_at, updated_at", threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pg.db.Select(&response.Customers, "select id, coalesce(last_sync, created_at) as last_sync, stale, created_at, updated_at from customers")
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// DeleteCustomer purges every entity belonging to a customer, and the
+// customer itself, in a single transaction.
+func (pg *Postgres) DeleteCustomer(request *CustomerRequest) (*DeleteCustomerResponse, error) {
+	if request.Id == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	tx, err := pg.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	response := &DeleteCustomerResponse{Id: request.Id}
+	deletes := []struct {
+		table string
+		count *int64
+	}{
+		{"groups_instances", &response.Memberships},
+		{"instances", &response.Instances},
+		{"groups", &response.Groups},
+		{"subnets", &response.Subnets},
+		{"route_tables", &response.RouteTables},
+		{"webhooks", &response.Webhooks},
+		{"baselines", &response.Baselines},
+		// dead letters hold the customer's message bodies
+		{"dead_letters", &response.DeadLetters},
+		// last, since deleting entities fires the inventory event triggers
+		{"inventory_events", &response.Events},
+	}
+
+	for _, d := range deletes {
+		result, err := tx.Exec("delete from "+d.table+" where customer_id = $1", request.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		*d.count, err = result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := tx.Exec("delete from ingest_pauses where scope = $1 and value = $2", CustomerIngestScope, request.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Pauses, err = result.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	result, err = tx.Exec("delete from customers where id = $1", request.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	// entities can outlive their customers row, e.g. one deleted by hand, and
+	// are purged all the same
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	response.Customer = deleted > 0
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	pg.expireMut.Lock()
+	delete(pg.expirys, request.Id)
+	pg.expireMut.Unlock()
+
+	return response, nil
+}
+
+// ExportCustomer writes a consistent snapshot of a customer's inventory to
+// archive, returning sql.ErrNoRows if there's no such customer. Groups and
+// instances come before their memberships, so RestoreCustomer can read the
+// archive in order.
+func (pg *Postgres) ExportCustomer(request *CustomerRequest, archive *ArchiveWriter) error {
+	if request.Id == "" {
+		return ErrMissingCustomerId
+	}
+
+	tx, err := pg.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("set transaction isolation level repeatable read, read only"); err != nil {
+		return err
+	}
+
+	customer := &ArchiveCustomer{}
+	err = tx.Get(customer, "select coalesce(last_sync, created_at) as last_sync, created_at from customers where id = $1", request.Id)
+	if err != nil {
+		return err
+	}
+
+	err = archive.Write(&ArchiveRecord{
+		Kind:   ArchiveHeaderKind,
+		Header: &ArchiveHeader{Version: ArchiveVersion, CustomerId: request.Id, ExportedAt: time.Now().UTC()},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = archive.Write(&ArchiveRecord{Kind: ArchiveCustomerKind, Customer: customer}); err != nil {
+		return err
+	}
+
+	exports := []struct {
+		kind  string
+		query string
+	}{
+		{ArchiveGroupKind, "select name as id, region, account_id, type::text as type, data from groups where customer_id = $1 order by account_id, region, name"},
+		{ArchiveInstanceKind, "select id, region, account_id, type::text as type, data from instances where customer_id = $1 order by account_id, region, id"},
+		{ArchiveMembershipKind, "select region, account_id, group_name, instance_id from groups_instances where customer_id = $1 order by account_id, region, group_name, instance_id"},
+		{ArchiveSubnetKind, "select id, region, account_id, '' as type, data from subnets where customer_id = $1 order by account_id, region, id"},
+		{ArchiveRouteTableKind, "select id, region, account_id, '' as type, data from route_tables where customer_id = $1 order by account_id, region, id"},
+	}
+
+	for _, e := range exports {
+		if err = exportRows(tx, archive, e.kind, e.query, request.Id); err != nil {
+			return fmt.Errorf("exporting %s: %s", e.kind, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func exportRows(tx *sqlx.Tx, archive *ArchiveWriter, kind, query, customerId string) error {
+	rows, err := tx.Queryx(query, customerId)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record := &ArchiveRecord{Kind: kind}
+		if kind == ArchiveMembershipKind {
+			record.Membership = &ArchiveMembership{}
+			err = rows.StructScan(record.Membership)
+		} else {
+			record.Entity = &ArchiveEntity{}
+			err = rows.StructScan(record.Entity)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err = archive.Write(record); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// RestoreCustomer upserts an archive's records into the request's customer,
+// which needn't be the one it was exported from, in a single transaction.
+// Restoring the same archive again changes nothing; entities the customer has
+// that aren't in the archive are left alone.
+func (pg *Postgres) RestoreCustomer(request *RestoreRequest) (*RestoreResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	tx, err := pg.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	baselines, err := loadBaselines(tx, request.CustomerId)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &RestoreResponse{Id: request.CustomerId, SourceCustomerId: request.Archive.Header().CustomerId}
+	counts := map[string]*int64{
+		ArchiveGroupKind:      &response.Groups,
+		ArchiveInstanceKind:   &response.Instances,
+		ArchiveMembershipKind: &response.Memberships,
+		ArchiveSubnetKind:     &response.Subnets,
+		ArchiveRouteTableKind: &response.RouteTables,
+	}
+	queries := map[string]string{
+		ArchiveGroupKind:      putGroupQuery,
+		ArchiveInstanceKind:   putInstanceQuery,
+		ArchiveSubnetKind:     putSubnetQuery,
+		ArchiveRouteTableKind: putRouteTableQuery,
+	}
+
+	// archives without a customer record restore as synced now
+	now := time.Now()
+	customer := &ArchiveCustomer{LastSync: now, CreatedAt: now}
+
+	for {
+		record, err := request.Archive.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch record.Kind {
+		case ArchiveCustomerKind:
+			if record.Customer == nil {
+				return nil, &ArchiveError{ErrMalformedArchive}
+			}
+			customer = record.Customer
+			continue
+
+		case ArchiveMembershipKind:
+			m := record.Membership
+			if m == nil || m.GroupName == "" || m.InstanceId == "" {
+				return nil, &ArchiveError{ErrMalformedArchive}
+			}
+			_, err = tx.Exec(ensureMembershipQuery, request.CustomerId, m.Region, m.AccountId, m.GroupName, m.InstanceId)
+
+		case ArchiveGroupKind, ArchiveInstanceKind, ArchiveSubnetKind, ArchiveRouteTableKind:
+			e := record.Entity
+			if e == nil || e.Id == "" || len(e.Data) == 0 {
+				return nil, &ArchiveError{ErrMalformedArchive}
+			}
+
+			idKey := "id"
+			if record.Kind == ArchiveGroupKind {
+				idKey = "name"
+			}
+
+			var summary *Summary
+			if record.Kind == ArchiveGroupKind || record.Kind == ArchiveInstanceKind {
+				if summary, err = Summarize(e.Type, e.Id, e.Data); err != nil {
+					return nil, &ArchiveError{fmt.Errorf("malformed %s %s: %s", record.Kind, e.Id, err)}
+				}
+			}
+
+			var changed bool
+			_, changed, err = upsert(tx, queries[record.Kind], map[string]interface{}{
+				idKey:         e.Id,
+				"customer_id": request.CustomerId,
+				"region":      e.Region,
+				"account_id":  e.AccountId,
+				"type":        e.Type,
+				"data":        []byte(e.Data),
+				"summary":     summary,
+			})
+
+			// restored data is checked against the customer's baselines as
+			// if it had been ingested
+			if err == nil && changed {
+				entityType := e.Type
+				switch record.Kind {
+				case ArchiveSubnetKind:
+					entityType = SubnetStoreType
+				case ArchiveRouteTableKind:
+					entityType = RouteTableStoreType
+				}
+
+				err = evaluateBaselines(tx, baselines, entityType, e.Id, e.Region, e.AccountId, []byte(e.Data))
+			}
+
+		default:
+			return nil, &ArchiveError{fmt.Errorf("unknown record kind: %s", record.Kind)}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("restoring %s: %s", record.Kind, err)
+		}
+
+		*counts[record.Kind]++
+	}
+
+	_, err = tx.Exec("update customers set last_sync = greatest(last_sync, $2) where id = $1", request.CustomerId, customer.LastSync)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("insert into customers (id, last_sync, created_at) select $1, $2, $3 where not exists (select id from customers where id = $1)", request.CustomerId, customer.LastSync, customer.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+const (
+	// defaultDeadLetterLimit caps ListDeadLetters when the request doesn't.
+	defaultDeadLetterLimit = 100
+	// defaultDeliveryLimit caps ListWebhookDeliveries when the request
+	// doesn't.
+	defaultDeliveryLimit = 100
+)
+
+func (pg *Postgres) PutDeadLetter(dl *DeadLetter) error {
+	query := `insert into dead_letters (customer_id, entity_type, region, account_id, message_id, body, error, attempts)
+		  values (:customer_id, :entity_type, :region, :account_id, :message_id, :body, :error, :attempts)
+		  returning id, created_at, updated_at`
+
+	rows, err := pg.db.NamedQuery(query, dl)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := rows.Scan(&dl.Id, &dl.CreatedAt, &dl.UpdatedAt); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// UpdateDeadLetter records another failed attempt at a dead letter.
+func (pg *Postgres) UpdateDeadLetter(dl *DeadLetter) error {
+	_, err := pg.db.NamedExec("update dead_letters set (error, attempts) = (:error, :attempts) where id = :id", dl)
+	return err
+}
+
+func (pg *Postgres) GetDeadLetter(request *DeadLetterRequest) (*DeadLetterResponse, error) {
+	dl := new(DeadLetter)
+	err := pg.db.Get(dl, "select * from dead_letters where id = $1", request.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeadLetterResponse{dl}, nil
+}
+
+// ListDeadLetters returns the newest dead letters first, without their
+// message bodies.
+func (pg *Postgres) ListDeadLetters(request *DeadLettersRequest) (*DeadLettersResponse, error) {
+	w := &where{}
+	w.addIf("customer_id = %s", request.CustomerId)
+	w.addIf("entity_type = %s", request.EntityType)
+
+	limit := request.Limit
+	if limit <= 0 {
+		limit = defaultDeadLetterLimit
+	}
+
+	query := "select id, customer_id, entity_type, region, account_id, message_id, error, attempts, created_at, updated_at from dead_letters" + w.String() + fmt.Sprintf(" order by id desc limit %d", limit)
+
+	deadLetters := make([]*DeadLetter, 0)
+	err := pg.db.Select(&deadLetters, query, w.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeadLettersResponse{deadLetters}, nil
+}
+
+// DeleteDeadLetter returns sql.ErrNoRows if there is no such dead letter.
+func (pg *Postgres) DeleteDeadLetter(request *DeadLetterRequest) error {
+	result, err := pg.db.Exec("delete from dead_letters where id = $1", request.Id)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// PurgeDeadLetters deletes every dead letter matching the request, or all of
+// them for an empty request.
+func (pg *Postgres) PurgeDeadLetters(request *DeadLettersRequest) (*PurgeDeadLettersResponse, error) {
+	w := &where{}
+	w.addIf("customer_id = %s", request.CustomerId)
+	w.addIf("entity_type = %s", request.EntityType)
+
+	result, err := pg.db.Exec("delete from dead_letters"+w.String(), w.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PurgeDeadLettersResponse{deleted}, nil
+}
+
+func (pg *Postgres) SummarizeDeadLetters() (*DeadLetterSummaryResponse, error) {
+	types := make([]*DeadLetterTypeSummary, 0)
+	err := pg.db.Select(&types, `select entity_type, count(id) as count, count(distinct customer_id) as customers,
+		min(created_at) as oldest, max(created_at) as newest
+		from dead_letters group by entity_type order by count desc, entity_type`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeadLetterSummaryResponse{types}, nil
+}
+
+func (pg *Postgres) ListIngestPauses() (*IngestPausesResponse, error) {
+	pauses := make([]*IngestPause, 0)
+	err := pg.db.Select(&pauses, "select * from ingest_pauses order by scope, value")
+	if err != nil {
+		return nil, err
+	}
+
+	return &IngestPausesResponse{pauses}, nil
+}
+
+// PutIngestPause adds a pause, updating the reason if it already exists.
+func (pg *Postgres) PutIngestPause(pause *IngestPause) error {
+	query := "with update_pauses as (update ingest_pauses set reason = :reason where scope = :scope and value = :value returning scope), insert_pauses as (insert into ingest_pauses (scope, value, reason) select :scope as scope, :value as value, :reason as reason where not exists (select scope from update_pauses limit 1) returning scope) select * from update_pauses union all select * from insert_pauses;"
+	_, err := pg.db.NamedExec(query, pause)
+	return err
+}
+
+// DeleteIngestPause returns sql.ErrNoRows if there is no such pause.
+func (pg *Postgres) DeleteIngestPause(pause *IngestPause) error {
+	result, err := pg.db.Exec("delete from ingest_pauses where scope = $1 and value = $2", pause.Scope, pause.Value)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ListInventoryEvents returns a customer's events after request.After, oldest
+// first. Events are written by triggers, so they cover every writer.
+func (pg *Postgres) ListInventoryEvents(request *InventoryEventsRequest) (*InventoryEventsResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	limit := request.Limit
+	if limit <= 0 {
+		limit = 500
+	}
+
+	w := &where{}
+	w.add("customer_id = %s", request.CustomerId)
+	w.add("id > %s", request.After)
+	w.addIn("entity_type", request.EntityTypes)
+
+	events := make([]*InventoryEvent, 0)
+	err := pg.db.Select(&events, "select * from inventory_events"+w.String()+fmt.Sprintf(" order by id limit %d", limit), w.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &InventoryEventsResponse{Events: events}, nil
+}
+
+// LastInventoryEventId returns the id of a customer's latest event, 0 if it
+// has none.
+func (pg *Postgres) LastInventoryEventId(request *CustomerRequest) (int64, error) {
+	if request.Id == "" {
+		return 0, ErrMissingCustomerId
+	}
+
+	var id int64
+	err := pg.db.Get(&id, "select coalesce(max(id), 0) from inventory_events where customer_id = $1", request.Id)
+	return id, err
+}
+
+func (pg *Postgres) PurgeInventoryEvents(request *PurgeInventoryEventsRequest) (*PurgeInventoryEventsResponse, error) {
+	result, err := pg.db.Exec("delete from inventory_events where created_at < $1", request.Before)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PurgeInventoryEventsResponse{Deleted: deleted}, nil
+}
+
+// PutWebhook creates a webhook.
+func (pg *Postgres) PutWebhook(webhook *Webhook) error {
+	if webhook.CustomerId == "" {
+		return ErrMissingCustomerId
+	}
+
+	query := `insert into webhooks (customer_id, url, secret, entity_types, actions, last_event_id)
+		  values (:customer_id, :url, :secret, :entity_types, :actions, :last_event_id)
+		  returning id, enabled, next_attempt_at, created_at, updated_at`
+
+	rows, err := pg.db.NamedQuery(query, webhook)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := rows.Scan(&webhook.Id, &webhook.Enabled, &webhook.NextAttemptAt, &webhook.CreatedAt, &webhook.UpdatedAt); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (pg *Postgres) GetWebhook(request *WebhookRequest) (*WebhookResponse, error) {
+	w := &where{}
+	w.add("id = %s", request.Id)
+	w.addIf("customer_id = %s", request.CustomerId)
+
+	webhook := new(Webhook)
+	err := pg.db.Get(webhook, "select * from webhooks"+w.String(), w.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookResponse{webhook}, nil
+}
+
+func (pg *Postgres) ListWebhooks(request *WebhooksRequest) (*WebhooksResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	webhooks := make([]*Webhook, 0)
+	err := pg.db.Select(&webhooks, "select * from webhooks where customer_id = $1 order by id", request.CustomerId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhooksResponse{webhooks}, nil
+}
+
+// DeleteWebhook deletes a webhook and its delivery log, returning
+// sql.ErrNoRows if there is no such webhook.
+func (pg *Postgres) DeleteWebhook(request *WebhookRequest) error {
+	w := &where{}
+	w.add("id = %s", request.Id)
+	w.addIf("customer_id = %s", request.CustomerId)
+
+	result, err := pg.db.Exec("delete from webhooks"+w.String(), w.args...)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// EnableWebhook re-enables a webhook and clears its failures. It resumes
+// from the event it was disabled on.
+func (pg *Postgres) EnableWebhook(request *WebhookRequest) (*WebhookResponse, error) {
+	w := &where{}
+	w.add("id = %s", request.Id)
+	w.addIf("customer_id = %s", request.CustomerId)
+
+	webhook := new(Webhook)
+	err := pg.db.Get(webhook, "update webhooks set (enabled, failures, next_attempt_at, disabled_at, disabled_reason) = (true, 0, now(), null, '')"+w.String()+" returning *", w.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookResponse{webhook}, nil
+}
+
+// ClaimWebhooks leases due webhooks to request.Owner. The lease is checked
+// again as each row is updated, so when replicas race for a webhook only one
+// gets it.
+func (pg *Postgres) ClaimWebhooks(request *ClaimWebhooksRequest) (*WebhooksResponse, error) {
+	query := `update webhooks set (lease_owner, lease_until) = ($1, now() + $2 * interval '1 millisecond')
+		  where id in (select id from webhooks where enabled and next_attempt_at <= now() and (lease_until is null or lease_until < now())
+		  and exists (select 1 from inventory_events where inventory_events.customer_id = webhooks.customer_id and inventory_events.id > webhooks.last_event_id)
+		  order by next_attempt_at limit $3)
+		  and enabled and (lease_until is null or lease_until < now())
+		  returning *`
+
+	webhooks := make([]*Webhook, 0)
+	err := pg.db.Select(&webhooks, query, request.Owner, int64(request.Lease/time.Millisecond), request.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhooksResponse{webhooks}, nil
+}
+
+// UpdateWebhook saves a claimed webhook's cursor, failures and lease. It
+// changes nothing if the webhook's lease has since passed to another owner.
+func (pg *Postgres) UpdateWebhook(webhook *Webhook) error {
+	query := `update webhooks set (enabled, failures, last_event_id, next_attempt_at, lease_until, disabled_at, disabled_reason) =
+		  (:enabled, :failures, :last_event_id, :next_attempt_at, :lease_until, :disabled_at, :disabled_reason)
+		  where id = :id and lease_owner = :lease_owner`
+
+	_, err := pg.db.NamedExec(query, webhook)
+	return err
+}
+
+func (pg *Postgres) PutWebhookDelivery(delivery *WebhookDelivery) error {
+	query := `insert into webhook_deliveries (webhook_id, event_id, action, attempt, succeeded, status_code, error, duration_ms)
+		  values (:webhook_id, :event_id, :action, :attempt, :succeeded, :status_code, :error, :duration_ms)
+		  returning id, created_at`
+
+	rows, err := pg.db.NamedQuery(query, delivery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := rows.Scan(&delivery.Id, &delivery.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ListWebhookDeliveries returns a webhook's newest deliveries first.
+func (pg *Postgres) ListWebhookDeliveries(request *WebhookDeliveriesRequest) (*WebhookDeliveriesResponse, error) {
+	w := &where{}
+	w.add("webhook_deliveries.webhook_id = %s", request.WebhookId)
+	w.addIf("webhooks.customer_id = %s", request.CustomerId)
+
+	limit := request.Limit
+	if limit <= 0 {
+		limit = defaultDeliveryLimit
+	}
+
+	deliveries := make([]*WebhookDelivery, 0)
+	err := pg.db.Select(&deliveries, "select webhook_deliveries.* from webhook_deliveries join webhooks on webhooks.id = webhook_deliveries.webhook_id"+w.String()+fmt.Sprintf(" order by webhook_deliveries.id desc limit %d", limit), w.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookDeliveriesResponse{deliveries}, nil
+}
+
+func (pg *Postgres) PurgeWebhookDeliveries(request *PurgeWebhookDeliveriesRequest) (*PurgeWebhookDeliveriesResponse, error) {
+	result, err := pg.db.Exec("delete from webhook_deliveries where created_at < $1", request.Before)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PurgeWebhookDeliveriesResponse{Deleted: deleted}, nil
+}
+
+// entityTables maps store types to the table holding their entities and the
+// column holding their ids. Instances and groups are also filtered by type.
+var entityTables = map[string]struct {
+	table string
+	id    string
+	typed bool
+}{
+	InstanceStoreType:         {"instances", "id", true},
+	DBInstanceStoreType:       {"instances", "id", true},
+	SecurityGroupStoreType:    {"groups", "name", true},
+	DBSecurityGroupStoreType:  {"groups", "name", true},
+	AutoScalingGroupStoreType: {"groups", "name", true},
+	ELBStoreType:              {"groups", "name", true},
+	RouteTableStoreType:       {"route_tables", "id", false},
+	SubnetStoreType:           {"subnets", "id", false},
+}
+
+// baselinedEntity is the part of an entity a baseline is evaluated against.
+type baselinedEntity struct {
+	Region    string          `db:"region"`
+	AccountId string          `db:"account_id"`
+	Data      json.RawMessage `db:"data"`
+}
+
+// getBaselinedEntity finds the entity a baseline request names. If the
+// region or account are left out and more than one entity matches, it
+// returns ErrAmbiguousEntity.
+func (pg *Postgres) getBaselinedEntity(request *BaselineRequest) (*baselinedEntity, error) {
+	t, ok := entityTables[request.EntityType]
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+
+	w := &where{}
+	w.add("customer_id = %s", request.CustomerId)
+	w.add(t.id+" = %s", request.EntityId)
+	if t.typed {
+		w.add("type = %s", request.EntityType)
+	}
+	w.addIf("region = %s", request.Region)
+	w.addIf("account_id = %s", request.AccountId)
+
+	entity := new(baselinedEntity)
+	err := getUnique(pg.db, entity, "select region, account_id, data from "+t.table+w.String(), w.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+const putBaselineQuery = `with update_baselines as
+	  (update baselines set (expected, exact, drifted, differences, evaluated_at) = (:expected, :exact, :drifted, :differences, :evaluated_at)
+	  where customer_id = :customer_id and entity_type = :entity_type and entity_id = :entity_id and region = :region and account_id = :account_id returning *),
+	  insert_baselines as (insert into baselines (customer_id, entity_type, entity_id, region, account_id, expected, exact, drifted, differences, evaluated_at)
+	  select :customer_id, :entity_type, :entity_id, :region, :account_id, :expected, :exact, :drifted, :differences, :evaluated_at
+	  where not exists (select 1 from update_baselines) returning *)
+	  select * from update_baselines union all select * from insert_baselines`
+
+// PutBaseline creates or replaces an entity's baseline and evaluates it
+// against the entity's current data, if the entity exists. A snapshot
+// requires the entity, returning sql.ErrNoRows without it. When the request
+// leaves out the region or account, the entity's are used.
+func (pg *Postgres) PutBaseline(request *PutBaselineRequest) (*BaselineResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	entity, err := pg.getBaselinedEntity(&request.BaselineRequest)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if entity == nil && request.Snapshot {
+		return nil, sql.ErrNoRows
+	}
+
+	baseline := &Baseline{
+		CustomerId: request.CustomerId,
+		EntityType: request.EntityType,
+		EntityId:   request.EntityId,
+		Region:     request.Region,
+		AccountId:  request.AccountId,
+		Expected:   request.Expected,
+		Exact:      request.Exact,
+	}
+
+	if request.Snapshot {
+		baseline.Expected = entity.Data
+		baseline.Exact = true
+	}
+
+	if entity != nil {
+		baseline.Region = entity.Region
+		baseline.AccountId = entity.AccountId
+		if err = baseline.Evaluate(entity.Data); err != nil {
+			return nil, err
+		}
+	} else if _, err = Diff(baseline.Expected, []byte("{}"), baseline.Exact); err != nil {
+		return nil, err
+	}
+
+	rows, err := pg.db.NamedQuery(putBaselineQuery, baseline)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := rows.StructScan(baseline); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &BaselineResponse{baseline}, nil
+}
+
+func (pg *Postgres) GetBaseline(request *BaselineRequest) (*BaselineResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	w := &where{}
+	w.add("customer_id = %s", request.CustomerId)
+	w.add("entity_type = %s", request.EntityType)
+	w.add("entity_id = %s", request.EntityId)
+	w.addIf("region = %s", request.Region)
+	w.addIf("account_id = %s", request.AccountId)
+
+	baseline := new(Baseline)
+	err := getUnique(pg.db, baseline, "select * from baselines"+w.String(), w.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BaselineResponse{baseline}, nil
+}
+
+func (pg *Postgres) ListBaselines(request *BaselinesRequest) (*BaselinesResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	w := &where{}
+	w.add("customer_id = %s", request.CustomerId)
+	w.addIf("entity_type = %s", request.EntityType)
+	if request.Drifted {
+		w.conditions = append(w.conditions, "drifted")
+	}
+
+	baselines := make([]*Baseline, 0)
+	err := pg.db.Select(&baselines, "select * from baselines"+w.String()+" order by entity_type, entity_id, account_id, region", w.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BaselinesResponse{baselines}, nil
+}
+
+// DeleteBaseline deletes the baselines a request names, returning
+// sql.ErrNoRows if there are none.
+func (pg *Postgres) DeleteBaseline(request *BaselineRequest) error {
+	if request.CustomerId == "" {
+		return ErrMissingCustomerId
+	}
+
+	w := &where{}
+	w.add("customer_id = %s", request.CustomerId)
+	w.add("entity_type = %s", request.EntityType)
+	w.add("entity_id = %s", request.EntityId)
+	w.addIf("region = %s", request.Region)
+	w.addIf("account_id = %s", request.AccountId)
+
+	result, err := pg.db.Exec("delete from baselines"+w.String(), w.args...)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// loadBaselines reads a customer's baselines for PutEntities and
+// RestoreCustomer, keyed by entity type and id.
+func loadBaselines(tx *sqlx.Tx, customerId string) (map[string][]*Baseline, error) {
+	baselines := make([]*Baseline, 0)
+	if err := tx.Select(&baselines, "select * from baselines where customer_id = $1", customerId); err != nil {
+		return nil, err
+	}
+
+	byEntity := make(map[string][]*Baseline, len(baselines))
+	for _, b := range baselines {
+		key := b.EntityType + "/" + b.EntityId
+		byEntity[key] = append(byEntity[key], b)
+	}
+
+	return byEntity, nil
+}
+
+// evaluateBaselines re-evaluates the baselines of an entity whose data just
+// changed, only writing those whose result did.
+func evaluateBaselines(q queryer, baselines map[string][]*Baseline, entityType, entityId, region, accountId string, data []byte) error {
+	for _, b := range baselines[entityType+"/"+entityId] {
+		if !b.Applies(region, accountId) {
+			continue
+		}
+
+		evaluated := b.EvaluatedAt != nil
+		drifted, differences := b.Drifted, b.Differences
+
+		if err := b.Evaluate(data); err != nil {
+			return err
+		}
+
+		if evaluated && b.Drifted == drifted && b.Differences.Equal(differences) {
+			continue
+		}
+
+		_, err := q.NamedExec(`update baselines set (drifted, differences, evaluated_at) = (:drifted, :differences, :evaluated_at)
+			where customer_id = :customer_id and entity_type = :entity_type and entity_id = :entity_id and region = :region and account_id = :account_id`, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (pg *Postgres) listInstances(request *InstancesRequest) ([]*Instance, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	w := &where{}
+	w.add("instances.customer_id = %s", request.CustomerId)
+	w.addIf("instances.region = %s", request.Region)
+	w.addIf("instances.account_id = %s", request.AccountId)
+
+	if request.GroupId != "" {
+		w.add("exists (select 1 from groups_instances where groups_instances.customer_id = instances.customer_id and groups_instances.region = instances.region and groups_instances.account_id = instances.account_id and groups_instances.instance_id = instances.id and groups_instances.group_name = %s)", request.GroupId)
+	} else {
+		w.addIf("instances.type = %s", request.Type)
+	}
+
+	if !request.ChangedSince.IsZero() {
+		w.add("instances.changed_at > %s", request.ChangedSince)
+	}
+
+	instances := make([]*Instance, 0)
+	err := pg.db.Select(&instances, "select instances.* from instances"+w.String(), w.args...)
+
+	return instances, err
+}
+
+// The put queries update a row if it exists and insert it otherwise,
+// returning whether they inserted it and whether its data changed. Postgres
+// before 9.5 has no upsert. A row whose data hash hasn't changed only has its
+// last_seen_at moved, so unchanged snapshots don't rewrite the data or move
+// updated_at. Instances and groups store their summary too, filled in on
+// rows written before summaries were.
+const (
+	dataHash = "md5(cast(cast(:data as jsonb) as text))"
+
+	putInstanceQuery = `with seen_instances as
+		  (update instances set last_seen_at = now(), summary = coalesce(summary, cast(:summary as jsonb)) where id = :id and customer_id = :customer_id and region = :region and account_id = :account_id and type = :type and data_hash = ` + dataHash + ` returning id),
+		  update_instances as (update instances set (type, data, data_hash, summary, last_seen_at) = (:type, :data, ` + dataHash + `, cast(:summary as jsonb), now())
+		  where id = :id and customer_id = :customer_id and region = :region and account_id = :account_id and not (type = :type and data_hash = ` + dataHash + `) returning id),
+		  insert_instances as (insert into instances (id, customer_id, region, account_id, type, data, data_hash, summary) select :id as id, :customer_id as customer_id,
+		  :region as region, :account_id as account_id, :type as type, :data as data, ` + dataHash + ` as data_hash, cast(:summary as jsonb) as summary
+		  where not exists (select id from seen_instances limit 1) and not exists (select id from update_instances limit 1) returning id)
+		  select false as created, false as changed from seen_instances union all select false, true from update_instances union all select true, true from insert_instances;
+		  `
+
+	putGroupQuery = `with seen_groups as
+		  (update groups set last_seen_at = now(), summary = coalesce(summary, cast(:summary as jsonb)) where name = :name and customer_id = :customer_id and region = :region and account_id = :account_id and type = :type and data_hash = ` + dataHash + ` returning name),
+		  update_groups as (update groups set (type, data, data_hash, summary, last_seen_at) = (:type, :data, ` + dataHash + `, cast(:summary as jsonb), now())
+		  where name = :name and customer_id = :customer_id and region = :region and account_id = :account_id and not (type = :type and data_hash = ` + dataHash + `) returning name),
+		  insert_groups as (insert into groups (name, customer_id, region, account_id, type, data, data_hash, summary) select :name as name, :customer_id as customer_id,
+		  :region as region, :account_id as account_id, :type as type, :data as data, ` + dataHash + ` as data_hash, cast(:summary as jsonb) as summary
+		  where not exists (select name from seen_groups limit 1) and not exists (select name from update_groups limit 1) returning name)
+		  select false as created, false as changed from seen_groups union all select false, true from update_groups union all select true, true from insert_groups;
+		  `
+
+	putRouteTableQuery = `with seen_route_tables as
+		  (update route_tables set last_seen_at = now() where customer_id = :customer_id and region = :region and account_id = :account_id and id = :id and data_hash = ` + dataHash + ` returning id),
+		  update_route_tables as (update route_tables set (data, data_hash, last_seen_at) = (:data, ` + dataHash + `, now())
+		  where customer_id = :customer_id and region = :region and account_id = :account_id and id = :id and data_hash <> ` + dataHash + ` returning id),
+		  insert_route_tables as (insert into route_tables (id, customer_id, region, account_id, data, data_hash) select :id as id,
+		  :customer_id as customer_id, :region as region, :account_id as account_id, :data as data, ` + dataHash + ` as data_hash
+		  where not exists (select id from seen_route_tables limit 1) and not exists (select id from update_route_tables limit 1) returning id)
+		  select false as created, false as changed from seen_route_tables union all select false, true from update_route_tables union all select true, true from insert_route_tables;
+		  `
+
+	putSubnetQuery = `with seen_subnets as
+		  (update subnets set last_seen_at = now() where customer_id = :customer_id and region = :region and account_id = :account_id and id = :id and data_hash = ` + dataHash + ` returning id),
+		  update_subnets as (update subnets set (data, data_hash, last_seen_at) = (:data, ` + dataHash + `, now())
+		  where customer_id = :customer_id and region = :region and account_id = :account_id and id = :id and data_hash <> ` + dataHash + ` returning id),
+		  insert_subnets as (insert into subnets (id, customer_id, region, account_id, data, data_hash) select :id as id,
+		  :customer_id as customer_id, :region as region, :account_id as account_id, :data as data, ` + dataHash + ` as data_hash
+		  where not exists (select id from seen_subnets limit 1) and not exists (select id from update_subnets limit 1) returning id)
+		  select false as created, false as changed from seen_subnets union all select false, true from update_subnets union all select true, true from insert_subnets;
+		  `
+)
+
+func putInstance(q queryer, instance *Instance) (bool, bool, error) {
+	if err := instance.summarize(); err != nil {
+		return false, false, err
+	}
+
+	created, changed, err := upsert(q, putInstanceQuery, instance)
+	if err != nil {
+		return false, false, err
+	}
+
+	for _, group := range instance.Groups {
+		err := ensureGroup(q, group)
+		if err != nil {
+			return false, false, err
+		}
+
+		err = ensureMembership(q, group, instance)
+		if err != nil {
+			return false, false, err
+		}
+	}
+
+	if instance.Type == InstanceStoreType {
+		if err = deriveGroups(q, instance); err != nil {
+			return false, false, err
+		}
+	}
+
+	return created, changed, nil
+}
+
+func putGroup(q queryer, group *Group) (bool, bool, error) {
+	if err := group.summarize(); err != nil {
+		return false, false, err
+	}
+
+	created, changed, err := upsert(q, putGroupQuery, group)
+	if err != nil {
+		return false, false, err
+	}
+
+	for _, instance := range group.Instances {
+		err := ensureInstance(q, instance)
+		if err != nil {
+			return false, false, err
+		}
+
+		err = ensureMembership(q, group, instance)
+		if err != nil {
+			return false, false, err
+		}
+
+		// the group's tags and launch configurations are its instances'
+		if group.Type == AutoScalingGroupStoreType {
+			if err = deriveGroups(q, instance); err != nil {
+				return false, false, err
+			}
+		}
+	}
+
+	return created, changed, nil
+}
+
+// deriveGroups puts the tag and attribute groups an EC2 instance belongs to,
+// going by its stored data and that of its autoscaling groups, and removes
+// it from those it no longer belongs to. Derived groups left without members
+// are expired like any other unseen group.
+func deriveGroups(q queryer, instance *Instance) error {
+	stored := make([]*Instance, 0, 1)
+	err := q.Select(&stored, "select * from instances where customer_id = $1 and region = $2 and account_id = $3 and id = $4 and type = $5", instance.CustomerId, instance.Region, instance.AccountId, instance.Id, InstanceStoreType)
+	if err != nil || len(stored) == 0 {
+		return err
+	}
+
+	autoscalingGroups := make([]*Group, 0)
+	err = q.Select(&autoscalingGroups, "select groups.* from groups join groups_instances on groups_instances.customer_id = groups.customer_id and groups_instances.region = groups.region and groups_instances.account_id = groups.account_id and groups_instances.group_name = groups.name where groups.customer_id = $1 and groups.region = $2 and groups.account_id = $3 and groups_instances.instance_id = $4 and groups.type = $5", instance.CustomerId, instance.Region, instance.AccountId, instance.Id, AutoScalingGroupStoreType)
+	if err != nil {
+		return err
+	}
+
+	groups, err := DeriveGroups(stored[0], autoscalingGroups)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, len(groups))
+	for i, group := range groups {
+		if _, _, err = putGroup(q, group); err != nil {
+			return err
+		}
+		names[i] = group.Name
+	}
+
+	w := &where{}
+	w.add("customer_id = %s", instance.CustomerId)
+	w.add("region = %s", instance.Region)
+	w.add("account_id = %s", instance.AccountId)
+	w.add("instance_id = %s", instance.Id)
+	w.addNotIn("group_name", names)
+	w.conditions = append(w.conditions, fmt.Sprintf("group_name in (select name from groups where customer_id = $1 and region = $2 and account_id = $3 and type in ('%s', '%s'))", TagStoreType, AttributeStoreType))
+
+	_, err = q.Exec("delete from groups_instances"+w.String(), w.args...)
+	return err
+}
+
+func putCustomer(q queryer, customer *Customer) error {
+	query := "with update_customers as (update customers set last_sync = :last_sync where id = :id returning id), insert_customers as (insert into customers (id, last_sync) select :id as id, :last_sync as last_sync where not exists (select id from update_customers limit 1) returning id) select * from update_customers union all select * from insert_customers;"
+	_, err := q.NamedExec(query, customer)
+	return err
+}
+
+func putRouteTable(q queryer, routeTable *RouteTable) (bool, bool, error) {
+	return upsert(q, putRouteTableQuery, routeTable)
+}
+
+func putSubnet(q queryer, subnet *Subnet) (bool, bool, error) {
+	return upsert(q, putSubnetQuery, subnet)
+}
+
+// queryer is a *sqlx.DB or *sqlx.Tx, so entities can be written with or
+// without a transaction.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	NamedExec(query string, arg interface{}) (sql.Result, error)
+	NamedQuery(query string, arg interface{}) (*sqlx.Rows, error)
+	Select(dest interface{}, query string, args ...interface{}) error
+}
+
+// upsert runs one of the put queries, reporting whether it inserted a new
+// row rather than updating an existing one, and whether the row's data
+// changed, which it always has for a new row.
+func upsert(q queryer, query string, arg interface{}) (created, changed bool, err error) {
+	rows, err := q.NamedQuery(query, arg)
+	if err != nil {
+		return false, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := rows.Scan(&created, &changed); err != nil {
+			return false, false, err
+		}
+	}
+
+	return created, changed, rows.Err()
+}
+
+func (pg *Postgres) expireEntities(customerId string, lastSync int64) error {
+	lastSyncTime := time.Unix(lastSync, 0).Add(time.Duration(-1*pg.expireThreshold) * time.Second)
+
+	_, err := pg.ExpireEntities(&ExpireRequest{CustomerId: customerId, Before: lastSyncTime})
+	return err
+}
+
+// ExpireEntities deletes a customer's groups and instances that haven't been
+// seen in a sync since request.Before.
+func (pg *Postgres) ExpireEntities(request *ExpireRequest) (*ExpireResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	expiryRuns.Inc(request.CustomerId)
+
+	response := &ExpireResponse{CustomerId: request.CustomerId}
+	deletes := []struct {
+		table string
+		count *int64
+	}{
+		{"groups", &response.Groups},
+		{"instances", &response.Instances},
+	}
+
+	for _, d := range deletes {
+		result, err := pg.db.Exec("delete from "+d.table+" where customer_id = $1 and last_seen_at < $2", request.CustomerId, request.Before)
+		if err != nil {
+			return nil, err
+		}
+
+		if *d.count, err = result.RowsAffected(); err == nil {
+			expiredRows.Add(float64(*d.count), request.CustomerId, d.table)
+		}
+	}
+
+	return response, nil
+}
+
+func ensureInstance(q queryer, instance *Instance) error {
+	_, err := q.Exec("insert into instances (id, customer_id, region, account_id, type, data, data_hash) select ($1::varchar(128)) as id, $2 as customer_id, ($3::varchar(32)) as region, ($4::varchar(32)) as account_id, $5 as type, $6 as data, md5($6::jsonb::text) as data_hash where not exists (select id from instances where id = $1 and customer_id = $2 and region = $3 and account_id = $4)", instance.Id, instance.CustomerId, instance.Region, instance.AccountId, instance.Type, instance.Data)
+	return err
+}
+
+func ensureGroup(q queryer, group *Group) error {
+	_, err := q.Exec("insert into groups (name, customer_id, region, account_id, type, data, data_hash) select ($1::varchar(128)) as name, $2 as customer_id, ($3::varchar(32)) as region, ($4::varchar(32)) as account_id, $5 as type, $6 as data, md5($6::jsonb::text) as data_hash where not exists (select name from groups where name = $1 and customer_id = $2 and region = $3 and account_id = $4)", group.Name, group.CustomerId, group.Region, group.AccountId, group.Type, group.Data)
+	return err
+}
+
+const ensureMembershipQuery = "insert into groups_instances (customer_id, region, account_id, group_name, instance_id) select $1 as customer_id, ($2::varchar(32)) as region, ($3::varchar(32)) as account_id, ($4::varchar(128)) as group_name, ($5::varchar(128)) as instance_id where not exists (select instance_id from groups_instances where customer_id = $1 and region = $2 and account_id = $3 and group_name = $4 and instance_id = $5)"
+
+func ensureMembership(q queryer, group *Group, instance *Instance) error {
+	_, err := q.Exec(ensureMembershipQuery, group.CustomerId, group.Region, group.AccountId, group.Name, instance.Id)
+	return err
+}
+
+// viewInstances puts instances in a view, leaving them as they are for the
+// data view.
+func viewInstances(view string, instances []*Instance) error {
+	if view != SummaryView {
+		return nil
+	}
+
+	for _, instance := range instances {
+		if err := instance.viewSummary(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// viewGroups puts groups in a view, leaving them as they are for the data
+// view.
+func viewGroups(view string, groups []*Group) error {
+	if view != SummaryView {
+		return nil
+	}
+
+	for _, group := range groups {
+		if err := group.viewSummary(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newInstanceResponse(instance *Instance) *InstanceResponse {
+	return &InstanceResponse{
+		Instance:  instance,
+		Region:    instance.Region,
+		AccountId: instance.AccountId,
+	}
 }
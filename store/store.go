@@ -1,6 +1,7 @@
 package store
 
 import (
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,46 +11,110 @@ import (
 	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
 	opsee_aws_elb "github.com/opsee/basic/schema/aws/elb"
 	opsee_aws_rds "github.com/opsee/basic/schema/aws/rds"
+	"strings"
 	"time"
 )
 
 type Store interface {
 	Start()
+	Stop(timeout time.Duration) error
 	PutEntity(interface{}) (*EntityResponse, error)
+	PutEntities(*PutEntitiesRequest) (*PutEntitiesResponse, error)
 	GetInstance(*InstanceRequest) (*InstanceResponse, error)
 	ListInstances(*InstancesRequest) (*InstancesResponse, error)
 	CountInstances(*InstancesRequest) (*CountResponse, error)
 	GetGroup(*GroupRequest) (*GroupResponse, error)
 	GetCustomer(*CustomerRequest) (*CustomerResponse, error)
+	ListCustomers() (*CustomersResponse, error)
+	GetCustomerSummary(*CustomerRequest) (*CustomerSummaryResponse, error)
+	DeleteCustomer(*CustomerRequest) (*DeleteCustomerResponse, error)
+	ExportCustomer(*CustomerRequest, *ArchiveWriter) error
+	RestoreCustomer(*RestoreRequest) (*RestoreResponse, error)
+	UpdateStaleness(*StalenessRequest) (*StalenessResponse, error)
+	ExpireEntities(*ExpireRequest) (*ExpireResponse, error)
+	PutDeadLetter(*DeadLetter) error
+	UpdateDeadLetter(*DeadLetter) error
+	GetDeadLetter(*DeadLetterRequest) (*DeadLetterResponse, error)
+	ListDeadLetters(*DeadLettersRequest) (*DeadLettersResponse, error)
+	DeleteDeadLetter(*DeadLetterRequest) error
+	PurgeDeadLetters(*DeadLettersRequest) (*PurgeDeadLettersResponse, error)
+	SummarizeDeadLetters() (*DeadLetterSummaryResponse, error)
+	ListIngestPauses() (*IngestPausesResponse, error)
+	PutIngestPause(*IngestPause) error
+	DeleteIngestPause(*IngestPause) error
+	ListInventoryEvents(*InventoryEventsRequest) (*InventoryEventsResponse, error)
+	LastInventoryEventId(*CustomerRequest) (int64, error)
+	PurgeInventoryEvents(*PurgeInventoryEventsRequest) (*PurgeInventoryEventsResponse, error)
+	PutWebhook(*Webhook) error
+	GetWebhook(*WebhookRequest) (*WebhookResponse, error)
+	ListWebhooks(*WebhooksRequest) (*WebhooksResponse, error)
+	DeleteWebhook(*WebhookRequest) error
+	EnableWebhook(*WebhookRequest) (*WebhookResponse, error)
+	ClaimWebhooks(*ClaimWebhooksRequest) (*WebhooksResponse, error)
+	UpdateWebhook(*Webhook) error
+	PutWebhookDelivery(*WebhookDelivery) error
+	ListWebhookDeliveries(*WebhookDeliveriesRequest) (*WebhookDeliveriesResponse, error)
+	PurgeWebhookDeliveries(*PurgeWebhookDeliveriesRequest) (*PurgeWebhookDeliveriesResponse, error)
+	PutBaseline(*PutBaselineRequest) (*BaselineResponse, error)
+	GetBaseline(*BaselineRequest) (*BaselineResponse, error)
+	ListBaselines(*BaselinesRequest) (*BaselinesResponse, error)
+	DeleteBaseline(*BaselineRequest) error
 	ListGroups(*GroupsRequest) (*GroupsResponse, error)
+	ListMemberships(*MembershipsRequest) (*MembershipsResponse, error)
+	ListSubnets(*SubnetsRequest) (*SubnetsResponse, error)
+	ListRouteTables(*RouteTablesRequest) (*RouteTablesResponse, error)
+	ListTags(*TagsRequest) (*TagsResponse, error)
+	Lookup(*LookupRequest) (*LookupResponse, error)
 	CountGroups(*GroupsRequest) (*CountResponse, error)
 }
 
+// InstanceRequest gets one instance. GetInstance doesn't look at
+// ChangedSince, it's for callers to compare with the instance's ChangedAt.
 type InstanceRequest struct {
-	CustomerId string `json:"customer_id"`
-	InstanceId string `json:"instance_id"`
-	Type       string `json:"type"`
+	CustomerId   string    `json:"customer_id"`
+	InstanceId   string    `json:"instance_id"`
+	Type         string    `json:"type"`
+	Region       string    `json:"region"`
+	AccountId    string    `json:"account_id"`
+	ChangedSince time.Time `json:"changed_since"`
+	View         string    `json:"view"`
 }
 
 type InstancesRequest struct {
-	CustomerId string `json:"customer_id"`
-	GroupId    string `json:"group_id"`
-	Type       string `json:"type"`
+	CustomerId   string    `json:"customer_id"`
+	GroupId      string    `json:"group_id"`
+	Type         string    `json:"type"`
+	Region       string    `json:"region"`
+	AccountId    string    `json:"account_id"`
+	ChangedSince time.Time `json:"changed_since"`
+	View         string    `json:"view"`
 }
 
+// GroupRequest gets one group. GetGroup doesn't look at ChangedSince,
+// it's for callers to compare with the group's ChangedAt.
 type GroupRequest struct {
-	CustomerId string `json:"customer_id"`
-	GroupId    string `json:"group_id"`
-	Type       string `json:"type"`
+	CustomerId   string    `json:"customer_id"`
+	GroupId      string    `json:"group_id"`
+	Type         string    `json:"type"`
+	Region       string    `json:"region"`
+	AccountId    string    `json:"account_id"`
+	ChangedSince time.Time `json:"changed_since"`
+	View         string    `json:"view"`
 }
 
 type GroupsRequest struct {
-	CustomerId string `json:"customer_id"`
-	Type       string `json:"type"`
+	CustomerId   string    `json:"customer_id"`
+	Type         string    `json:"type"`
+	Region       string    `json:"region"`
+	AccountId    string    `json:"account_id"`
+	ChangedSince time.Time `json:"changed_since"`
+	View         string    `json:"view"`
 }
 
 type InstanceResponse struct {
-	Instance *Instance `json:"instance"`
+	Instance  *Instance `json:"instance"`
+	Region    string    `json:"region,omitempty"`
+	AccountId string    `json:"account_id,omitempty"`
 }
 
 type InstancesResponse struct {
@@ -60,12 +125,52 @@ type GroupResponse struct {
 	Group         *Group              `json:"group"`
 	Instances     []*InstanceResponse `json:"instances,omitempty"`
 	InstanceCount int                 `json:"instance_count"`
+	Region        string              `json:"region,omitempty"`
+	AccountId     string              `json:"account_id,omitempty"`
 }
 
 type GroupsResponse struct {
 	Groups []*GroupResponse `json:"groups"`
 }
 
+type MembershipsRequest struct {
+	CustomerId string `json:"customer_id"`
+	Region     string `json:"region"`
+	AccountId  string `json:"account_id"`
+}
+
+type MembershipsResponse struct {
+	Memberships []*Membership `json:"memberships"`
+}
+
+// Membership puts an instance in a group of the same region and account.
+type Membership struct {
+	Region     string `json:"region"`
+	AccountId  string `json:"account_id" db:"account_id"`
+	GroupName  string `json:"group_name" db:"group_name"`
+	InstanceId string `json:"instance_id" db:"instance_id"`
+}
+
+type SubnetsRequest struct {
+	CustomerId string `json:"customer_id"`
+	Region     string `json:"region"`
+	AccountId  string `json:"account_id"`
+}
+
+type SubnetsResponse struct {
+	Subnets []*Subnet `json:"subnets"`
+}
+
+type RouteTablesRequest struct {
+	CustomerId string `json:"customer_id"`
+	Region     string `json:"region"`
+	AccountId  string `json:"account_id"`
+}
+
+type RouteTablesResponse struct {
+	RouteTables []*RouteTable `json:"route_tables"`
+}
+
 type CustomerRequest struct {
 	Id string `json:"id"`
 }
@@ -74,8 +179,116 @@ type CustomerResponse struct {
 	Customer *Customer `json:"customer"`
 }
 
+type ExpireRequest struct {
+	CustomerId string    `json:"customer_id"`
+	Before     time.Time `json:"before"`
+}
+
+type ExpireResponse struct {
+	CustomerId string `json:"customer_id"`
+	Groups     int64  `json:"groups"`
+	Instances  int64  `json:"instances"`
+}
+
+type StalenessRequest struct {
+	StaleAfter time.Duration `json:"stale_after"`
+}
+
+// StalenessResponse holds the customers whose stale flag changed, and every
+// customer's last sync once it did.
+type StalenessResponse struct {
+	Stale     []*Customer `json:"stale"`
+	Recovered []*Customer `json:"recovered"`
+	Customers []*Customer `json:"customers"`
+}
+
+type CustomersResponse struct {
+	Customers []*CustomerSummary `json:"customers"`
+}
+
+type CustomerSummaryResponse struct {
+	Customer *CustomerSummary `json:"customer"`
+}
+
+// DeleteCustomerResponse counts what was purged. Customer is false when
+// there was no customers row, only orphaned entities.
+type DeleteCustomerResponse struct {
+	Id          string `json:"id"`
+	Customer    bool   `json:"customer"`
+	Instances   int64  `json:"instances"`
+	Groups      int64  `json:"groups"`
+	Memberships int64  `json:"memberships"`
+	Subnets     int64  `json:"subnets"`
+	RouteTables int64  `json:"route_tables"`
+	Webhooks    int64  `json:"webhooks"`
+	Baselines   int64  `json:"baselines"`
+	DeadLetters int64  `json:"dead_letters"`
+	Events      int64  `json:"events"`
+	Pauses      int64  `json:"pauses"`
+}
+
+type RestoreRequest struct {
+	CustomerId string
+	Archive    *ArchiveReader
+}
+
+// RestoreResponse reports how many records of each kind were restored, and
+// the customer they were exported from.
+type RestoreResponse struct {
+	Id               string `json:"id"`
+	SourceCustomerId string `json:"source_customer_id"`
+	Instances        int64  `json:"instances"`
+	Groups           int64  `json:"groups"`
+	Memberships      int64  `json:"memberships"`
+	Subnets          int64  `json:"subnets"`
+	RouteTables      int64  `json:"route_tables"`
+}
+
+type DeadLetterRequest struct {
+	Id int64 `json:"id"`
+}
+
+// DeadLettersRequest filters dead letters by customer and entity type. Limit
+// only applies to listing them.
+type DeadLettersRequest struct {
+	CustomerId string `json:"customer_id"`
+	EntityType string `json:"entity_type"`
+	Limit      int    `json:"limit"`
+}
+
+type DeadLetterResponse struct {
+	DeadLetter *DeadLetter `json:"dead_letter"`
+}
+
+type DeadLettersResponse struct {
+	DeadLetters []*DeadLetter `json:"dead_letters"`
+}
+
+type PurgeDeadLettersResponse struct {
+	Deleted int64 `json:"deleted"`
+}
+
+type DeadLetterSummaryResponse struct {
+	Types []*DeadLetterTypeSummary `json:"types"`
+}
+
+type IngestPausesResponse struct {
+	Pauses []*IngestPause `json:"pauses"`
+}
+
+// PutEntitiesRequest is a batch of entities belonging to one customer.
+type PutEntitiesRequest struct {
+	CustomerId string
+	Entities   []interface{}
+}
+
+type PutEntitiesResponse struct {
+	Entities []*EntityResponse `json:"entities"`
+}
+
 type EntityResponse struct {
-	Entity interface{} `json:"entity"`
+	Entity  interface{} `json:"entity"`
+	Created bool        `json:"created"`
 }
 
 type CountResponse struct {
@@ -85,48 +298,327 @@ type CountResponse struct {
 type Customer struct {
 	Id        string    `json:"id"`
 	LastSync  time.Time `json:"last_sync" db:"last_sync"`
+	Stale     bool      `json:"stale"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
 }
 
+// DeadLetter is an NSQ message that couldn't be stored. CustomerId,
+// EntityType, Region and AccountId are empty if the message couldn't be
+// decoded far enough to know them.
+type DeadLetter struct {
+	Id         int64     `json:"id"`
+	CustomerId string    `json:"customer_id" db:"customer_id"`
+	EntityType string    `json:"entity_type" db:"entity_type"`
+	Region     string    `json:"region"`
+	AccountId  string    `json:"account_id" db:"account_id"`
+	MessageId  string    `json:"message_id" db:"message_id"`
+	Body       []byte    `json:"-"`
+	Error      string    `json:"error"`
+	Attempts   int       `json:"attempts"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// MarshalJSON includes the message body when it was loaded, inline if it is
+// json and as a string otherwise.
+func (dl *DeadLetter) MarshalJSON() ([]byte, error) {
+	type deadLetter DeadLetter
+
+	var body interface{}
+	if json.Valid(dl.Body) {
+		body = json.RawMessage(dl.Body)
+	} else if len(dl.Body) > 0 {
+		body = string(dl.Body)
+	}
+
+	return json.Marshal(struct {
+		*deadLetter
+		Body interface{} `json:"body,omitempty"`
+	}{(*deadLetter)(dl), body})
+}
+
+// DeadLetterTypeSummary counts the dead letters of one entity type.
+type DeadLetterTypeSummary struct {
+	EntityType string    `json:"entity_type" db:"entity_type"`
+	Count      int64     `json:"count"`
+	Customers  int64     `json:"customers"`
+	Oldest     time.Time `json:"oldest"`
+	Newest     time.Time `json:"newest"`
+}
+
+// IngestPause stops the consumer storing messages, either all of them, a
+// customer's (Value is the customer id) or an entity type's (Value is the
+// type, e.g. Instance).
+type IngestPause struct {
+	Scope     string    `json:"scope"`
+	Value     string    `json:"value,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// CustomerSummary is a customer with the size and age of its inventory.
+type CustomerSummary struct {
+	Customer
+	InstanceCount   int   `json:"instance_count" db:"instance_count"`
+	GroupCount      int   `json:"group_count" db:"group_count"`
+	SubnetCount     int   `json:"subnet_count" db:"subnet_count"`
+	RouteTableCount int   `json:"route_table_count" db:"route_table_count"`
+	Staleness       int64 `json:"staleness_seconds" db:"-"`
+}
+
 type Instance struct {
 	Id         string    `json:"id"`
 	CustomerId string    `json:"customer_id" db:"customer_id"`
+	Region     string    `json:"region"`
+	AccountId  string    `json:"account_id" db:"account_id"`
 	Type       string    `json:"type"`
 	Data       []byte    `json:"data"`
 	Groups     []*Group  `json:"-" db:""`
+	Summary    *Summary  `json:"-" db:"summary"`
 	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	DataHash   string    `json:"-" db:"data_hash"`
+	LastSeenAt time.Time `json:"last_seen_at" db:"last_seen_at"`
+	ChangedAt  time.Time `json:"changed_at" db:"changed_at"`
 	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
 }
 
 type Group struct {
 	Name          string      `json:"name"`
 	CustomerId    string      `json:"customer_id" db:"customer_id"`
+	Region        string      `json:"region"`
+	AccountId     string      `json:"account_id" db:"account_id"`
 	Type          string      `json:"type"`
 	Data          []byte      `json:"data"`
 	InstanceCount int         `json:"instance_count" db:"instance_count"`
 	Instances     []*Instance `json:"-" db:""`
+	Summary       *Summary    `json:"-" db:"summary"`
 	CreatedAt     time.Time   `json:"created_at" db:"created_at"`
+	DataHash      string      `json:"-" db:"data_hash"`
+	LastSeenAt    time.Time   `json:"last_seen_at" db:"last_seen_at"`
+	ChangedAt     time.Time   `json:"changed_at" db:"changed_at"`
 	UpdatedAt     time.Time   `json:"updated_at" db:"updated_at"`
 }
 
 type RouteTable struct {
 	Id         string    `json:"id"`
 	CustomerId string    `json:"customer_id" db:"customer_id"`
+	Region     string    `json:"region"`
+	AccountId  string    `json:"account_id" db:"account_id"`
 	Data       []byte    `json:"data"`
 	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	DataHash   string    `json:"-" db:"data_hash"`
+	LastSeenAt time.Time `json:"last_seen_at" db:"last_seen_at"`
+	ChangedAt  time.Time `json:"changed_at" db:"changed_at"`
 	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
 }
 
 type Subnet struct {
 	Id         string    `json:"id"`
 	CustomerId string    `json:"customer_id" db:"customer_id"`
+	Region     string    `json:"region"`
+	AccountId  string    `json:"account_id" db:"account_id"`
 	Data       []byte    `json:"data"`
 	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	DataHash   string    `json:"-" db:"data_hash"`
+	LastSeenAt time.Time `json:"last_seen_at" db:"last_seen_at"`
+	ChangedAt  time.Time `json:"changed_at" db:"changed_at"`
 	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
 }
 
+// InventoryEventsRequest lists a customer's events after the event id After,
+// optionally only those of the given entity types.
+type InventoryEventsRequest struct {
+	CustomerId  string   `json:"customer_id"`
+	After       int64    `json:"after"`
+	EntityTypes []string `json:"entity_types"`
+	Limit       int      `json:"limit"`
+}
+
+type InventoryEventsResponse struct {
+	Events []*InventoryEvent `json:"events"`
+}
+
+type PurgeInventoryEventsRequest struct {
+	Before time.Time `json:"before"`
+}
+
+type PurgeInventoryEventsResponse struct {
+	Deleted int64 `json:"deleted"`
+}
+
+// InventoryEvent records an entity or group membership being created,
+// updated or deleted. Membership events carry the instance id as EntityId
+// and the group in GroupName.
+type InventoryEvent struct {
+	Id         int64     `json:"id"`
+	CustomerId string    `json:"customer_id" db:"customer_id"`
+	Action     string    `json:"action"`
+	EntityType string    `json:"entity_type" db:"entity_type"`
+	EntityId   string    `json:"entity_id" db:"entity_id"`
+	Region     string    `json:"region"`
+	AccountId  string    `json:"account_id" db:"account_id"`
+	GroupName  string    `json:"group_name,omitempty" db:"group_name"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// Inventory event entity types.
+const (
+	InstanceEventType   = "instance"
+	GroupEventType      = "group"
+	RouteTableEventType = "route_table"
+	SubnetEventType     = "subnet"
+	MembershipEventType = "membership"
+)
+
+// InventoryEventTypes are the entity types inventory events can have.
+var InventoryEventTypes = []string{InstanceEventType, GroupEventType, RouteTableEventType, SubnetEventType, MembershipEventType}
+
+// Inventory event actions.
+const (
+	CreatedAction = "created"
+	UpdatedAction = "updated"
+	DeletedAction = "deleted"
+)
+
+// InventoryEventActions are the actions inventory events can have.
+var InventoryEventActions = []string{CreatedAction, UpdatedAction, DeletedAction}
+
+// WebhookRequest names one of a customer's webhooks. Admins may leave the
+// customer empty.
+type WebhookRequest struct {
+	CustomerId string `json:"customer_id"`
+	Id         int64  `json:"id"`
+}
+
+type WebhookResponse struct {
+	Webhook *Webhook `json:"webhook"`
+}
+
+type WebhooksRequest struct {
+	CustomerId string `json:"customer_id"`
+}
+
+type WebhooksResponse struct {
+	Webhooks []*Webhook `json:"webhooks"`
+}
+
+// ClaimWebhooksRequest leases up to Limit enabled webhooks that are due and
+// have events after their cursor to Owner for Lease, so replicas don't
+// deliver the same events.
+type ClaimWebhooksRequest struct {
+	Owner string        `json:"owner"`
+	Lease time.Duration `json:"lease"`
+	Limit int           `json:"limit"`
+}
+
+type WebhookDeliveriesRequest struct {
+	CustomerId string `json:"customer_id"`
+	WebhookId  int64  `json:"webhook_id"`
+	Limit      int    `json:"limit"`
+}
+
+type WebhookDeliveriesResponse struct {
+	Deliveries []*WebhookDelivery `json:"deliveries"`
+}
+
+type PurgeWebhookDeliveriesRequest struct {
+	Before time.Time `json:"before"`
+}
+
+type PurgeWebhookDeliveriesResponse struct {
+	Deleted int64 `json:"deleted"`
+}
+
+// Webhook posts a customer's inventory events, optionally only those of some
+// entity types and actions, to a url. LastEventId is the last event it has
+// delivered. After consecutive failures it backs off until NextAttemptAt, and
+// is disabled once there are too many.
+type Webhook struct {
+	Id             int64      `json:"id"`
+	CustomerId     string     `json:"customer_id" db:"customer_id"`
+	Url            string     `json:"url"`
+	Secret         string     `json:"secret,omitempty"`
+	EntityTypes    StringList `json:"entity_types" db:"entity_types"`
+	Actions        StringList `json:"actions"`
+	Enabled        bool       `json:"enabled"`
+	Failures       int        `json:"failures"`
+	LastEventId    int64      `json:"last_event_id" db:"last_event_id"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at" db:"next_attempt_at"`
+	LeaseOwner     string     `json:"-" db:"lease_owner"`
+	LeaseUntil     *time.Time `json:"-" db:"lease_until"`
+	DisabledAt     *time.Time `json:"disabled_at,omitempty" db:"disabled_at"`
+	DisabledReason string     `json:"disabled_reason,omitempty" db:"disabled_reason"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// Matches reports whether the webhook wants an event.
+func (w *Webhook) Matches(event *InventoryEvent) bool {
+	return w.EntityTypes.Allows(event.EntityType) && w.Actions.Allows(event.Action)
+}
+
+// WebhookDelivery logs an attempt to deliver an event to a webhook.
+type WebhookDelivery struct {
+	Id         int64     `json:"id"`
+	WebhookId  int64     `json:"webhook_id" db:"webhook_id"`
+	EventId    int64     `json:"event_id" db:"event_id"`
+	Action     string    `json:"action"`
+	Attempt    int       `json:"attempt"`
+	Succeeded  bool      `json:"succeeded"`
+	StatusCode int       `json:"status_code" db:"status_code"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms" db:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// StringList is stored as a comma-separated string. An empty list allows
+// everything.
+type StringList []string
+
+func (l StringList) Allows(s string) bool {
+	if len(l) == 0 {
+		return true
+	}
+
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l StringList) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+func (l *StringList) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case nil:
+	default:
+		return fmt.Errorf("can't scan %T into a StringList", src)
+	}
+
+	*l = StringList{}
+	if s != "" {
+		*l = strings.Split(s, ",")
+	}
+
+	return nil
+}
+
 const (
+	GlobalIngestScope   = "global"
+	CustomerIngestScope = "customer"
+	TypeIngestScope     = "type"
+
 	InstanceEntityType         = "Instance"
 	DBInstanceEntityType       = "DBInstance"
 	SecurityGroupEntityType    = "SecurityGroup"
@@ -142,79 +634,131 @@ const (
 	DBSecurityGroupStoreType  = "rds-security"
 	AutoScalingGroupStoreType = "autoscaling"
 	ELBStoreType              = "elb"
+	RouteTableStoreType       = "route_table"
+	SubnetStoreType           = "subnet"
+	// tag and attribute groups are derived from instances, not ingested
+	TagStoreType       = "tag"
+	AttributeStoreType = "attribute"
 )
 
+// StoreTypes are the types entities are stored and routed under.
+// EntityTypes are the message types NewEntity accepts.
+var EntityTypes = []string{InstanceEntityType, DBInstanceEntityType, SecurityGroupEntityType, AutoScalingGroupEntityType, ELBEntityType, RouteTableEntityType, SubnetEntityType}
+
+var StoreTypes = []string{InstanceStoreType, DBInstanceStoreType, SecurityGroupStoreType, DBSecurityGroupStoreType, AutoScalingGroupStoreType, ELBStoreType, RouteTableStoreType, SubnetStoreType}
+
 var (
 	ErrMissingInstanceId   = errors.New("must provide instance id")
 	ErrMissingGroupId      = errors.New("must provide group id")
 	ErrMissingRouteTableId = errors.New("must provide route table id")
 	ErrMissingSubnetId     = errors.New("must provide subnet id")
 	ErrMissingCustomerId   = errors.New("must provide customer id")
+	ErrAmbiguousEntity     = errors.New("more than one region or account has an entity with that id, must provide region and account")
 	ErrMissingType         = errors.New("must provide type")
 	ErrMissingBody         = errors.New("must provide body")
+	ErrUnsupportedType     = errors.New("unsupported entity type")
 )
 
-func NewEntity(entityType, customerId string, blob []byte) (interface{}, error) {
+// NewEntity builds the entity an event describes. The account is worked out
+// once, from the event or else from the entity's own data, and given to the
+// entity, its member instances and their security groups alike, so an
+// instance is stored under one account however it's described.
+func NewEntity(entityType, customerId, region, accountId string, blob []byte) (interface{}, error) {
+	var data interface{}
+
+	switch entityType {
+	case InstanceEntityType:
+		data = &opsee_aws_ec2.Instance{}
+	case DBInstanceEntityType:
+		data = &opsee_aws_rds.DBInstance{}
+	case SecurityGroupEntityType:
+		data = &opsee_aws_ec2.SecurityGroup{}
+	case ELBEntityType:
+		data = &opsee_aws_elb.LoadBalancerDescription{}
+	case AutoScalingGroupEntityType:
+		data = &opsee_aws_autoscaling.Group{}
+	case RouteTableEntityType:
+		data = &opsee_aws_ec2.RouteTable{}
+	case SubnetEntityType:
+		data = &opsee_aws_ec2.Subnet{}
+	default:
+		return nil, ErrUnsupportedType
+	}
+
+	if err := json.Unmarshal(blob, data); err != nil {
+		return nil, err
+	}
+
+	// an account the data doesn't say is left empty, as it is for events
+	// from bastions that don't send one, rather than refusing the entity
+	if accountId == "" {
+		accountId = ownerAccountId(data)
+	}
+
 	var (
 		err    error
 		entity interface{}
 	)
 
-	switch entityType {
-	case InstanceEntityType:
-		instanceData := &opsee_aws_ec2.Instance{}
-		if err = json.Unmarshal(blob, instanceData); err != nil {
-			break
-		}
-		entity, err = NewInstance(customerId, instanceData)
+	switch t := data.(type) {
+	case *opsee_aws_ec2.Instance, *opsee_aws_rds.DBInstance:
+		entity, err = NewInstance(customerId, region, accountId, t)
+	case *opsee_aws_ec2.SecurityGroup, *opsee_aws_elb.LoadBalancerDescription, *opsee_aws_autoscaling.Group:
+		entity, err = NewGroup(customerId, region, accountId, t)
+	case *opsee_aws_ec2.RouteTable:
+		entity, err = NewRouteTable(customerId, region, accountId, t)
+	case *opsee_aws_ec2.Subnet:
+		entity, err = NewSubnet(customerId, region, accountId, t)
+	}
 
-	case DBInstanceEntityType:
-		dbInstanceData := &opsee_aws_rds.DBInstance{}
-		if err = json.Unmarshal(blob, dbInstanceData); err != nil {
-			break
-		}
-		entity, err = NewInstance(customerId, dbInstanceData)
+	return entity, err
+}
 
-	case SecurityGroupEntityType:
-		secGroupData := &opsee_aws_ec2.SecurityGroup{}
-		if err = json.Unmarshal(blob, secGroupData); err != nil {
-			break
+// ownerAccountId is the account an entity's data says owns it, for events
+// that don't say: an EC2 instance's network interfaces' owner, a security
+// group's owner or the account in an autoscaling group's ARN. Load
+// balancers, RDS instances, route tables and subnets don't say.
+func ownerAccountId(data interface{}) string {
+	switch t := data.(type) {
+	case *opsee_aws_ec2.Instance:
+		for _, iface := range t.NetworkInterfaces {
+			if owner := aws.StringValue(iface.OwnerId); owner != "" {
+				return owner
+			}
 		}
-		entity, err = NewGroup(customerId, secGroupData)
 
-	case ELBEntityType:
-		elbData := &opsee_aws_elb.LoadBalancerDescription{}
-		if err = json.Unmarshal(blob, elbData); err != nil {
-			break
-		}
-		entity, err = NewGroup(customerId, elbData)
+	case *opsee_aws_ec2.SecurityGroup:
+		return aws.StringValue(t.OwnerId)
 
-	case AutoScalingGroupEntityType:
-		autoscalingData := &opsee_aws_autoscaling.Group{}
-		if err = json.Unmarshal(blob, autoscalingData); err != nil {
-			break
+	case *opsee_aws_autoscaling.Group:
+		// arn:aws:autoscaling:<region>:<account>:autoScalingGroup:...
+		parts := strings.SplitN(aws.StringValue(t.AutoScalingGroupARN), ":", 6)
+		if len(parts) == 6 && parts[0] == "arn" {
+			return parts[4]
 		}
-		entity, err = NewGroup(customerId, autoscalingData)
+	}
 
-	case RouteTableEntityType:
-		routeTableData := &opsee_aws_ec2.RouteTable{}
-		if err = json.Unmarshal(blob, routeTableData); err != nil {
-			break
-		}
-		entity, err = NewRouteTable(customerId, routeTableData)
+	return ""
+}
 
-	case SubnetEntityType:
-		subnetData := &opsee_aws_ec2.Subnet{}
-		if err = json.Unmarshal(blob, subnetData); err != nil {
-			break
-		}
-		entity, err = NewSubnet(customerId, subnetData)
+// EntityCustomerId returns the customer an entity built by NewEntity belongs
+// to.
+func EntityCustomerId(entity interface{}) (string, error) {
+	switch e := entity.(type) {
+	case *Instance:
+		return e.CustomerId, nil
+	case *Group:
+		return e.CustomerId, nil
+	case *RouteTable:
+		return e.CustomerId, nil
+	case *Subnet:
+		return e.CustomerId, nil
 	}
 
-	return entity, err
+	return "", ErrUnsupportedType
 }
 
-func NewInstance(customerId string, instanceData interface{}) (*Instance, error) {
+func NewInstance(customerId, region, accountId string, instanceData interface{}) (*Instance, error) {
 	var (
 		instance *Instance
 		groups   []*Group
@@ -234,7 +778,7 @@ func NewInstance(customerId string, instanceData interface{}) (*Instance, error)
 			gr := &opsee_aws_ec2.SecurityGroup{}
 			opsee_aws.CopyInto(gr, group)
 
-			g, err := NewGroup(customerId, gr)
+			g, err := NewGroup(customerId, region, accountId, gr)
 			if err != nil {
 				continue
 			}
@@ -245,6 +789,8 @@ func NewInstance(customerId string, instanceData interface{}) (*Instance, error)
 		instance = &Instance{
 			Id:         aws.StringValue(t.InstanceId),
 			CustomerId: customerId,
+			Region:     region,
+			AccountId:  accountId,
 			Type:       InstanceStoreType,
 			Groups:     groups,
 			Data:       jsonD,
@@ -261,7 +807,7 @@ func NewInstance(customerId string, instanceData interface{}) (*Instance, error)
 			gr := &opsee_aws_ec2.SecurityGroup{}
 			opsee_aws.CopyInto(gr, group)
 
-			g, err := NewGroup(customerId, gr)
+			g, err := NewGroup(customerId, region, accountId, gr)
 			if err != nil {
 				continue
 			}
@@ -273,6 +819,8 @@ func NewInstance(customerId string, instanceData interface{}) (*Instance, error)
 		instance = &Instance{
 			Id:         aws.StringValue(t.DBInstanceIdentifier),
 			CustomerId: customerId,
+			Region:     region,
+			AccountId:  accountId,
 			Type:       DBInstanceStoreType,
 			Groups:     groups,
 			Data:       jsonD,
@@ -288,7 +836,7 @@ func NewInstance(customerId string, instanceData interface{}) (*Instance, error)
 	return instance, nil
 }
 
-func NewGroup(customerId string, groupData interface{}) (*Group, error) {
+func NewGroup(customerId, region, accountId string, groupData interface{}) (*Group, error) {
 	var (
 		group *Group
 		jsonD []byte
@@ -304,6 +852,8 @@ func NewGroup(customerId string, groupData interface{}) (*Group, error) {
 		jsonD, err = json.Marshal(t)
 		group = &Group{
 			CustomerId: customerId,
+			Region:     region,
+			AccountId:  accountId,
 			Name:       aws.StringValue(t.GroupId),
 			Type:       SecurityGroupStoreType,
 			Data:       jsonD,
@@ -319,7 +869,7 @@ func NewGroup(customerId string, groupData interface{}) (*Group, error) {
 			inst := &opsee_aws_ec2.Instance{}
 			opsee_aws.CopyInto(inst, instance)
 
-			ii, err := NewInstance(customerId, inst)
+			ii, err := NewInstance(customerId, region, accountId, inst)
 			if err != nil {
 				continue
 			}
@@ -330,6 +880,8 @@ func NewGroup(customerId string, groupData interface{}) (*Group, error) {
 		jsonD, err = json.Marshal(t)
 		group = &Group{
 			CustomerId: customerId,
+			Region:     region,
+			AccountId:  accountId,
 			Name:       aws.StringValue(t.LoadBalancerName),
 			Type:       ELBStoreType,
 			Data:       jsonD,
@@ -346,7 +898,7 @@ func NewGroup(customerId string, groupData interface{}) (*Group, error) {
 			inst := &opsee_aws_ec2.Instance{}
 			opsee_aws.CopyInto(inst, instance)
 
-			ii, err := NewInstance(customerId, inst)
+			ii, err := NewInstance(customerId, region, accountId, inst)
 			if err != nil {
 				continue
 			}
@@ -357,6 +909,8 @@ func NewGroup(customerId string, groupData interface{}) (*Group, error) {
 		jsonD, err = json.Marshal(t)
 		group = &Group{
 			CustomerId: customerId,
+			Region:     region,
+			AccountId:  accountId,
 			Name:       aws.StringValue(t.AutoScalingGroupName),
 			Type:       AutoScalingGroupStoreType,
 			Data:       jsonD,
@@ -373,7 +927,7 @@ func NewGroup(customerId string, groupData interface{}) (*Group, error) {
 	return group, nil
 }
 
-func NewRouteTable(customerId string, routeTableData *opsee_aws_ec2.RouteTable) (*RouteTable, error) {
+func NewRouteTable(customerId, region, accountId string, routeTableData *opsee_aws_ec2.RouteTable) (*RouteTable, error) {
 	jsonD, err := json.Marshal(routeTableData)
 
 	if err != nil {
@@ -383,11 +937,13 @@ func NewRouteTable(customerId string, routeTableData *opsee_aws_ec2.RouteTable)
 	return &RouteTable{
 		Id:         aws.StringValue(routeTableData.RouteTableId),
 		CustomerId: customerId,
+		Region:     region,
+		AccountId:  accountId,
 		Data:       jsonD,
 	}, nil
 }
 
-func NewSubnet(customerId string, subnetData *opsee_aws_ec2.Subnet) (*Subnet, error) {
+func NewSubnet(customerId, region, accountId string, subnetData *opsee_aws_ec2.Subnet) (*Subnet, error) {
 	jsonD, err := json.Marshal(subnetData)
 
 	if err != nil {
@@ -397,6 +953,8 @@ func NewSubnet(customerId string, subnetData *opsee_aws_ec2.Subnet) (*Subnet, er
 	return &Subnet{
 		Id:         aws.StringValue(subnetData.SubnetId),
 		CustomerId: customerId,
+		Region:     region,
+		AccountId:  accountId,
 		Data:       jsonD,
 	}, nil
 }
@@ -408,3 +966,65 @@ func (i *Instance) MarshalJSON() ([]byte, error) {
 func (g *Group) MarshalJSON() ([]byte, error) {
 	return g.Data, nil
 }
+
+// summarize fills in the instance's summary, unless it has one.
+func (i *Instance) summarize() error {
+	if i.Summary != nil {
+		return nil
+	}
+
+	summary, err := Summarize(i.Type, i.Id, i.Data)
+	if err != nil {
+		return err
+	}
+
+	i.Summary = summary
+	return nil
+}
+
+// summarize fills in the group's summary, unless it has one.
+func (g *Group) summarize() error {
+	if g.Summary != nil {
+		return nil
+	}
+
+	summary, err := Summarize(g.Type, g.Name, g.Data)
+	if err != nil {
+		return err
+	}
+
+	g.Summary = summary
+	return nil
+}
+
+// viewSummary swaps the instance's data for its summary, so it's what the
+// instance marshals to.
+func (i *Instance) viewSummary() error {
+	if err := i.summarize(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(i.Summary)
+	if err != nil {
+		return err
+	}
+
+	i.Data = data
+	return nil
+}
+
+// viewSummary swaps the group's data for its summary, so it's what the group
+// marshals to.
+func (g *Group) viewSummary() error {
+	if err := g.summarize(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(g.Summary)
+	if err != nil {
+		return err
+	}
+
+	g.Data = data
+	return nil
+}
@@ -0,0 +1,239 @@
+package store
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	opsee_aws_autoscaling "github.com/opsee/basic/schema/aws/autoscaling"
+	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
+	opsee_aws_elb "github.com/opsee/basic/schema/aws/elb"
+	opsee_aws_rds "github.com/opsee/basic/schema/aws/rds"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+	"strings"
+	"time"
+)
+
+// Views of entities. The data view is an entity's data as AWS describes it,
+// the summary view its Summary.
+const (
+	DataView    = "data"
+	SummaryView = "summary"
+)
+
+// Views are the views entities can be listed and fetched in.
+var Views = []string{DataView, SummaryView}
+
+// Summary is the same handful of fields for every type of instance and
+// group, so clients needn't know each type's AWS schema. Name is the Name
+// tag, or the id when there's none. LaunchedAt is when an instance was
+// launched, or a group created.
+type Summary struct {
+	Id                string     `json:"id"`
+	Type              string     `json:"type"`
+	Name              string     `json:"name"`
+	State             string     `json:"state,omitempty"`
+	PrivateIps        []string   `json:"private_ips"`
+	PublicIps         []string   `json:"public_ips"`
+	DnsNames          []string   `json:"dns_names"`
+	AvailabilityZones []string   `json:"availability_zones"`
+	VpcId             string     `json:"vpc_id,omitempty"`
+	SubnetIds         []string   `json:"subnet_ids"`
+	LaunchedAt        *time.Time `json:"launched_at,omitempty"`
+}
+
+// Summaries are stored as jsonb alongside entities' data.
+func (s Summary) Value() (driver.Value, error) {
+	return json.Marshal(s)
+}
+
+func (s *Summary) Scan(src interface{}) error {
+	switch b := src.(type) {
+	case []byte:
+		return json.Unmarshal(b, s)
+	case string:
+		return json.Unmarshal([]byte(b), s)
+	default:
+		return fmt.Errorf("can't scan %T into Summary", src)
+	}
+}
+
+// Summarize summarizes an entity's data by its store type. Types it doesn't
+// know get a summary with just the id.
+func Summarize(entityType, id string, data []byte) (*Summary, error) {
+	s := &Summary{
+		Id:                id,
+		Type:              entityType,
+		Name:              id,
+		PrivateIps:        []string{},
+		PublicIps:         []string{},
+		DnsNames:          []string{},
+		AvailabilityZones: []string{},
+		SubnetIds:         []string{},
+	}
+
+	switch entityType {
+	case InstanceStoreType:
+		instance := &opsee_aws_ec2.Instance{}
+		if err := json.Unmarshal(data, instance); err != nil {
+			return nil, err
+		}
+
+		s.named(nameTag(instance.Tags))
+		if instance.State != nil {
+			s.State = aws.StringValue(instance.State.Name)
+		}
+		s.add(&s.PrivateIps, instance.PrivateIpAddress)
+		s.add(&s.PublicIps, instance.PublicIpAddress)
+		s.add(&s.DnsNames, instance.PrivateDnsName, instance.PublicDnsName)
+
+		for _, iface := range instance.NetworkInterfaces {
+			s.add(&s.PrivateIps, iface.PrivateIpAddress)
+			s.add(&s.DnsNames, iface.PrivateDnsName)
+
+			for _, address := range iface.PrivateIpAddresses {
+				s.add(&s.PrivateIps, address.PrivateIpAddress)
+				s.add(&s.DnsNames, address.PrivateDnsName)
+				if address.Association != nil {
+					s.add(&s.PublicIps, address.Association.PublicIp)
+					s.add(&s.DnsNames, address.Association.PublicDnsName)
+				}
+			}
+
+			if iface.Association != nil {
+				s.add(&s.PublicIps, iface.Association.PublicIp)
+				s.add(&s.DnsNames, iface.Association.PublicDnsName)
+			}
+		}
+
+		if instance.Placement != nil {
+			s.add(&s.AvailabilityZones, instance.Placement.AvailabilityZone)
+		}
+		s.VpcId = aws.StringValue(instance.VpcId)
+		s.add(&s.SubnetIds, instance.SubnetId)
+		s.LaunchedAt = timestamp(instance.LaunchTime)
+
+	case DBInstanceStoreType:
+		db := &opsee_aws_rds.DBInstance{}
+		if err := json.Unmarshal(data, db); err != nil {
+			return nil, err
+		}
+
+		s.State = aws.StringValue(db.DBInstanceStatus)
+		if db.Endpoint != nil {
+			s.add(&s.DnsNames, db.Endpoint.Address)
+		}
+		s.add(&s.AvailabilityZones, db.AvailabilityZone, db.SecondaryAvailabilityZone)
+		if db.DBSubnetGroup != nil {
+			s.VpcId = aws.StringValue(db.DBSubnetGroup.VpcId)
+			for _, subnet := range db.DBSubnetGroup.Subnets {
+				s.add(&s.SubnetIds, subnet.SubnetIdentifier)
+			}
+		}
+		s.LaunchedAt = timestamp(db.InstanceCreateTime)
+
+	case SecurityGroupStoreType:
+		group := &opsee_aws_ec2.SecurityGroup{}
+		if err := json.Unmarshal(data, group); err != nil {
+			return nil, err
+		}
+
+		s.named(aws.StringValue(group.GroupName))
+		s.named(nameTag(group.Tags))
+		s.VpcId = aws.StringValue(group.VpcId)
+
+	case ELBStoreType:
+		elb := &opsee_aws_elb.LoadBalancerDescription{}
+		if err := json.Unmarshal(data, elb); err != nil {
+			return nil, err
+		}
+
+		s.add(&s.DnsNames, elb.DNSName)
+		s.AvailabilityZones = append(s.AvailabilityZones, elb.AvailabilityZones...)
+		s.VpcId = aws.StringValue(elb.VPCId)
+		s.SubnetIds = append(s.SubnetIds, elb.Subnets...)
+		s.LaunchedAt = timestamp(elb.CreatedTime)
+
+	case AutoScalingGroupStoreType:
+		group := &opsee_aws_autoscaling.Group{}
+		if err := json.Unmarshal(data, group); err != nil {
+			return nil, err
+		}
+
+		for _, tag := range group.Tags {
+			if aws.StringValue(tag.Key) == "Name" {
+				s.named(aws.StringValue(tag.Value))
+			}
+		}
+		s.State = aws.StringValue(group.Status)
+		s.AvailabilityZones = append(s.AvailabilityZones, group.AvailabilityZones...)
+		for _, subnetId := range strings.Split(aws.StringValue(group.VPCZoneIdentifier), ",") {
+			if subnetId = strings.TrimSpace(subnetId); subnetId != "" {
+				s.SubnetIds = append(s.SubnetIds, subnetId)
+			}
+		}
+		s.LaunchedAt = timestamp(group.CreatedTime)
+
+	case TagStoreType, AttributeStoreType:
+		derived := &DerivedGroup{}
+		if err := json.Unmarshal(data, derived); err != nil {
+			return nil, err
+		}
+
+		if derived.Key != "" {
+			s.named(derived.Key + "=" + derived.Value)
+		} else {
+			s.named(derived.Value)
+		}
+	}
+
+	return s, nil
+}
+
+// named names the summary, unless name is empty.
+func (s *Summary) named(name string) {
+	if name != "" {
+		s.Name = name
+	}
+}
+
+// add appends the values that are set and not already in list.
+func (s *Summary) add(list *[]string, values ...*string) {
+	for _, value := range values {
+		v := aws.StringValue(value)
+		if v == "" {
+			continue
+		}
+
+		found := false
+		for _, existing := range *list {
+			if existing == v {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			*list = append(*list, v)
+		}
+	}
+}
+
+func nameTag(tags []*opsee_aws_ec2.Tag) string {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == "Name" {
+			return aws.StringValue(tag.Value)
+		}
+	}
+
+	return ""
+}
+
+func timestamp(t *opsee_types.Timestamp) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	tm := time.Unix(0, t.Millis()*int64(time.Millisecond)).UTC()
+	return &tm
+}
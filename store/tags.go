@@ -0,0 +1,47 @@
+package store
+
+import (
+	"strings"
+)
+
+// TagsRequest lists the tags on a customer's entities. Prefix matches the
+// start of tag keys, for autocompletion, and ValuePrefix the start of their
+// values. Key, EntityType, Region and AccountId narrow the catalog down.
+type TagsRequest struct {
+	CustomerId  string `json:"customer_id"`
+	Prefix      string `json:"prefix"`
+	Key         string `json:"key"`
+	ValuePrefix string `json:"value_prefix"`
+	EntityType  string `json:"entity_type"`
+	Region      string `json:"region"`
+	AccountId   string `json:"account_id"`
+}
+
+type TagsResponse struct {
+	Tags []*TagKey `json:"tags"`
+}
+
+// TagKey is a tag key, with the distinct values it has and how many
+// resources are tagged with each.
+type TagKey struct {
+	Key       string      `json:"key"`
+	Resources int64       `json:"resources"`
+	Values    []*TagValue `json:"values"`
+}
+
+type TagValue struct {
+	Value     string `json:"value"`
+	Resources int64  `json:"resources"`
+}
+
+// tagCount is a row of the tag catalog query.
+type tagCount struct {
+	Key       string `db:"key"`
+	Value     string `db:"value"`
+	Resources int64  `db:"resources"`
+}
+
+// likePrefix escapes a prefix for a like pattern.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
@@ -0,0 +1,449 @@
+// Package webhooks delivers customers' inventory events to the webhooks they
+// register. Each webhook has a cursor into the inventory event log, so events
+// are delivered in order, at least once, and survive restarts.
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/fieri/metrics"
+	"github.com/opsee/fieri/store"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// PingAction is the action of the event sent by Ping.
+	PingAction = "ping"
+
+	SignatureHeader = "X-Fieri-Signature"
+	TimestampHeader = "X-Fieri-Timestamp"
+	EventHeader     = "X-Fieri-Event"
+	EventIdHeader   = "X-Fieri-Event-Id"
+	WebhookIdHeader = "X-Fieri-Webhook-Id"
+
+	claimLimit    = 16
+	eventPage     = 100
+	purgeInterval = time.Hour
+	minBackoff    = 10 * time.Second
+	maxBackoff    = time.Hour
+)
+
+var (
+	deliveries        = metrics.NewCounter("fieri_webhook_deliveries_total", "Webhook deliveries by result (succeeded or failed).", "result")
+	deliveryDuration  = metrics.NewHistogram("fieri_webhook_delivery_duration_seconds", "Webhook delivery latency.", metrics.DefaultBuckets)
+	disabledWebhooks  = metrics.NewCounter("fieri_webhooks_disabled_total", "Webhooks disabled after too many consecutive failures.")
+	purgedDeliveries  = metrics.NewCounter("fieri_webhook_deliveries_purged_total", "Webhook delivery log entries deleted after the retention period.")
+	deliveryBodyLimit = int64(1024)
+)
+
+// ErrPrivateAddress is the error dialing a webhook whose host resolves to an
+// address fieri won't post to.
+var ErrPrivateAddress = errors.New("webhook address is private, loopback or link-local")
+
+// Payload is the json body posted to a webhook.
+type Payload struct {
+	WebhookId int64                 `json:"webhook_id"`
+	Event     *store.InventoryEvent `json:"event"`
+	SentAt    time.Time             `json:"sent_at"`
+}
+
+// Config tunes delivery.
+type Config struct {
+	// Interval is how often due webhooks are looked for.
+	Interval time.Duration
+	// Timeout bounds each delivery.
+	Timeout time.Duration
+	// MaxFailures is how many consecutive failed deliveries disable a
+	// webhook.
+	MaxFailures int
+	// Retention is how long the delivery log is kept.
+	Retention time.Duration
+	// AllowPrivate allows delivering to private, loopback and link-local
+	// addresses, which are refused otherwise.
+	AllowPrivate bool
+}
+
+// Dispatcher claims webhooks with undelivered events and posts the events to
+// them, backing off exponentially after each consecutive failure.
+type Dispatcher struct {
+	db       store.Store
+	client   *http.Client
+	config   *Config
+	owner    string
+	inFlight int64
+	wg       *sync.WaitGroup
+	stopChan chan struct{}
+	doneChan chan struct{}
+	stopOnce *sync.Once
+}
+
+// New makes a dispatcher whose client doesn't follow redirects and, unless
+// AllowPrivate is set, only connects to public addresses, checked after DNS
+// resolution, so a webhook can't be pointed at fieri's own network.
+func New(db store.Store, config *Config) *Dispatcher {
+	hostname, _ := os.Hostname()
+
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	if !config.AllowPrivate {
+		dialer.Control = refusePrivate
+	}
+
+	client := &http.Client{
+		Timeout: config.Timeout,
+		// no proxy, which would be dialed in the webhook's place
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: config.Timeout,
+			MaxIdleConnsPerHost: 2,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return &Dispatcher{
+		db:       db,
+		client:   client,
+		config:   config,
+		owner:    fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		wg:       &sync.WaitGroup{},
+		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+		stopOnce: &sync.Once{},
+	}
+}
+
+// Start delivers events every interval until Stop is called.
+func (d *Dispatcher) Start() {
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+
+	purge := time.NewTicker(purgeInterval)
+	defer purge.Stop()
+
+	defer close(d.doneChan)
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.dispatch(); err != nil {
+				log.WithError(err).Error("error claiming webhooks")
+			}
+
+		case <-purge.C:
+			response, err := d.db.PurgeWebhookDeliveries(&store.PurgeWebhookDeliveriesRequest{Before: time.Now().Add(-d.config.Retention)})
+			if err != nil {
+				log.WithError(err).Error("error purging webhook deliveries")
+				continue
+			}
+			purgedDeliveries.Add(float64(response.Deleted))
+
+		case <-d.stopChan:
+			return
+		}
+	}
+}
+
+// Stop ends the dispatch loop, waiting for deliveries in progress to finish.
+func (d *Dispatcher) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stopChan)
+		<-d.doneChan
+		d.wg.Wait()
+	})
+}
+
+// dispatch claims due webhooks, up to claimLimit being delivered at once, and
+// delivers each one's events in its own goroutine, which releases it when
+// it's done. A slow webhook doesn't hold up the others, or the next claim.
+func (d *Dispatcher) dispatch() error {
+	available := claimLimit - atomic.LoadInt64(&d.inFlight)
+	if available <= 0 {
+		return nil
+	}
+
+	response, err := d.db.ClaimWebhooks(&store.ClaimWebhooksRequest{
+		Owner: d.owner,
+		// long enough for a page of deliveries that all time out
+		Lease: d.config.Timeout*eventPage + time.Minute,
+		Limit: int(available),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, webhook := range response.Webhooks {
+		d.wg.Add(1)
+		atomic.AddInt64(&d.inFlight, 1)
+
+		go func(webhook *store.Webhook) {
+			defer d.wg.Done()
+			defer atomic.AddInt64(&d.inFlight, -1)
+			d.deliverEvents(webhook)
+		}(webhook)
+	}
+
+	return nil
+}
+
+// deliverEvents delivers a page of a claimed webhook's events in order,
+// stopping at the first failure, then releases it.
+func (d *Dispatcher) deliverEvents(webhook *store.Webhook) {
+	logger := log.WithFields(log.Fields{"customer-id": webhook.CustomerId, "webhook-id": webhook.Id})
+
+	defer func() {
+		webhook.LeaseUntil = nil
+		if err := d.db.UpdateWebhook(webhook); err != nil {
+			logger.WithError(err).Error("error saving webhook")
+		}
+	}()
+
+	response, err := d.db.ListInventoryEvents(&store.InventoryEventsRequest{
+		CustomerId: webhook.CustomerId,
+		After:      webhook.LastEventId,
+		Limit:      eventPage,
+	})
+	if err != nil {
+		logger.WithError(err).Error("error listing inventory events for webhook")
+		return
+	}
+
+	for _, event := range response.Events {
+		select {
+		case <-d.stopChan:
+			return
+		default:
+		}
+
+		if !webhook.Matches(event) {
+			webhook.LastEventId = event.Id
+			continue
+		}
+
+		delivery := d.deliver(webhook, event)
+		delivery.Attempt = webhook.Failures + 1
+		if err := d.db.PutWebhookDelivery(delivery); err != nil {
+			logger.WithError(err).Error("error logging webhook delivery")
+		}
+
+		if !delivery.Succeeded {
+			d.fail(webhook, delivery, logger)
+			return
+		}
+
+		webhook.LastEventId = event.Id
+		webhook.Failures = 0
+		webhook.NextAttemptAt = time.Now()
+
+		// keep the cursor current, so a crash redelivers as little as
+		// possible
+		if err := d.db.UpdateWebhook(webhook); err != nil {
+			logger.WithError(err).Error("error saving webhook")
+		}
+	}
+}
+
+// fail backs a webhook off after a failed delivery, disabling it once it has
+// failed MaxFailures times in a row.
+func (d *Dispatcher) fail(webhook *store.Webhook, delivery *store.WebhookDelivery, logger *log.Entry) {
+	webhook.Failures++
+	webhook.NextAttemptAt = time.Now().Add(Backoff(webhook.Failures))
+	logger = logger.WithFields(log.Fields{"failures": webhook.Failures, "event-id": delivery.EventId, "err": delivery.Error})
+
+	if webhook.Failures >= d.config.MaxFailures {
+		now := time.Now()
+		webhook.Enabled = false
+		webhook.DisabledAt = &now
+		webhook.DisabledReason = fmt.Sprintf("%d consecutive failed deliveries, the last: %s", webhook.Failures, delivery.Error)
+		disabledWebhooks.Inc()
+		logger.Warn("disabled webhook")
+		return
+	}
+
+	logger.WithField("next-attempt-at", webhook.NextAttemptAt).Info("webhook delivery failed, backing off")
+}
+
+// Backoff is the delay before retrying a webhook that has failed failures
+// times in a row: 10s doubling each time, up to an hour.
+func Backoff(failures int) time.Duration {
+	backoff := minBackoff
+	for i := 1; i < failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	return backoff
+}
+
+// Ping sends a webhook a ping event, without touching its cursor or
+// failures, and returns the delivery.
+func (d *Dispatcher) Ping(webhook *store.Webhook) *store.WebhookDelivery {
+	delivery := d.deliver(webhook, &store.InventoryEvent{
+		CustomerId: webhook.CustomerId,
+		Action:     PingAction,
+		CreatedAt:  time.Now().UTC(),
+	})
+
+	if err := d.db.PutWebhookDelivery(delivery); err != nil {
+		log.WithError(err).WithField("webhook-id", webhook.Id).Error("error logging webhook delivery")
+	}
+
+	return delivery
+}
+
+// deliver posts one event to a webhook. Any 2xx response is a success.
+func (d *Dispatcher) deliver(webhook *store.Webhook, event *store.InventoryEvent) *store.WebhookDelivery {
+	delivery := &store.WebhookDelivery{
+		WebhookId: webhook.Id,
+		EventId:   event.Id,
+		Action:    event.Action,
+		Attempt:   1,
+	}
+
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		delivery.DurationMs = int64(elapsed / time.Millisecond)
+		deliveryDuration.Observe(elapsed.Seconds())
+
+		if delivery.Succeeded {
+			deliveries.Inc("succeeded")
+		} else {
+			deliveries.Inc("failed")
+		}
+	}()
+
+	body, err := json.Marshal(&Payload{WebhookId: webhook.Id, Event: event, SentAt: start.UTC()})
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+
+	request, err := http.NewRequest("POST", webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "fieri-webhooks")
+	request.Header.Set(TimestampHeader, timestamp)
+	request.Header.Set(SignatureHeader, Sign(webhook.Secret, timestamp, body))
+	request.Header.Set(EventHeader, event.Action)
+	request.Header.Set(EventIdHeader, strconv.FormatInt(event.Id, 10))
+	request.Header.Set(WebhookIdHeader, strconv.FormatInt(webhook.Id, 10))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	defer response.Body.Close()
+
+	// the body is only read to reuse the connection, it isn't kept: it's
+	// whatever the url answered, which the customer may not otherwise see
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, deliveryBodyLimit))
+
+	delivery.StatusCode = response.StatusCode
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		delivery.Error = fmt.Sprintf("webhook responded with status %d", response.StatusCode)
+		return delivery
+	}
+
+	delivery.Succeeded = true
+
+	return delivery
+}
+
+// CheckUrl refuses a webhook url whose host is localhost or an address that
+// isn't public, unless AllowPrivate is set. Other names are checked when
+// they're resolved, at delivery.
+func (d *Dispatcher) CheckUrl(rawurl string) error {
+	if d.config.AllowPrivate {
+		return nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+
+	host := u.Hostname()
+	if ip := net.ParseIP(host); (ip != nil && !PublicAddress(ip)) || strings.EqualFold(host, "localhost") {
+		return ErrPrivateAddress
+	}
+
+	return nil
+}
+
+// PublicAddress is whether fieri may post to ip: it isn't private, loopback,
+// link-local, multicast or unspecified.
+func PublicAddress(ip net.IP) bool {
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// refusePrivate is a dialer Control refusing connections to addresses that
+// aren't public. It sees the address after DNS resolution, so a public name
+// resolving to an internal address is refused too.
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !PublicAddress(ip) {
+		return ErrPrivateAddress
+	}
+
+	return nil
+}
+
+// Sign returns the signature header for a body sent at timestamp: sha256=
+// followed by the hex HMAC-SHA256, keyed with the webhook's secret, of the
+// timestamp, a dot and the body.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature made by Sign.
+func Verify(secret, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// NewSecret returns a random signing secret.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}